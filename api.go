@@ -3,125 +3,427 @@ package chatterbox
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/schnapper79/chatterbox/types"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Server struct {
 	Router       *mux.Router
 	ModelPath    string
 	PathToLLama  string
-	LoadedModels map[string]*Runner
+	MaxNPredict  int            //cap on n_predict of completion requests, 0 => no cap
+	Cache        *ResponseCache //caches deterministic completions, nil => disabled
+	Audit        *AuditLog      //records generation requests, nil => disabled
+	WorkerSecret string         //shared with workers, none => workers can't register
+	EventOrigins []string       //origins allowed to open the events WebSocket besides our own, "*" => any
+	LoadedModels map[string]*Pool
 	Server       *http.Server
+	Konfigs      types.KonfigStore
+	Events       *EventBus
+	Catalog      *Catalog
 	usedPorts    map[int]bool
+	routes       map[string]*types.Route
+	routesPath   string
+	workers      map[string]*types.WorkerInfo
+	sessions     map[string]*session
+	sessionsPath string
+	grammarsPath string
+	ctx          context.Context //done once the server is closed
+	cancel       context.CancelFunc
+	mu           sync.RWMutex
 }
 
-func (s *Server) loadModelHandler(w http.ResponseWriter, r *http.Request) {
-	// Access the model value from the path
-	vars := mux.Vars(r)
-	modelname := vars["model"]
-	if _, ok := s.LoadedModels[modelname]; ok {
-		http.Error(w, "Model already loaded", http.StatusBadRequest)
+const (
+	reloadReadyTimeout = 10 * time.Minute
+	reloadDrainTimeout = 5 * time.Minute
+)
+
+// writeError answers with a 422 and the field errors as JSON if err is a
+// konfig validation error, otherwise with err as text and the given status.
+func writeError(w http.ResponseWriter, err error, status int) {
+	var verr *types.ValidationError
+	if errors.As(err, &verr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(verr)
 		return
 	}
+	http.Error(w, err.Error(), status)
+}
 
-	req := types.NewModelRequestWithDefaults()
-	err := json.NewDecoder(r.Body).Decode(req)
+// resolveKonfig merges config over the konfigs it extends and validates the
+// result.
+func (s *Server) resolveKonfig(config *types.Model_Request) (*types.Model_Request, error) {
+	resolved, err := config.Resolve(s.Konfigs)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return nil, err
 	}
+	return resolved, resolved.Validate(s.ModelPath)
+}
 
-	req.ModelName = modelname
+// pool returns the pool currently serving modelname.
+func (s *Server) pool(modelname string) (*Pool, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.LoadedModels[modelname]
+	return p, ok
+}
 
-	if _, ok := s.usedPorts[req.Port]; ok {
-		http.Error(w, "Port already in use", http.StatusBadRequest)
-		return
+// pick acquires a replica of pool for the request id, moving on to the pool
+// that replaced it if a reload retired pool in the meantime.
+func (s *Server) pick(pool *Pool, aff Affinity, id string) (*Pool, *Runner, int) {
+	runner, slot := pool.Pick(aff, id)
+	if runner == nil && pool.Retired() {
+		if current, ok := s.pool(pool.Config.ModelName); ok && current != pool {
+			pool = current
+			runner, slot = pool.Pick(aff, id)
+		}
 	}
+	return pool, runner, slot
+}
 
-	ctx, Cancel := context.WithCancel(context.Background())
+// freePort returns port if it is unused, otherwise the next unused port above it.
+// Must be called with s.mu held.
+func (s *Server) freePort(port int) int {
+	for s.usedPorts[port] {
+		port++
+	}
+	return port
+}
 
-	newRunner := NewRunner(ctx, Cancel, s.PathToLLama, s.ModelPath, req)
+// reservePorts reserves n unused ports starting at port. Must be called with
+// s.mu held.
+func (s *Server) reservePorts(port, n int) []int {
+	ports := make([]int, n)
+	for i := range ports {
+		port = s.freePort(port)
+		s.usedPorts[port] = true
+		ports[i] = port
+	}
+	return ports
+}
+
+// replicaPorts reserves a port for every replica of req. External upstreams
+// don't listen here, so their replicas keep req.Port without reserving it.
+// Must be called with s.mu held.
+func (s *Server) replicaPorts(req *types.Model_Request) []int {
+	if s.localBackend(req) {
+		return s.reservePorts(req.Port, req.Replicas)
+	}
+	ports := make([]int, req.Replicas)
+	for i := range ports {
+		ports[i] = req.Port
+	}
+	return ports
+}
+
+// localBackend reports whether req is served by a process started here.
+func (s *Server) localBackend(req *types.Model_Request) bool {
+	backend, err := backendFor(req)
+	return err != nil || backend.Executable(s.PathToLLama) != ""
+}
+
+func (s *Server) releasePorts(ports []int) {
+	s.mu.Lock()
+	for _, port := range ports {
+		delete(s.usedPorts, port)
+	}
+	s.mu.Unlock()
+}
+
+// startRunner starts a llama.cpp server for one replica of req. The port of a
+// local backend must already be reserved in usedPorts; it is released once
+// the process exits.
+func (s *Server) startRunner(req *types.Model_Request, replica int) (*Runner, error) {
+	ctx, Cancel := context.WithCancel(context.Background())
+	_, span := traceRunnerStart(req, replica)
+	newRunner, err := NewRunner(ctx, Cancel, s.PathToLLama, s.ModelPath, req, replica)
+	if err != nil {
+		Cancel()
+		endSpan(span, err)
+		return nil, err
+	}
 	//Load model
 	err = newRunner.Run()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		Cancel()
+		endSpan(span, err)
+		return nil, err
 	}
+	span.AddEvent("process started")
 	// Logging
 	go func() {
-		for msg := range newRunner.LogChan {
-			logger.Info(msg)
+		for line := range newRunner.LogChan {
+			entry := logger.WithFields(logrus.Fields{"model": req.ModelName, "replica": replica})
+			//requests in flight when the line was written
+			switch len(line.RequestIDs) {
+			case 0:
+			case 1:
+				entry = entry.WithField("request_id", line.RequestIDs[0])
+			default:
+				entry = entry.WithField("request_ids", line.RequestIDs)
+			}
+			entry.Info(line.Text)
+		}
+	}()
+
+	// Readiness
+	go func() {
+		err := newRunner.WaitReady(ctx)
+		endSpan(span, err)
+		if err == nil {
+			s.Events.Publish(EventModelReady, ModelEvent{Model: req.ModelName, Port: req.Port})
 		}
 	}()
 
 	// Error handling
 	go func() {
+		var exitErr string
 		for err := range newRunner.ErrorChan {
 			logger.Error(err)
+			exitErr = err.Error()
 		}
 		Cancel()
-		delete(s.usedPorts, s.LoadedModels[modelname].Config.Port)
-		delete(s.LoadedModels, modelname)
+		s.mu.Lock()
+		//still registered means nobody asked the runner to stop
+		crashed, left := false, 0
+		pool, ok := s.LoadedModels[req.ModelName]
+		if ok {
+			crashed, left = pool.remove(newRunner)
+		}
+		if crashed && left == 0 {
+			delete(s.LoadedModels, req.ModelName)
+		}
+		if s.localBackend(req) {
+			delete(s.usedPorts, req.Port)
+		}
+		s.mu.Unlock()
+
+		if crashed {
+			s.Events.Publish(EventRunnerCrashed, ModelEvent{Model: req.ModelName, Port: req.Port, Error: exitErr})
+			if left == 0 {
+				s.Events.Publish(EventModelUnloaded, ModelEvent{Model: req.ModelName})
+			}
+		} else {
+			s.Events.Publish(EventRunnerStopped, ModelEvent{Model: req.ModelName, Port: req.Port})
+		}
 	}()
+	return newRunner, nil
+}
 
-	s.usedPorts[req.Port] = true
-	s.LoadedModels[req.ModelName] = newRunner
+// startPool starts one runner per replica of config on the given, already
+// reserved ports. If a replica fails to start, the others are stopped.
+func (s *Server) startPool(config *types.Model_Request, ports []int) (*Pool, error) {
+	runners := []*Runner{}
+	for i, port := range ports {
+		replicaConfig := *config
+		replicaConfig.Port = port
+		r, err := s.startRunner(&replicaConfig, i)
+		if err != nil {
+			for _, started := range runners {
+				started.Stop()
+			}
+			//ports of started runners are released when they exit
+			if s.localBackend(config) {
+				s.releasePorts(ports[i:])
+			}
+			return nil, err
+		}
+		runners = append(runners, r)
+	}
+	return NewPool(config, runners), nil
+}
 
-	w.Write([]byte("Model loaded"))
+// loadModel resolves and validates req, reserves ports for its replicas,
+// starts them and registers the pool under req.ModelName. revision is the
+// konfig revision req was loaded from, 0 if it didn't come from the store.
+func (s *Server) loadModel(req *types.Model_Request, revision int) (*Pool, error) {
+	konfig := req
+	req, err := s.resolveKonfig(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if _, ok := s.LoadedModels[req.ModelName]; ok {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("Model already loaded")
+	}
+	//external upstreams don't listen here, their port is never reserved
+	if _, ok := s.usedPorts[req.Port]; ok && s.localBackend(req) {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("Port %d already in use", req.Port)
+	}
+	ports := s.replicaPorts(req)
+	s.mu.Unlock()
+
+	//before the replicas start, which may report ready right away
+	s.Events.Publish(EventModelLoading, ModelEvent{Model: req.ModelName, Port: req.Port})
+	pool, err := s.startPool(req, ports)
+	if err != nil {
+		s.Events.Publish(EventModelUnloaded, ModelEvent{Model: req.ModelName, Error: err.Error()})
+		return nil, err
+	}
+	pool.Konfig = konfig
+	pool.Revision = revision
+
+	s.mu.Lock()
+	s.LoadedModels[req.ModelName] = pool
+	s.mu.Unlock()
+	return pool, nil
 }
-func (s *Server) unloadModelHandler(w http.ResponseWriter, r *http.Request) {
+
+func (s *Server) loadModelHandler(w http.ResponseWriter, r *http.Request) {
 	// Access the model value from the path
 	vars := mux.Vars(r)
 	modelname := vars["model"]
 
-	//Unload model
-	if _, ok := s.LoadedModels[modelname]; !ok {
-		http.Error(w, "Model not loaded", http.StatusBadRequest)
+	req := types.NewModelRequestWithDefaults()
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	delete(s.usedPorts, s.LoadedModels[modelname].Config.Port)
-	delete(s.LoadedModels, modelname)
+	req.ModelName = modelname
+
+	_, err = s.loadModel(req, 0)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
 
+	w.Write([]byte("Model loaded"))
 }
 
-func (s *Server) getLoadedModelsHandler(w http.ResponseWriter, r *http.Request) {
-	models := map[string]*types.Model_Request{}
-	for k := range s.LoadedModels {
-		models[k] = s.LoadedModels[k].Config
+// reloadModelHandler replaces the runners of a loaded model without dropping
+// traffic. The new konfig is taken from the request body, or from the konfig
+// file if the body is empty. The new replicas are started on fresh ports and
+// only receive traffic once all are ready; the old ones are drained and stopped.
+func (s *Server) reloadModelHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the model value from the path
+	vars := mux.Vars(r)
+	modelname := vars["model"]
+
+	old, ok := s.pool(modelname)
+	if !ok {
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
 	}
-	json.NewEncoder(w).Encode(models)
-}
 
-func (s *Server) getAvailableModelsHandler(w http.ResponseWriter, r *http.Request) {
-	//read available models from disk
-	models := []string{}
+	req := types.NewModelRequestWithDefaults()
+	revision := 0
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err == io.EOF {
+		revision = s.latestRevision(modelname)
+		err = req.Load(s.Konfigs, modelname)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.ModelName = modelname
+	konfig := req
 
-	filetype := ".gguf" // Replace with your desired file extension
+	req, err = s.resolveKonfig(req)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	ports := s.replicaPorts(req)
+	s.mu.Unlock()
 
-	files, err := os.ReadDir(s.ModelPath)
+	newPool, err := s.startPool(req, ports)
 	if err != nil {
-		fmt.Println("Error reading directory:", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	newPool.Konfig = konfig
+	newPool.Revision = revision
+
+	ctx, cancel := context.WithTimeout(r.Context(), reloadReadyTimeout)
+	defer cancel()
+	for _, runner := range newPool.Runners() {
+		if err := runner.WaitReady(ctx); err != nil {
+			newPool.Stop()
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	//Switch traffic to the new replicas
+	s.mu.Lock()
+	if s.LoadedModels[modelname] != old {
+		s.mu.Unlock()
+		newPool.Stop()
+		http.Error(w, "Model was unloaded or reloaded concurrently", http.StatusConflict)
+		return
+	}
+	s.LoadedModels[modelname] = newPool
+	s.mu.Unlock()
+	s.Events.Publish(EventModelReloaded, ModelEvent{Model: modelname, Port: ports[0], Ports: ports, Revision: revision})
 
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), filetype) {
-			models = append(models, file.Name())
+	//Drain and stop the old replicas, requests that picked the old pool
+	//too late move on to the new one
+	old.retire()
+	go func() {
+		if !old.Drain(reloadDrainTimeout) {
+			logger.Warnf("Reload of %s: %d requests still in flight after drain timeout", modelname, old.InFlight())
 		}
+		old.Stop()
+	}()
+
+	json.NewEncoder(w).Encode(req)
+}
+
+func (s *Server) unloadModelHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the model value from the path
+	vars := mux.Vars(r)
+	modelname := vars["model"]
+
+	//Unload model
+	s.mu.Lock()
+	pool, ok := s.LoadedModels[modelname]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
 	}
+	delete(s.LoadedModels, modelname)
+	s.mu.Unlock()
+
+	//the ports are released once the processes have exited
+	pool.Stop()
+	s.Events.Publish(EventModelUnloaded, ModelEvent{Model: modelname})
+}
 
+func (s *Server) getLoadedModelsHandler(w http.ResponseWriter, r *http.Request) {
+	models := map[string]*types.Model_Request{}
+	s.mu.RLock()
+	for k := range s.LoadedModels {
+		models[k] = s.LoadedModels[k].Config
+	}
+	s.mu.RUnlock()
 	json.NewEncoder(w).Encode(models)
+}
 
+func (s *Server) getAvailableModelsHandler(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(s.Catalog.Models())
 }
 
 func (s *Server) saveModelHandler(w http.ResponseWriter, r *http.Request) {
@@ -129,17 +431,24 @@ func (s *Server) saveModelHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	modelname := vars["model"]
 
-	if _, ok := s.LoadedModels[modelname]; !ok {
+	pool, ok := s.pool(modelname)
+	if !ok {
 		http.Error(w, "Model not loaded", http.StatusBadRequest)
 		return
 	}
 
-	err := s.LoadedModels[modelname].Config.Save(s.ModelPath)
+	//saving the resolved konfig would inline its bases
+	konfig := pool.Konfig
+	if konfig == nil {
+		konfig = pool.Config
+	}
+	err := konfig.Save(s.Konfigs)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	s.Events.Publish(EventKonfigSaved, KonfigEvent{Konfig: modelname})
 	w.Write([]byte("Model saved"))
 
 }
@@ -150,21 +459,21 @@ func (s *Server) loadModelFromFileHandler(w http.ResponseWriter, r *http.Request
 	konfigname := vars["konfig"]
 
 	config := types.NewModelRequestWithDefaults()
-	err := config.Load(s.ModelPath, konfigname)
+	err := config.Load(s.Konfigs, konfigname)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
 	modelname := config.ModelName
-	if _, ok := s.LoadedModels[modelname]; ok {
+	if _, ok := s.pool(modelname); ok {
 		http.Error(w, "Model already loaded", http.StatusBadRequest)
 		return
 	}
 
 	res, err := s.LoadModellFromFile(modelname)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, err, http.StatusBadRequest)
 		return
 	}
 
@@ -172,81 +481,68 @@ func (s *Server) loadModelFromFileHandler(w http.ResponseWriter, r *http.Request
 	json.NewEncoder(w).Encode(res.Config)
 }
 
-func (s *Server) LoadModellFromFile(modelname string) (*Runner, error) {
+func (s *Server) LoadModellFromFile(modelname string) (*Pool, error) {
 
 	req := types.NewModelRequestWithDefaults()
-	err := req.Load(s.ModelPath, modelname)
+	revision := s.latestRevision(modelname)
+	err := req.Load(s.Konfigs, modelname)
 	if err != nil {
 		return nil, err
 	}
 	req.ModelName = modelname
 
-	if _, ok := s.usedPorts[req.Port]; ok {
-		return nil, fmt.Errorf("Port %d already in use", req.Port)
-	}
-
-	ctx, Cancel := context.WithCancel(context.Background())
-	newRunner := NewRunner(ctx, Cancel, s.PathToLLama, s.ModelPath, req)
-	//Load model
-	err = newRunner.Run()
-	if err != nil {
-		return nil, err
-	}
-	// Logging
-	go func() {
-		for msg := range newRunner.LogChan {
-			logger.Info(msg)
-		}
-	}()
-
-	// Error handling
-	go func() {
-		for err := range newRunner.ErrorChan {
-			logger.Error(err)
-		}
-		Cancel()
-		delete(s.usedPorts, s.LoadedModels[modelname].Config.Port)
-		delete(s.LoadedModels, modelname)
-	}()
-
-	s.usedPorts[req.Port] = true
-	s.LoadedModels[modelname] = newRunner
-	return newRunner, nil
-
+	return s.loadModel(req, revision)
 }
 func (s *Server) getAvailableKonfigsHandler(w http.ResponseWriter, r *http.Request) {
-	konfigs := []string{}
-
-	filetype := ".json" // Replace with your desired file extension
+	json.NewEncoder(w).Encode(s.Catalog.Konfigs())
+}
+func (s *Server) GetKonfigHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the model value from the path
+	vars := mux.Vars(r)
+	konfigname := vars["konfig"]
 
-	files, err := os.ReadDir(s.ModelPath)
+	config := types.NewModelRequestWithDefaults()
+	err := config.Load(s.Konfigs, konfigname)
 	if err != nil {
-		fmt.Println("Error reading directory:", err)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-
-	for _, file := range files {
-		if !file.IsDir() && strings.HasSuffix(file.Name(), filetype) {
-			//remove extension
-			fn := strings.TrimSuffix(file.Name(), filetype)
-			konfigs = append(konfigs, fn)
-		}
-	}
-
-	json.NewEncoder(w).Encode(konfigs)
+	json.NewEncoder(w).Encode(config)
 }
-func (s *Server) GetKonfigHandler(w http.ResponseWriter, r *http.Request) {
-	// Access the model value from the path
+
+// getResolvedKonfigHandler returns the konfig merged over the konfigs it
+// extends, together with the llama.cpp arguments it would be started with.
+func (s *Server) getResolvedKonfigHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the konfig value from the path
 	vars := mux.Vars(r)
 	konfigname := vars["konfig"]
 
 	config := types.NewModelRequestWithDefaults()
-	err := config.Load(s.ModelPath, konfigname)
+	err := config.Load(s.Konfigs, konfigname)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	json.NewEncoder(w).Encode(config)
+	resolved, err := config.Resolve(s.Konfigs)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	backend, err := backendFor(resolved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	args, err := backend.Args(s.ModelPath, resolved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Konfig *types.Model_Request `json:"konfig"`
+		Args   []string             `json:"args"`
+	}{resolved, args})
 }
 
 func (s *Server) SaveKonfigHandler(w http.ResponseWriter, r *http.Request) {
@@ -262,12 +558,18 @@ func (s *Server) SaveKonfigHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	config.ModelName = konfigname
-	err = config.Save(s.ModelPath)
+	if _, err := s.resolveKonfig(config); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = config.Save(s.Konfigs)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	s.Catalog.Rescan()
+	s.Events.Publish(EventKonfigSaved, KonfigEvent{Konfig: konfigname})
 	w.Write([]byte("Konfig saved"))
 }
 
@@ -277,23 +579,25 @@ func (s *Server) DeleteKonfigHandler(w http.ResponseWriter, r *http.Request) {
 	konfigname := vars["konfig"]
 
 	config := types.NewModelRequestWithDefaults()
-	err := config.Load(s.ModelPath, konfigname)
+	err := config.Load(s.Konfigs, konfigname)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	modelname := config.ModelName
-	if _, ok := s.LoadedModels[modelname]; ok {
+	if _, ok := s.pool(modelname); ok {
 		http.Error(w, "Model is loaded", http.StatusBadRequest)
 		return
 	}
 
-	err = config.Delete(s.ModelPath)
+	err = config.Delete(s.Konfigs)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	s.Catalog.Rescan()
+	s.Events.Publish(EventKonfigDeleted, KonfigEvent{Konfig: konfigname})
 	w.Write([]byte("Konfig deleted"))
 }
 
@@ -302,13 +606,7 @@ func (s *Server) completionProxy(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	modelname := vars["model"]
 
-	//check if model is loaded
-	if _, ok := s.LoadedModels[modelname]; !ok {
-		http.Error(w, "Model not loaded", http.StatusBadRequest)
-		return
-	}
-
-	s.genericProxy(w, r, "/completion", s.LoadedModels[modelname].Config.Port)
+	s.modelProxy(w, r, modelname, "/completion")
 }
 
 func (s *Server) infillProxy(w http.ResponseWriter, r *http.Request) {
@@ -316,37 +614,189 @@ func (s *Server) infillProxy(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	modelname := vars["model"]
 
-	//check if model is loaded
-	if _, ok := s.LoadedModels[modelname]; !ok {
-		http.Error(w, "Model not loaded", http.StatusBadRequest)
+	s.modelProxy(w, r, modelname, "/infill")
+}
+
+// modelProxy routes a generation request to a replica of modelname, after
+// merging in the konfig's generation defaults.
+func (s *Server) modelProxy(w http.ResponseWriter, r *http.Request, modelname, path string) {
+	//check if model is loaded, following aliases and routing rules
+	_, span := tracer.Start(r.Context(), "route", trace.WithAttributes(attribute.String("chatterbox.model", modelname)))
+	pool, target, ok := s.routePool(modelname)
+	if ok {
+		span.SetAttributes(attribute.String("chatterbox.konfig", pool.Config.ModelName), attribute.Int("chatterbox.konfig_revision", pool.Revision))
+	}
+	span.End()
+	if !ok {
+		//not here, maybe one of our workers has it
+		worker, ok := s.workerFor(target)
+		if !ok {
+			http.Error(w, "Model not loaded", http.StatusBadRequest)
+			return
+		}
+		audit := s.startRemoteAudit(r, modelname, target, worker)
+		w = audit.track(w)
+		defer audit.done()
+		s.forwardToWorker(w, r, worker, modelname, target)
 		return
 	}
-	s.genericProxy(w, r, "/infill", s.LoadedModels[modelname].Config.Port)
+	//recorded with the status the client got, whatever fails from here on
+	audit := s.startAudit(r, modelname, pool)
+	w = audit.track(w)
+	defer audit.done()
 
+	if err := applyGenerationDefaults(r, pool.Config); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.validateCompletion(r, pool.Config); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	schema, err := s.applyGrammar(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	//with the defaults applied
+	audit.readRequest(r)
+	checks := []func(*http.Response) error{}
+	if schema != nil {
+		checks = append(checks, schemaCheck(schema))
+	}
+	if s.Cache != nil && path == "/completion" {
+		w.Header().Set(BackendHeader, pool.Config.ModelName)
+		cached, store := s.Cache.lookup(w, r, pool.Config)
+		if cached != nil {
+			return
+		}
+		if store != nil {
+			checks = append(checks, store)
+		}
+	}
+
+	aff, err := requestAffinity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, span = tracer.Start(r.Context(), "queue")
+	pool, runner, slot := s.pick(pool, aff, requestID(r.Context()))
+	if runner == nil {
+		endSpan(span, errors.New("no replica available"))
+		http.Error(w, "No replica available", http.StatusServiceUnavailable)
+		return
+	}
+	//requests the runner already has, ahead of this one if its slots are busy
+	span.SetAttributes(append(runnerAttributes(runner), attribute.Int64("chatterbox.queue_depth", runner.InFlight()), attribute.Int("chatterbox.slot", slot))...)
+	span.End()
+	defer runner.Release(requestID(r.Context()))
+	if slot != aff.Slot {
+		if err := setBodyField(r, "id_slot", slot); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set(BackendHeader, pool.Config.ModelName)
+	w.Header().Set(ReplicaHeader, strconv.Itoa(runner.Replica))
+	s.genericProxy(w, r, path, runner, func(resp *http.Response) error {
+		for _, check := range checks {
+			if err := check(resp); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// genericProxy sends r to path of the runner's backend, which the caller
+// acquired with Pick. check, if set, sees the response after the backend
+// normalized it.
+func (s *Server) genericProxy(w http.ResponseWriter, r *http.Request, path string, runner *Runner, check func(*http.Response) error) {
+	start := time.Now()
+	ctx, span := tracer.Start(r.Context(), "proxy "+path, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(runnerAttributes(runner)...))
+	var spanErr error
+	defer func() { endSpan(span, spanErr) }()
+	r = r.WithContext(ctx)
+
+	backend := runner.Backend
+	upstreamPath, ok := backend.Endpoint(path)
+	if !ok {
+		spanErr = fmt.Errorf("%s is not supported by the %s backend", path, runner.Config.Backend)
+		http.Error(w, spanErr.Error(), http.StatusNotImplemented)
+		return
+	}
+	target, err := url.Parse(backend.BaseURL(runner.Config) + upstreamPath)
+	if err != nil {
+		spanErr = err
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := backend.Request(runner.Config, path, r); err != nil {
+		spanErr = err
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	span.SetAttributes(semconv.URLFull(target.String()))
+	s.forward(w, r, target, func(resp *http.Response) error {
+		span.SetAttributes(semconv.HTTPResponseStatusCodeKey.Int(resp.StatusCode))
+		spanErr = statusError(resp.StatusCode)
+		err := backend.Response(path, resp)
+		if err == nil && check != nil {
+			err = check(resp)
+		}
+		if err != nil {
+			spanErr = err
+			return err
+		}
+		//the timings are in the final result, seen once the body is read
+		resp.Body = &captureBody{ReadCloser: resp.Body, done: func(data []byte, complete bool) {
+			if res := auditResult(resp.Header.Get("Content-Type"), data); res != nil {
+				span.SetAttributes(timingAttributes(res, time.Since(start))...)
+			}
+		}}
+		return nil
+	})
 }
 
-func (s *Server) genericProxy(w http.ResponseWriter, r *http.Request, path string, port int) {
+// forward sends r to target and copies the response back to w, after
+// passing it through normalize if that is set.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, target *url.URL, normalize func(*http.Response) error) {
 	//proxy request to model
+	injectTrace(r.Context(), r.Header)
 	newRequest := &http.Request{
-		URL: &url.URL{
-			Scheme: "http",
-			Host:   fmt.Sprintf("localhost:%d", port),
-			Path:   path,
-		},
-		Method: r.Method,
-		Header: r.Header,
-		Body:   r.Body,
+		URL:           target,
+		Method:        r.Method,
+		Header:        r.Header,
+		Body:          r.Body,
+		ContentLength: r.ContentLength,
 	}
 	// Send the proxy request
 	resp, err := http.DefaultClient.Do(newRequest)
 	if err != nil {
+		trace.SpanFromContext(r.Context()).RecordError(err)
 		http.Error(w, "Failed to proxy request", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
+	//normalize may replace the body
+	defer func() { resp.Body.Close() }()
+	if normalize != nil {
+		if err := normalize(resp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	copyResponse(w, resp)
+}
 
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
 	// Copy headers and status code
 	for k, vv := range resp.Header {
+		//the request id is ours, a worker just echoes it
+		if k == http.CanonicalHeaderKey(RequestIDHeader) {
+			continue
+		}
 		for _, v := range vv {
 			w.Header().Add(k, v)
 		}
@@ -362,10 +812,45 @@ var logger = logrus.New()
 func (s *Server) AddRoutes() {
 	r := mux.NewRouter()
 
+	r.HandleFunc("/api/v1/workers", s.getWorkersHandler).Methods("GET")
+	r.HandleFunc("/api/v1/workers/register", s.registerWorkerHandler).Methods("POST")
+	r.HandleFunc("/api/v1/workers/{id}", s.deregisterWorkerHandler).Methods("DELETE")
+	r.HandleFunc("/api/v1/workers/{id}/heartbeat", s.heartbeatHandler).Methods("POST")
+	r.HandleFunc("/api/v1/workers/{id}/{konfig}/load", s.loadOnWorkerHandler).Methods("POST")
+	r.HandleFunc("/api/v1/workers/{id}/{model}/unload", s.unloadOnWorkerHandler).Methods("POST")
+
+	r.HandleFunc("/api/v1/sessions", s.getSessionsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/sessions", s.createSessionHandler).Methods("POST")
+	r.HandleFunc("/api/v1/sessions/{id}", s.getSessionHandler).Methods("GET")
+	r.HandleFunc("/api/v1/sessions/{id}", s.deleteSessionHandler).Methods("DELETE")
+	r.HandleFunc("/api/v1/sessions/{id}/messages", s.sessionMessageHandler).Methods("POST")
+
+	r.HandleFunc("/api/v1/routes", s.getRoutesHandler).Methods("GET")
+	r.HandleFunc("/api/v1/routes/{name}", s.getRouteHandler).Methods("GET")
+	r.HandleFunc("/api/v1/routes/{name}", s.saveRouteHandler).Methods("PUT")
+	r.HandleFunc("/api/v1/routes/{name}", s.deleteRouteHandler).Methods("DELETE")
+
+	r.HandleFunc("/api/v1/cache", s.getCacheHandler).Methods("GET")
+	r.HandleFunc("/api/v1/cache", s.clearCacheHandler).Methods("DELETE")
+
+	r.HandleFunc("/api/v1/audit", s.getAuditHandler).Methods("GET")
+
+	r.HandleFunc("/api/v1/grammars", s.getGrammarsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/grammars/{name}", s.getGrammarHandler).Methods("GET")
+	r.HandleFunc("/api/v1/grammars/{name}", s.saveGrammarHandler).Methods("PUT")
+	r.HandleFunc("/api/v1/grammars/{name}", s.deleteGrammarHandler).Methods("DELETE")
+
 	r.HandleFunc("/api/v1/{model}/completion", s.completionProxy).Methods("POST")
 	r.HandleFunc("/api/v1/{model}/infill", s.infillProxy).Methods("POST")
+	r.HandleFunc("/api/v1/{model}/tokenize", s.tokenizeProxy).Methods("POST")
+	r.HandleFunc("/api/v1/{model}/detokenize", s.detokenizeProxy).Methods("POST")
+	r.HandleFunc("/api/v1/{model}/count", s.countHandler).Methods("POST")
+	r.HandleFunc("/api/v1/{model}/embedding", s.embeddingProxy).Methods("POST")
+	r.HandleFunc("/v1/embeddings", s.openAIEmbeddingsHandler).Methods("POST")
+	r.HandleFunc("/v1/chat/completions", s.openAIChatHandler).Methods("POST")
 
 	r.HandleFunc("/api/v1/{model}/load", s.loadModelHandler).Methods("POST")
+	r.HandleFunc("/api/v1/{model}/reload", s.reloadModelHandler).Methods("POST")
 	r.HandleFunc("/api/v1/{model}/unload", s.unloadModelHandler).Methods("GET")
 	r.HandleFunc("/api/v1/{model}/savetofile", s.saveModelHandler).Methods("GET")
 
@@ -373,21 +858,78 @@ func (s *Server) AddRoutes() {
 	r.HandleFunc("/api/v1/models/available", s.getAvailableModelsHandler).Methods("GET")
 	r.HandleFunc("/api/v1/models/download/{path}", s.downloadModelHandler).Methods("GET")
 	r.HandleFunc("/api/v1/konfigs/available", s.getAvailableKonfigsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/events", s.eventsHandler).Methods("GET")
 	r.HandleFunc("/api/v1/{konfig}", s.GetKonfigHandler).Methods("GET")
 	r.HandleFunc("/api/v1/{konfig}", s.SaveKonfigHandler).Methods("POST")
 	r.HandleFunc("/api/v1/{konfig}", s.DeleteKonfigHandler).Methods("DELETE")
 	r.HandleFunc("/api/v1/{konfig}/load", s.loadModelFromFileHandler).Methods("GET")
+	r.HandleFunc("/api/v1/{konfig}/resolved", s.getResolvedKonfigHandler).Methods("GET")
+	r.HandleFunc("/api/v1/{konfig}/revisions", s.getRevisionsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/{konfig}/revisions/{rev}", s.getRevisionHandler).Methods("GET")
+	r.HandleFunc("/api/v1/{konfig}/diff", s.diffRevisionsHandler).Methods("GET")
+	r.HandleFunc("/api/v1/{konfig}/rollback/{rev}", s.rollbackKonfigHandler).Methods("POST")
+	r.Use(s.traceRequests, s.logRequests)
+	r.NotFoundHandler = s.traceRequests(s.logRequests(http.NotFoundHandler()))
+	r.MethodNotAllowedHandler = s.traceRequests(s.logRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})))
 	s.Router = r
 }
 
+// GetServer returns a server storing konfigs as files in ModelPath/konfigs.
 func GetServer(ModelPath, PathToLLama, Addr string) *Server {
+	store, err := types.NewFileStore(ModelPath + "/konfigs")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	return NewServer(ModelPath, PathToLLama, Addr, store)
+}
+
+// NewServer returns a server using store for konfigs. Konfigs still lying
+// directly in ModelPath are migrated into the store.
+func NewServer(ModelPath, PathToLLama, Addr string, store types.KonfigStore) *Server {
 	s := &Server{
 		Router:       mux.NewRouter(),
 		ModelPath:    ModelPath,
 		PathToLLama:  PathToLLama,
-		LoadedModels: map[string]*Runner{},
+		LoadedModels: map[string]*Pool{},
+		Konfigs:      store,
+		Events:       NewEventBus(),
 		usedPorts:    map[int]bool{8080: true},
+		workers:      map[string]*types.WorkerInfo{},
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	migrated, err := types.MigrateKonfigs(ModelPath, store)
+	if err != nil {
+		logger.Error("Migrating konfigs failed: ", err)
+	}
+	if len(migrated) > 0 {
+		logger.Infof("Migrated %d konfigs into the konfig store: %v", len(migrated), migrated)
 	}
+
+	s.routesPath = ModelPath + "/routes.json"
+	s.routes, err = types.LoadRoutes(s.routesPath)
+	if err != nil {
+		logger.Error("Loading routes failed: ", err)
+		s.routes = map[string]*types.Route{}
+	}
+
+	s.grammarsPath = ModelPath + "/grammars"
+
+	s.sessionsPath = ModelPath + "/sessions"
+	s.sessions = map[string]*session{}
+	stored, err := types.LoadSessions(s.sessionsPath)
+	if err != nil {
+		logger.Error("Loading sessions failed: ", err)
+	}
+	for id, sess := range stored {
+		s.sessions[id] = &session{Session: sess}
+	}
+
+	s.Catalog = NewCatalog(ModelPath, store, s.Events)
+	go s.Catalog.Watch(s.ctx)
+	go s.reapWorkers(s.ctx)
 	s.AddRoutes()
 	s.Server = &http.Server{
 		Addr:    Addr,
@@ -396,10 +938,21 @@ func GetServer(ModelPath, PathToLLama, Addr string) *Server {
 	return s
 }
 
+// Close stops the server's background work. It doesn't stop the HTTP server
+// or the loaded models.
+func (s *Server) Close() {
+	s.cancel()
+	if s.Cache != nil {
+		s.Cache.Close()
+	}
+}
+
 func init() {
 	// Initialize logger
 	logger.SetFormatter(&logrus.TextFormatter{
 		FullTimestamp: true,
 	})
 	logger.SetLevel(logrus.InfoLevel)
+	accessLog.SetFormatter(&logrus.JSONFormatter{})
+	accessLog.SetLevel(logrus.InfoLevel)
 }
@@ -0,0 +1,422 @@
+package chatterbox
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+type redaction struct {
+	re      *regexp.Regexp
+	replace string
+}
+
+// AuditLog appends one JSON line per generation request to a file. Once the
+// file grows past MaxSize it is rotated to Path.1, Path.1 to Path.2 and so
+// on, keeping MaxFiles rotated files.
+type AuditLog struct {
+	Path     string
+	MaxSize  int64 //0 => never rotate
+	MaxFiles int
+	redact   []redaction
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+// NewAuditLog opens the audit log at path, appending to what is there.
+func NewAuditLog(path string, maxSize int64, maxFiles int, rules []types.RedactionRule) (*AuditLog, error) {
+	a := &AuditLog{Path: path, MaxSize: maxSize, MaxFiles: maxFiles}
+	for _, rule := range rules {
+		re, err := rule.Compile()
+		if err != nil {
+			return nil, err
+		}
+		replace := rule.Replace
+		if replace == "" {
+			replace = "[REDACTED]"
+		}
+		a.redact = append(a.redact, redaction{re: re, replace: replace})
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate shifts the rotated files by one, dropping the oldest, and starts a
+// new file.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(a.rotated(a.MaxFiles))
+	for i := a.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(a.rotated(i), a.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if a.MaxFiles > 0 {
+		if err := os.Rename(a.Path, a.rotated(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.Path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *AuditLog) rotated(i int) string {
+	return a.Path + "." + strconv.Itoa(i)
+}
+
+func (a *AuditLog) redactString(s string) string {
+	for _, r := range a.redact {
+		s = r.re.ReplaceAllString(s, r.replace)
+	}
+	return s
+}
+
+// Write redacts rec and appends it to the log.
+func (a *AuditLog) Write(rec *types.AuditRecord) error {
+	rec.Prompt = a.redactString(rec.Prompt)
+	rec.Content = a.redactString(rec.Content)
+	rec.Error = a.redactString(rec.Error)
+	for name, value := range rec.Params {
+		if s, ok := value.(string); ok {
+			rec.Params[name] = a.redactString(s)
+		}
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+// Query returns the records from the current and the rotated files, oldest
+// first, with from <= time < to. A zero from or to leaves that end open, an
+// empty model matches every record, otherwise the requested model or the
+// konfig that served it must match.
+func (a *AuditLog) Query(from, to time.Time, model string) ([]*types.AuditRecord, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	records := []*types.AuditRecord{}
+	files := []string{}
+	for i := a.MaxFiles; i >= 1; i-- {
+		files = append(files, a.rotated(i))
+	}
+	files = append(files, a.Path)
+	for _, path := range files {
+		f, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		reader := bufio.NewReader(f)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				rec := &types.AuditRecord{}
+				if json.Unmarshal(line, rec) == nil && auditMatches(rec, from, to, model) {
+					records = append(records, rec)
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+		}
+		f.Close()
+	}
+	return records, nil
+}
+
+func auditMatches(rec *types.AuditRecord, from, to time.Time, model string) bool {
+	if !from.IsZero() && rec.Time.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !rec.Time.Before(to) {
+		return false
+	}
+	return model == "" || rec.Model == model || rec.Konfig == model
+}
+
+// Close closes the current file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// apiKeyFingerprint identifies the API key of r, from a bearer token or the
+// X-API-Key header, without revealing it.
+func apiKeyFingerprint(r *http.Request) string {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		key = r.Header.Get("X-API-Key")
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// auditEntry is the record of a request in flight.
+type auditEntry struct {
+	log    *AuditLog
+	start  time.Time
+	rec    *types.AuditRecord
+	result *types.Result //set by handlers that don't answer with a result
+	w      *auditRecorder
+}
+
+// auditRecorder keeps what was sent to the client, up to maxCachedBody.
+type auditRecorder struct {
+	statusRecorder
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (w *auditRecorder) Write(p []byte) (int, error) {
+	if !w.overflow {
+		if w.buf.Len()+len(p) > maxCachedBody {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(p)
+		}
+	}
+	return w.statusRecorder.Write(p)
+}
+
+// startAudit begins the record of a generation request, or returns nil if
+// auditing is off. The record is written by done, which must be deferred
+// right away, with whatever was sent to the writer returned by track.
+func (s *Server) startAudit(r *http.Request, modelname string, pool *Pool) *auditEntry {
+	if s.Audit == nil {
+		return nil
+	}
+	e := &auditEntry{log: s.Audit, start: time.Now(), rec: &types.AuditRecord{
+		APIKey:   apiKeyFingerprint(r),
+		Model:    modelname,
+		Konfig:   pool.Config.ModelName,
+		Revision: pool.Revision,
+		Endpoint: r.URL.Path,
+	}}
+	e.readRequest(r)
+	return e
+}
+
+// startRemoteAudit is startAudit for a request forwarded to worker, which
+// serves it with the konfig target.
+func (s *Server) startRemoteAudit(r *http.Request, modelname, target string, worker *types.WorkerInfo) *auditEntry {
+	if s.Audit == nil {
+		return nil
+	}
+	e := &auditEntry{log: s.Audit, start: time.Now(), rec: &types.AuditRecord{
+		APIKey:   apiKeyFingerprint(r),
+		Model:    modelname,
+		Konfig:   target,
+		Worker:   worker.ID,
+		Endpoint: r.URL.Path,
+	}}
+	e.readRequest(r)
+	return e
+}
+
+// readRequest takes prompt and parameters from the body of r, leaving the
+// body to be read again.
+func (e *auditEntry) readRequest(r *http.Request) {
+	if e == nil {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err == nil {
+		e.setRequest(body)
+	}
+}
+
+// setRequest takes prompt and parameters from the completion request body.
+func (e *auditEntry) setRequest(body []byte) {
+	if e == nil {
+		return
+	}
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(body, &fields) != nil {
+		return
+	}
+	if prompt, ok := fields["prompt"]; ok {
+		if err := json.Unmarshal(prompt, &e.rec.Prompt); err != nil {
+			e.rec.Prompt = string(prompt)
+		}
+	}
+	req := &types.Prediction_Request{}
+	if json.Unmarshal(body, req) == nil {
+		e.rec.Params = req.Overrides()
+		delete(e.rec.Params, "prompt")
+		delete(e.rec.Params, "image_data")
+	}
+}
+
+// setResult records result instead of what the client gets, for handlers
+// answering in another format.
+func (e *auditEntry) setResult(result *types.Result) {
+	if e != nil {
+		e.result = result
+	}
+}
+
+// track returns the writer whose status and body end up in the record.
+func (e *auditEntry) track(w http.ResponseWriter) http.ResponseWriter {
+	if e == nil {
+		return w
+	}
+	e.w = &auditRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+	return e.w
+}
+
+// done completes the record with what the client got and writes it.
+func (e *auditEntry) done() {
+	if e == nil {
+		return
+	}
+	status := e.w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	e.rec.Time = e.start.UTC()
+	e.rec.LatencyMs = time.Since(e.start).Milliseconds()
+	e.rec.Status = status
+	e.rec.Cached = e.w.Header().Get(CacheHeader) == "hit"
+	result := e.result
+	if result == nil && status < 400 {
+		result = auditResult(e.w.Header().Get("Content-Type"), e.w.buf.Bytes())
+	}
+	if result != nil {
+		e.rec.Content = result.Content
+		e.rec.StopReason = result.StopReason()
+		e.rec.TokensEvaluated = result.TokensEvaluated
+		e.rec.TokensPredicted = result.TokensPredicted
+	}
+	if status >= 400 {
+		//plain text or a JSON validation error
+		msg := e.w.buf.Bytes()
+		e.rec.Error = strings.TrimSpace(string(msg[:min(len(msg), 512)]))
+	}
+	if err := e.log.Write(e.rec); err != nil {
+		logger.Error("Writing audit record failed: ", err)
+	}
+}
+
+// auditResult extracts the result from a response body: a JSON result, or a
+// stream whose content is collected from its events.
+func auditResult(contentType string, data []byte) *types.Result {
+	if !strings.HasPrefix(contentType, "text/event-stream") {
+		res := &types.Result{}
+		if json.Unmarshal(data, res) != nil {
+			return nil
+		}
+		return res
+	}
+	res := &types.Result{}
+	content := &strings.Builder{}
+	for _, line := range strings.Split(string(data), "\n") {
+		event, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		chunk := &types.Result{}
+		if json.Unmarshal([]byte(event), chunk) != nil {
+			continue
+		}
+		content.WriteString(chunk.Content)
+		if chunk.Stop {
+			res = chunk
+		}
+	}
+	res.Content = content.String()
+	return res
+}
+
+// getAuditHandler returns the audit records, optionally filtered by the
+// query parameters from and to (RFC 3339) and model.
+func (s *Server) getAuditHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Audit == nil {
+		http.Error(w, "Audit log is disabled", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid %s: %v", name, err), http.StatusBadRequest)
+			return
+		}
+		*t = parsed
+	}
+	records, err := s.Audit.Query(from, to, query.Get("model"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(records)
+}
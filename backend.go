@@ -0,0 +1,316 @@
+package chatterbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// Backend is what serves the requests of a konfig. The API always speaks the
+// llama.cpp server protocol; a backend maps it to whatever its upstream
+// understands and normalizes the results back.
+type Backend interface {
+	// Executable returns the program to start, or "" if the backend has no
+	// local process.
+	Executable(llamaPath string) string
+	// Args returns the arguments of the program serving config.
+	Args(ModelPath string, config *types.Model_Request) ([]string, error)
+	// BaseURL is where requests for config are sent.
+	BaseURL(config *types.Model_Request) string
+	// Health returns nil once the upstream is ready to serve.
+	Health(ctx context.Context, config *types.Model_Request) error
+	// Endpoint maps a llama.cpp server endpoint like /completion to the
+	// upstream path, or reports that the backend doesn't support it.
+	Endpoint(path string) (string, bool)
+	// Request rewrites a request for the llama.cpp endpoint path before it is
+	// sent upstream.
+	Request(config *types.Model_Request, path string, r *http.Request) error
+	// Response rewrites the upstream response into what the llama.cpp server
+	// would have returned for path.
+	Response(path string, resp *http.Response) error
+}
+
+var backends = map[string]Backend{
+	types.BackendLlamaCpp: llamaBackend{},
+	types.BackendOpenAI:   openAIBackend{},
+}
+
+// backendFor returns the backend selected by config, llama.cpp if none is.
+func backendFor(config *types.Model_Request) (Backend, error) {
+	name := config.Backend
+	if name == "" {
+		name = types.BackendLlamaCpp
+	}
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown backend %q", name)
+	}
+	return b, nil
+}
+
+// llamaBackend runs the llama.cpp server, which needs no translation.
+type llamaBackend struct{}
+
+func (llamaBackend) Executable(llamaPath string) string {
+	return fmt.Sprintf("%s/server", llamaPath)
+}
+
+func (llamaBackend) Args(ModelPath string, config *types.Model_Request) ([]string, error) {
+	return BuildArgs(ModelPath, config)
+}
+
+func (llamaBackend) BaseURL(config *types.Model_Request) string {
+	return fmt.Sprintf("http://localhost:%d", config.Port)
+}
+
+func (b llamaBackend) Health(ctx context.Context, config *types.Model_Request) error {
+	return checkHealth(ctx, b.BaseURL(config)+"/health", nil)
+}
+
+func (llamaBackend) Endpoint(path string) (string, bool) {
+	return path, true
+}
+
+func (llamaBackend) Request(config *types.Model_Request, path string, r *http.Request) error {
+	return nil
+}
+
+func (llamaBackend) Response(path string, resp *http.Response) error {
+	return nil
+}
+
+// checkHealth returns nil if GET url answers 200.
+func checkHealth(ctx context.Context, url string, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// openAIBackend forwards to an external OpenAI-compatible server. Nothing is
+// started locally.
+type openAIBackend struct{}
+
+var openAIEndpoints = map[string]string{
+	"/completion": "/completions",
+}
+
+func (openAIBackend) Executable(llamaPath string) string {
+	return ""
+}
+
+func (openAIBackend) Args(ModelPath string, config *types.Model_Request) ([]string, error) {
+	return nil, nil
+}
+
+func (openAIBackend) BaseURL(config *types.Model_Request) string {
+	if config.Upstream == nil {
+		return ""
+	}
+	return strings.TrimSuffix(config.Upstream.URL, "/")
+}
+
+func (b openAIBackend) Health(ctx context.Context, config *types.Model_Request) error {
+	return checkHealth(ctx, b.BaseURL(config)+"/models", openAIHeader(config))
+}
+
+func (openAIBackend) Endpoint(path string) (string, bool) {
+	p, ok := openAIEndpoints[path]
+	return p, ok
+}
+
+// openAIHeader returns the authorization header for the upstream of config.
+func openAIHeader(config *types.Model_Request) http.Header {
+	header := http.Header{}
+	if config.Upstream != nil && config.Upstream.APIKeyEnv != "" {
+		if key := os.Getenv(config.Upstream.APIKeyEnv); key != "" {
+			header.Set("Authorization", "Bearer "+key)
+		}
+	}
+	return header
+}
+
+func (openAIBackend) Request(config *types.Model_Request, path string, r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return fmt.Errorf("Request body must be a JSON object: %v", err)
+		}
+	}
+
+	model := config.Model
+	if config.Upstream != nil && config.Upstream.Model != "" {
+		model = config.Upstream.Model
+	}
+	out := map[string]interface{}{"model": model}
+	//llama.cpp fields with an OpenAI counterpart, everything else is dropped
+	renames := map[string]string{
+		"prompt":            "prompt",
+		"temperature":       "temperature",
+		"top_p":             "top_p",
+		"stop":              "stop",
+		"stream":            "stream",
+		"seed":              "seed",
+		"presence_penalty":  "presence_penalty",
+		"frequency_penalty": "frequency_penalty",
+		"n_predict":         "max_tokens",
+		"n_probs":           "logprobs",
+	}
+	for from, to := range renames {
+		if v, ok := fields[from]; ok {
+			out[to] = v
+		}
+	}
+	//llama.cpp uses -1 for unlimited, OpenAI wants the field left out
+	if n, ok := out["max_tokens"].(json.RawMessage); ok {
+		if v, err := strconv.Atoi(string(n)); err == nil && v < 0 {
+			delete(out, "max_tokens")
+		}
+	}
+	if n, ok := out["logprobs"].(json.RawMessage); ok && string(n) == "0" {
+		delete(out, "logprobs")
+	}
+
+	body, err = json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Type", "application/json")
+	//the body is rewritten on the way back, so it must not be compressed
+	r.Header.Del("Accept-Encoding")
+	r.Header.Del("Authorization")
+	for k, vv := range openAIHeader(config) {
+		r.Header[k] = vv
+	}
+	return nil
+}
+
+// openAICompletion is the part of an OpenAI completion (or stream chunk)
+// that maps onto a llama.cpp result.
+type openAICompletion struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Text         string  `json:"text"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// result converts c into a llama.cpp completion result.
+func (c *openAICompletion) result() *types.Result {
+	res := &types.Result{Model: c.Model}
+	if len(c.Choices) > 0 {
+		choice := c.Choices[0]
+		res.Content = choice.Text
+		if choice.FinishReason != nil {
+			res.Stop = true
+			res.StoppedEOS = *choice.FinishReason == "stop"
+			res.StoppedLimit = *choice.FinishReason == "length"
+		}
+	}
+	if c.Usage != nil {
+		res.TokensEvaluated = c.Usage.PromptTokens
+		res.TokensPredicted = c.Usage.CompletionTokens
+	}
+	return res
+}
+
+func (openAIBackend) Response(path string, resp *http.Response) error {
+	if path != "/completion" || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	resp.Header.Del("Content-Length")
+
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		upstream := resp.Body
+		pr, pw := io.Pipe()
+		go func() {
+			defer upstream.Close()
+			pw.CloseWithError(normalizeOpenAIStream(upstream, pw))
+		}()
+		resp.Body = pr
+		return nil
+	}
+
+	c := &openAICompletion{}
+	err := json.NewDecoder(resp.Body).Decode(c)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("Invalid upstream response: %v", err)
+	}
+	res := c.result()
+	res.Stop = true
+	data, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	resp.ContentLength = int64(len(data))
+	resp.Header.Set("Content-Type", "application/json")
+	return nil
+}
+
+// normalizeOpenAIStream rewrites OpenAI stream chunks into llama.cpp stream
+// events. The [DONE] marker has no llama.cpp counterpart and is dropped.
+func normalizeOpenAIStream(src io.Reader, dst io.Writer) error {
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		c := &openAICompletion{}
+		if err := json.Unmarshal([]byte(data), c); err != nil {
+			return fmt.Errorf("Invalid upstream stream chunk: %v", err)
+		}
+		//like llama.cpp, only the final event carries the full result
+		res := c.result()
+		var v interface{} = res
+		if !res.Stop {
+			v = struct {
+				Content string `json:"content"`
+				Stop    bool   `json:"stop"`
+			}{res.Content, false}
+		}
+		out, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(dst, "data: %s\n\n", out); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,144 @@
+package chatterbox
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+func Test_OpenAIRequest(t *testing.T) {
+	t.Setenv("TEST_OPENAI_KEY", "secret")
+	config := &types.Model_Request{Model: "local.gguf", Upstream: &types.Upstream{URL: "http://upstream/v1/", Model: "gpt", APIKeyEnv: "TEST_OPENAI_KEY"}}
+	for _, tc := range []struct {
+		name string
+		body string
+		want map[string]interface{}
+	}{
+		{"renamed fields", `{"prompt":"hi","n_predict":5,"n_probs":2,"temperature":0.5,"stop":["\n"],"stream":true}`,
+			map[string]interface{}{"model": "gpt", "prompt": "hi", "max_tokens": 5.0, "logprobs": 2.0, "temperature": 0.5, "stop": []interface{}{"\n"}, "stream": true}},
+		{"unlimited and no probs are left out", `{"prompt":"hi","n_predict":-1,"n_probs":0}`,
+			map[string]interface{}{"model": "gpt", "prompt": "hi"}},
+		{"llama.cpp only fields are dropped", `{"prompt":"hi","top_k":40,"mirostat":2,"id_slot":1}`,
+			map[string]interface{}{"model": "gpt", "prompt": "hi"}},
+		{"empty body", ``, map[string]interface{}{"model": "gpt"}},
+	} {
+		r := httptest.NewRequest("POST", "/completion", strings.NewReader(tc.body))
+		r.Header.Set("Authorization", "Bearer client")
+		r.Header.Set("Accept-Encoding", "gzip")
+		if err := (openAIBackend{}).Request(config, "/completion", r); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: sent %v, want %v", tc.name, got, tc.want)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("%s: Authorization %q", tc.name, auth)
+		}
+		if r.Header.Get("Accept-Encoding") != "" {
+			t.Errorf("%s: Accept-Encoding was forwarded", tc.name)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/completion", strings.NewReader(`["not","an","object"]`))
+	if err := (openAIBackend{}).Request(config, "/completion", r); err == nil {
+		t.Error("array body accepted")
+	}
+	//without a model override the konfig's model is sent
+	config.Upstream.Model = ""
+	r = httptest.NewRequest("POST", "/completion", strings.NewReader(`{}`))
+	(openAIBackend{}).Request(config, "/completion", r)
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"model":"local.gguf"}` {
+		t.Errorf("sent %s", body)
+	}
+}
+
+func Test_OpenAIResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   types.Result
+	}{
+		{"length", http.StatusOK, `{"model":"gpt","choices":[{"text":"abc","finish_reason":"length"}],"usage":{"prompt_tokens":3,"completion_tokens":2}}`,
+			types.Result{Model: "gpt", Content: "abc", Stop: true, StoppedLimit: true, TokensEvaluated: 3, TokensPredicted: 2}},
+		{"stop", http.StatusOK, `{"model":"gpt","choices":[{"text":"abc","finish_reason":"stop"}]}`,
+			types.Result{Model: "gpt", Content: "abc", Stop: true, StoppedEOS: true}},
+		{"no choices", http.StatusOK, `{"model":"gpt","choices":[]}`,
+			types.Result{Model: "gpt", Stop: true}},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: http.Header{"Content-Type": {"application/json"}, "Content-Length": {"999"}}, Body: io.NopCloser(strings.NewReader(tc.body))}
+		if err := (openAIBackend{}).Response("/completion", resp); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := types.Result{}
+		if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+		if resp.Header.Get("Content-Length") != "" {
+			t.Errorf("%s: stale Content-Length kept", tc.name)
+		}
+	}
+
+	//errors are passed through untouched
+	resp := &http.Response{StatusCode: http.StatusUnauthorized, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(`{"error":"no"}`))}
+	if err := (openAIBackend{}).Response("/completion", resp); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(resp.Body); string(body) != `{"error":"no"}` {
+		t.Errorf("error body rewritten to %s", body)
+	}
+	resp = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(`<html>`))}
+	if err := (openAIBackend{}).Response("/completion", resp); err == nil {
+		t.Error("invalid upstream response accepted")
+	}
+}
+
+func Test_NormalizeOpenAIStream(t *testing.T) {
+	in := `data: {"model":"gpt","choices":[{"text":"a","finish_reason":null}]}
+
+: keep-alive
+data: {"model":"gpt","choices":[{"text":"b","finish_reason":null}]}
+
+data: {"model":"gpt","choices":[{"text":"","finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":2}}
+
+data: [DONE]
+
+`
+	out := &strings.Builder{}
+	if err := normalizeOpenAIStream(strings.NewReader(in), out); err != nil {
+		t.Fatal(err)
+	}
+	want := `data: {"content":"a","stop":false}
+
+data: {"content":"b","stop":false}
+
+`
+	if !strings.HasPrefix(out.String(), want) {
+		t.Fatalf("stream starts with %q", out.String())
+	}
+	final := types.Result{}
+	data, _ := strings.CutPrefix(strings.TrimSpace(strings.TrimPrefix(out.String(), want)), "data: ")
+	if err := json.Unmarshal([]byte(data), &final); err != nil {
+		t.Fatalf("final event %q: %v", data, err)
+	}
+	if !final.Stop || !final.StoppedEOS || final.TokensPredicted != 2 || final.Model != "gpt" {
+		t.Errorf("final event %+v", final)
+	}
+
+	if err := normalizeOpenAIStream(strings.NewReader("data: {oops\n\n"), io.Discard); err == nil {
+		t.Error("invalid chunk accepted")
+	}
+}
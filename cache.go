@@ -0,0 +1,611 @@
+package chatterbox
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// CacheHeader tells whether a completion came from the response cache: hit,
+// miss or bypass. Sent by a client, bypass skips the cache and refresh skips
+// the lookup but stores the new response. Cache-Control no-cache and no-store
+// are honored the same way.
+const CacheHeader = "X-Chatterbox-Cache"
+
+// maxCachedBody is the largest response body the cache keeps.
+const maxCachedBody = 8 << 20
+
+// cacheSweepInterval is how often expired responses are removed, rather than
+// waiting for them to be looked up again.
+const cacheSweepInterval = time.Minute
+
+// CachedResponse is a complete completion response, replayed on a hit.
+type CachedResponse struct {
+	Status      int       `json:"status"`
+	ContentType string    `json:"contentType"`
+	Body        []byte    `json:"body"`
+	Expires     time.Time `json:"expires,omitempty"` //zero => never
+}
+
+func (c *CachedResponse) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && now.After(c.Expires)
+}
+
+// CacheStore keeps cached responses by key. Implementations must be safe for
+// concurrent use.
+type CacheStore interface {
+	Get(key string) (*CachedResponse, bool)
+	Put(key string, resp *CachedResponse)
+	Clear() error
+	Len() int
+	// Sweep removes the expired responses and returns how many there were.
+	Sweep() int
+}
+
+// memoryCache is a CacheStore keeping the most recently used responses in
+// memory.
+type memoryCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List //front is most recently used
+	entries  map[string]*list.Element
+	evicted  func()
+}
+
+type memoryEntry struct {
+	key  string
+	resp *CachedResponse
+}
+
+// NewMemoryCache returns an LRU cache holding up to capacity responses.
+func NewMemoryCache(capacity int) CacheStore {
+	return &memoryCache{capacity: max(capacity, 1), order: list.New(), entries: map[string]*list.Element{}}
+}
+
+func (m *memoryCache) Get(key string) (*CachedResponse, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*memoryEntry)
+	if e.resp.expired(time.Now()) {
+		m.order.Remove(el)
+		delete(m.entries, key)
+		return nil, false
+	}
+	m.order.MoveToFront(el)
+	return e.resp, true
+}
+
+func (m *memoryCache) Put(key string, resp *CachedResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		el.Value.(*memoryEntry).resp = resp
+		m.order.MoveToFront(el)
+		return
+	}
+	m.entries[key] = m.order.PushFront(&memoryEntry{key: key, resp: resp})
+	for m.order.Len() > m.capacity {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.entries, oldest.Value.(*memoryEntry).key)
+		if m.evicted != nil {
+			m.evicted()
+		}
+	}
+}
+
+func (m *memoryCache) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.order.Init()
+	m.entries = map[string]*list.Element{}
+	return nil
+}
+
+func (m *memoryCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+func (m *memoryCache) Sweep() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for el := m.order.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*memoryEntry); e.resp.expired(now) {
+			m.order.Remove(el)
+			delete(m.entries, e.key)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// diskCache is a CacheStore keeping one file per response in a directory,
+// so the cache survives restarts. An index in memory tracks the size, expiry
+// and last use of every file; the last use is kept as the file's mtime so
+// the least recently used responses are evicted first after a restart too.
+type diskCache struct {
+	dir        string
+	maxEntries int   //0 => unlimited
+	maxBytes   int64 //0 => unlimited
+	mu         sync.Mutex
+	order      *list.List //front is most recently used
+	entries    map[string]*list.Element
+	size       int64
+	evicted    func()
+}
+
+type diskEntry struct {
+	key     string
+	size    int64
+	expires time.Time //zero => never
+}
+
+func (e *diskEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// NewDiskCache returns a cache storing responses in dir, evicting the least
+// recently used ones beyond maxEntries responses or maxBytes bytes, 0 for no
+// limit.
+func NewDiskCache(dir string, maxEntries int, maxBytes int64) (CacheStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &diskCache{dir: dir, maxEntries: maxEntries, maxBytes: maxBytes, order: list.New(), entries: map[string]*list.Element{}}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// load indexes the responses in the directory, dropping leftovers of
+// interrupted writes and files that can't be read.
+func (d *diskCache) load() error {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	type stored struct {
+		entry *diskEntry
+		used  time.Time
+	}
+	found := []stored{}
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasSuffix(name, ".json.tmp") {
+			os.Remove(filepath.Join(d.dir, name))
+			continue
+		}
+		key, ok := strings.CutSuffix(name, ".json")
+		if !ok || f.IsDir() {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		var head struct {
+			Expires time.Time `json:"expires"`
+		}
+		data, err := os.ReadFile(d.path(key))
+		if err != nil || json.Unmarshal(data, &head) != nil {
+			os.Remove(d.path(key))
+			continue
+		}
+		found = append(found, stored{&diskEntry{key: key, size: info.Size(), expires: head.Expires}, info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].used.Before(found[j].used) })
+	for _, s := range found {
+		d.entries[s.entry.key] = d.order.PushFront(s.entry)
+		d.size += s.entry.size
+	}
+	d.evict()
+	return nil
+}
+
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, key+".json")
+}
+
+// remove deletes the file of el and drops it from the index. Must be called
+// with d.mu held.
+func (d *diskCache) remove(el *list.Element) {
+	e := el.Value.(*diskEntry)
+	os.Remove(d.path(e.key))
+	d.order.Remove(el)
+	delete(d.entries, e.key)
+	d.size -= e.size
+}
+
+// evict removes the least recently used responses until the cache is within
+// its limits. Must be called with d.mu held.
+func (d *diskCache) evict() {
+	for d.order.Len() > 0 && ((d.maxEntries > 0 && d.order.Len() > d.maxEntries) || (d.maxBytes > 0 && d.size > d.maxBytes)) {
+		d.remove(d.order.Back())
+		if d.evicted != nil {
+			d.evicted()
+		}
+	}
+}
+
+func (d *diskCache) Get(key string) (*CachedResponse, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	el, ok := d.entries[key]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	if el.Value.(*diskEntry).expired(now) {
+		d.remove(el)
+		return nil, false
+	}
+	data, err := os.ReadFile(d.path(key))
+	resp := &CachedResponse{}
+	if err != nil || json.Unmarshal(data, resp) != nil {
+		d.remove(el)
+		return nil, false
+	}
+	d.order.MoveToFront(el)
+	os.Chtimes(d.path(key), now, now)
+	return resp, true
+}
+
+func (d *diskCache) Put(key string, resp *CachedResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tmp := d.path(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		logger.Error("Writing cached response failed: ", err)
+		return
+	}
+	if err := os.Rename(tmp, d.path(key)); err != nil {
+		logger.Error("Writing cached response failed: ", err)
+		os.Remove(tmp)
+		return
+	}
+	entry := &diskEntry{key: key, size: int64(len(data)), expires: resp.Expires}
+	if el, ok := d.entries[key]; ok {
+		d.size -= el.Value.(*diskEntry).size
+		el.Value = entry
+		d.order.MoveToFront(el)
+	} else {
+		d.entries[key] = d.order.PushFront(entry)
+	}
+	d.size += entry.size
+	d.evict()
+}
+
+func (d *diskCache) Clear() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.order.Init()
+	d.entries = map[string]*list.Element{}
+	d.size = 0
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			if err := os.Remove(filepath.Join(d.dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d *diskCache) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.order.Len()
+}
+
+func (d *diskCache) Sweep() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for el := d.order.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*diskEntry).expired(now) {
+			d.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// ResponseCache caches deterministic completions in front of the proxy.
+type ResponseCache struct {
+	Store CacheStore
+	TTL   time.Duration //0 => entries never expire
+
+	hits, misses, bypasses, stores, evictions, expirations int64
+	cancel                                                 context.CancelFunc
+}
+
+// NewResponseCache returns a cache in front of store that sweeps expired
+// responses from it until Close is called.
+func NewResponseCache(store CacheStore, ttl time.Duration) *ResponseCache {
+	c := &ResponseCache{Store: store, TTL: ttl}
+	evicted := func() { atomic.AddInt64(&c.evictions, 1) }
+	switch s := store.(type) {
+	case *memoryCache:
+		s.evicted = evicted
+	case *diskCache:
+		s.mu.Lock()
+		s.evicted = evicted
+		s.mu.Unlock()
+	}
+	var ctx context.Context
+	ctx, c.cancel = context.WithCancel(context.Background())
+	go c.sweep(ctx)
+	return c
+}
+
+func (c *ResponseCache) sweep(ctx context.Context) {
+	ticker := time.NewTicker(cacheSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			atomic.AddInt64(&c.expirations, int64(c.Store.Sweep()))
+		}
+	}
+}
+
+// Close stops sweeping the store.
+func (c *ResponseCache) Close() {
+	c.cancel()
+}
+
+func (c *ResponseCache) Stats() types.CacheStats {
+	return types.CacheStats{
+		Entries:     c.Store.Len(),
+		Hits:        atomic.LoadInt64(&c.hits),
+		Misses:      atomic.LoadInt64(&c.misses),
+		Bypasses:    atomic.LoadInt64(&c.bypasses),
+		Stores:      atomic.LoadInt64(&c.stores),
+		Evictions:   atomic.LoadInt64(&c.evictions),
+		Expirations: atomic.LoadInt64(&c.expirations),
+	}
+}
+
+// cacheKey returns the cache key of a completion request for config, or
+// false if the request isn't deterministic. Requests are normalized to the
+// fields that differ from the defaults, so spelling out a default doesn't
+// change the key. The slot doesn't change the result and is left out.
+func cacheKey(config *types.Model_Request, body []byte) (string, bool) {
+	pr := types.NewPredictionRequestWithDefaults()
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, pr); err != nil {
+			return "", false
+		}
+	}
+	if pr.Temperature > 0 && pr.Seed < 0 {
+		return "", false
+	}
+	fields := pr.Overrides()
+	delete(fields, "id_slot")
+	delete(fields, "cache_prompt")
+
+	//fields chatterbox doesn't know are part of the request too
+	extra := map[string]json.RawMessage{}
+	json.Unmarshal(body, &extra)
+	for name := range extra {
+		if predictionFields[name] {
+			delete(extra, name)
+		}
+	}
+
+	konfig, err := json.Marshal(config)
+	if err != nil {
+		return "", false
+	}
+	request, err := json.Marshal(struct {
+		Fields map[string]interface{}     `json:"fields"`
+		Extra  map[string]json.RawMessage `json:"extra"`
+	}{fields, extra})
+	if err != nil {
+		return "", false
+	}
+	h := sha256.New()
+	h.Write(konfig)
+	h.Write([]byte{0})
+	h.Write(request)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// predictionFields are the JSON names of types.Prediction_Request's fields
+// and the legacy slot_id.
+var predictionFields = func() map[string]bool {
+	fields := map[string]bool{"slot_id": true}
+	t := reflect.TypeOf(types.Prediction_Request{})
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath != "" {
+			continue
+		}
+		fields[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	return fields
+}()
+
+// cacheMode returns what the request's headers allow: lookup and store.
+func cacheMode(r *http.Request) (lookup, store bool) {
+	switch strings.ToLower(r.Header.Get(CacheHeader)) {
+	case "bypass":
+		return false, false
+	case "refresh":
+		return false, true
+	}
+	cc := strings.ToLower(r.Header.Get("Cache-Control"))
+	if strings.Contains(cc, "no-store") {
+		return false, false
+	}
+	if strings.Contains(cc, "no-cache") {
+		return false, true
+	}
+	return true, true
+}
+
+// lookup answers r from the cache if possible and returns the response it
+// sent. Otherwise it returns the hook storing the response once it has been
+// read completely, or nil.
+func (c *ResponseCache) lookup(w http.ResponseWriter, r *http.Request, config *types.Model_Request) (*CachedResponse, func(*http.Response) error) {
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil
+	}
+	key, ok := cacheKey(config, body)
+	lookup, store := cacheMode(r)
+	if !ok || (!lookup && !store) {
+		atomic.AddInt64(&c.bypasses, 1)
+		w.Header().Set(CacheHeader, "bypass")
+		return nil, nil
+	}
+	if lookup {
+		if cached, ok := c.Store.Get(key); ok {
+			atomic.AddInt64(&c.hits, 1)
+			w.Header().Set(CacheHeader, "hit")
+			w.Header().Set("Content-Type", cached.ContentType)
+			w.WriteHeader(cached.Status)
+			w.Write(cached.Body)
+			return cached, nil
+		}
+	}
+	atomic.AddInt64(&c.misses, 1)
+	w.Header().Set(CacheHeader, "miss")
+	return nil, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		resp.Body = &captureBody{ReadCloser: resp.Body, done: func(data []byte, complete bool) {
+			if !complete || !replayable(resp.Header.Get("Content-Type"), data) {
+				return
+			}
+			cached := &CachedResponse{Status: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), Body: data}
+			if c.TTL > 0 {
+				cached.Expires = time.Now().Add(c.TTL)
+			}
+			c.Store.Put(key, cached)
+			atomic.AddInt64(&c.stores, 1)
+		}}
+		return nil
+	}
+}
+
+// replayable reports whether a response body is complete: a JSON result, or
+// a stream whose last event is the final result.
+func replayable(contentType string, data []byte) bool {
+	if !strings.HasPrefix(contentType, "text/event-stream") {
+		return json.Valid(data)
+	}
+	events := strings.Split(strings.TrimSpace(string(data)), "\n")
+	last, ok := strings.CutPrefix(events[len(events)-1], "data: ")
+	if !ok {
+		return false
+	}
+	var final struct {
+		Stop  bool        `json:"stop"`
+		Error interface{} `json:"error"`
+	}
+	return json.Unmarshal([]byte(last), &final) == nil && final.Stop && final.Error == nil
+}
+
+// captureBody passes a body through and hands it to done once it has been
+// read to the end, or closed before that. data is nil if the body was larger
+// than maxCachedBody, complete is false if it was closed early.
+type captureBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	overflow bool
+	done     func(data []byte, complete bool)
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.overflow {
+		if b.buf.Len()+n > maxCachedBody {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF {
+		b.finish(true)
+	}
+	return n, err
+}
+
+func (b *captureBody) Close() error {
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
+
+func (b *captureBody) finish(complete bool) {
+	if b.done == nil {
+		return
+	}
+	var data []byte
+	if !b.overflow {
+		data = b.buf.Bytes()
+	}
+	b.done(data, complete)
+	b.done = nil
+}
+
+func (s *Server) getCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Cache == nil {
+		http.Error(w, "Response cache is disabled", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(s.Cache.Stats())
+}
+
+func (s *Server) clearCacheHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Cache == nil {
+		http.Error(w, "Response cache is disabled", http.StatusNotFound)
+		return
+	}
+	if err := s.Cache.Store.Clear(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Cache cleared"))
+}
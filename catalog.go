@@ -0,0 +1,258 @@
+package chatterbox
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+const (
+	modelFileType = ".gguf"
+
+	catalogPollInterval = 5 * time.Second
+	catalogDebounce     = 200 * time.Millisecond
+)
+
+type CatalogEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Error   string    `json:"error,omitempty"` //set for konfigs that fail to parse or validate
+}
+
+// Catalog keeps an in-memory view of the weights in ModelPath and the konfigs
+// in the konfig store and publishes add/remove/modify events when they change.
+type Catalog struct {
+	path         string
+	store        types.KonfigStore
+	events       *EventBus
+	pollInterval time.Duration
+
+	scanMu  sync.Mutex
+	mu      sync.RWMutex
+	models  map[string]CatalogEntry
+	konfigs map[string]CatalogEntry
+}
+
+func NewCatalog(path string, store types.KonfigStore, events *EventBus) *Catalog {
+	c := &Catalog{
+		path:         path,
+		store:        store,
+		events:       events,
+		pollInterval: catalogPollInterval,
+		models:       map[string]CatalogEntry{},
+		konfigs:      map[string]CatalogEntry{},
+	}
+	c.Rescan()
+	return c
+}
+
+// Models returns the file names of all weights, sorted.
+func (c *Catalog) Models() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return sortedKeys(c.models)
+}
+
+// Konfigs returns the names of all konfigs without extension, sorted.
+func (c *Catalog) Konfigs() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return sortedKeys(c.konfigs)
+}
+
+func sortedKeys(m map[string]CatalogEntry) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Rescan reads the directory and the konfig store and publishes the
+// differences to the last scan.
+func (c *Catalog) Rescan() {
+	c.scanMu.Lock()
+	defer c.scanMu.Unlock()
+
+	files, err := os.ReadDir(c.path)
+	if err != nil {
+		logger.Error("Error reading directory: ", err)
+		return
+	}
+	infos, err := c.store.List()
+	if err != nil {
+		logger.Error("Error listing konfigs: ", err)
+		return
+	}
+
+	models := map[string]CatalogEntry{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), modelFileType) {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		models[file.Name()] = CatalogEntry{Name: file.Name(), Size: info.Size(), ModTime: info.ModTime()}
+	}
+	konfigs := map[string]CatalogEntry{}
+	for _, info := range infos {
+		konfigs[info.Name] = CatalogEntry{Name: info.Name, Size: info.Size, ModTime: info.ModTime}
+	}
+
+	//only Rescan replaces the maps, so scanMu keeps them until the swap below
+	//and readers aren't held up while konfigs are read and validated
+	c.mu.RLock()
+	oldModels, oldKonfigs := c.models, c.konfigs
+	c.mu.RUnlock()
+	//konfigs referencing weights or base konfigs may have become (in)valid
+	changed := !sameEntries(models, oldModels) || !sameEntries(konfigs, oldKonfigs)
+	for name, entry := range konfigs {
+		if old, ok := oldKonfigs[name]; ok && sameFile(old, entry) && !changed {
+			konfigs[name] = old
+			continue
+		}
+		entry.Error = c.validateKonfig(name)
+		konfigs[name] = entry
+	}
+	c.mu.Lock()
+	c.models, c.konfigs = models, konfigs
+	c.mu.Unlock()
+
+	c.publishDiff(oldModels, models, EventCatalogWeightsAdded, EventCatalogWeightsRemoved, EventCatalogWeightsModified)
+	c.publishDiff(oldKonfigs, konfigs, EventCatalogKonfigAdded, EventCatalogKonfigRemoved, EventCatalogKonfigModified)
+}
+
+func (c *Catalog) validateKonfig(name string) string {
+	data, err := c.store.Load(name)
+	if err != nil {
+		return err.Error()
+	}
+	config := types.NewModelRequestWithDefaults()
+	if err := json.Unmarshal(data, config); err != nil {
+		return err.Error()
+	}
+	config.ModelName = name
+	resolved, err := config.Resolve(c.store)
+	if err != nil {
+		return err.Error()
+	}
+	if err := resolved.Validate(c.path); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func sameFile(a, b CatalogEntry) bool {
+	return a.Size == b.Size && a.ModTime.Equal(b.ModTime)
+}
+
+func sameEntries(a, b map[string]CatalogEntry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, entry := range a {
+		if other, ok := b[name]; !ok || !sameFile(entry, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Catalog) publishDiff(old, new map[string]CatalogEntry, added, removed, modified EventType) {
+	if c.events == nil {
+		return
+	}
+	for name, entry := range new {
+		prev, ok := old[name]
+		switch {
+		case !ok:
+			c.events.Publish(added, entry)
+		case !sameFile(prev, entry):
+			c.events.Publish(modified, entry)
+		case prev.Error == entry.Error:
+			continue
+		}
+		if entry.Error != "" {
+			c.events.Publish(EventCatalogKonfigInvalid, entry)
+		}
+	}
+	for name, entry := range old {
+		if _, ok := new[name]; !ok {
+			c.events.Publish(removed, entry)
+		}
+	}
+}
+
+// Watch keeps the catalog up to date until ctx is done. It uses fsnotify on
+// the model directory and the konfig store's directory and falls back to
+// polling if they can't be watched.
+func (c *Catalog) Watch(ctx context.Context) {
+	dirs := []string{c.path}
+	if ws, ok := c.store.(types.WatchableStore); !ok {
+		go c.poll(ctx)
+	} else if ws.WatchDir() != c.path {
+		dirs = append(dirs, ws.WatchDir())
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		for _, dir := range dirs {
+			if err = watcher.Add(dir); err != nil {
+				watcher.Close()
+				break
+			}
+		}
+	}
+	if err != nil {
+		logger.Warn("Watching model directory failed, falling back to polling: ", err)
+		c.poll(ctx)
+		return
+	}
+	defer watcher.Close()
+
+	//changes usually come in bursts (e.g. downloads), so rescan once they settle
+	debounce := time.NewTimer(catalogDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			debounce.Reset(catalogDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logger.Error("Model directory watcher: ", err)
+			debounce.Reset(catalogDebounce)
+		case <-debounce.C:
+			c.Rescan()
+		}
+	}
+}
+
+func (c *Catalog) poll(ctx context.Context) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Rescan()
+		}
+	}
+}
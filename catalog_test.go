@@ -0,0 +1,243 @@
+package chatterbox
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// catalogEvents collects the catalog events published so far.
+func catalogEvents(events <-chan Event) map[EventType][]string {
+	got := map[EventType][]string{}
+	for {
+		select {
+		case ev := <-events:
+			if entry, ok := ev.Data.(CatalogEntry); ok {
+				got[ev.Type] = append(got[ev.Type], entry.Name)
+			}
+		default:
+			return got
+		}
+	}
+}
+
+// waitCatalogEvent waits for an event of type et about name.
+func waitCatalogEvent(t *testing.T, events <-chan Event, et EventType, name string) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if entry, ok := ev.Data.(CatalogEntry); ok && ev.Type == et && entry.Name == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no %s event for %s", et, name)
+		}
+	}
+}
+
+func Test_CatalogRescan(t *testing.T) {
+	dir := t.TempDir()
+	store, err := types.NewFileStore(filepath.Join(dir, "konfigs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe()
+	defer cancel()
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a.gguf", "weights")
+	write("notes.txt", "not a model")
+	c := NewCatalog(dir, store, bus)
+	if got := c.Models(); len(got) != 1 || got[0] != "a.gguf" {
+		t.Errorf("models %v", got)
+	}
+	if got := catalogEvents(events); len(got[EventCatalogWeightsAdded]) != 1 {
+		t.Errorf("initial scan published %v", got)
+	}
+
+	//nothing changed, nothing published
+	c.Rescan()
+	if got := catalogEvents(events); len(got) != 0 {
+		t.Errorf("unchanged rescan published %v", got)
+	}
+
+	write("a.gguf", "bigger weights")
+	write("b.gguf", "weights")
+	store.Save("k", []byte(`{"model":"missing.gguf"}`))
+	c.Rescan()
+	got := catalogEvents(events)
+	for et, want := range map[EventType]string{
+		EventCatalogWeightsModified: "a.gguf",
+		EventCatalogWeightsAdded:    "b.gguf",
+		EventCatalogKonfigAdded:     "k",
+		EventCatalogKonfigInvalid:   "k",
+	} {
+		if len(got[et]) != 1 || got[et][0] != want {
+			t.Errorf("%s: got %v, want %s", et, got[et], want)
+		}
+	}
+	if got := c.Konfigs(); len(got) != 1 || got[0] != "k" {
+		t.Errorf("konfigs %v", got)
+	}
+
+	//the konfig becomes valid once its weights show up
+	write("missing.gguf", "weights")
+	c.Rescan()
+	got = catalogEvents(events)
+	if len(got[EventCatalogKonfigInvalid]) != 0 || len(got[EventCatalogWeightsAdded]) != 1 {
+		t.Errorf("adding the weights published %v", got)
+	}
+	c.mu.RLock()
+	entry := c.konfigs["k"]
+	c.mu.RUnlock()
+	if entry.Error != "" {
+		t.Errorf("konfig still invalid: %s", entry.Error)
+	}
+
+	os.Remove(filepath.Join(dir, "b.gguf"))
+	store.Delete("k")
+	c.Rescan()
+	got = catalogEvents(events)
+	if len(got[EventCatalogWeightsRemoved]) != 1 || len(got[EventCatalogKonfigRemoved]) != 1 {
+		t.Errorf("removal published %v", got)
+	}
+}
+
+func Test_CatalogWatch(t *testing.T) {
+	dir := t.TempDir()
+	store, err := types.NewFileStore(filepath.Join(dir, "konfigs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe()
+	defer cancel()
+	c := NewCatalog(dir, store, bus)
+	c.pollInterval = time.Hour //only the watcher can notice changes
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Watch(ctx)
+		close(done)
+	}()
+	//give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	os.WriteFile(filepath.Join(dir, "a.gguf"), []byte("weights"), 0644)
+	waitCatalogEvent(t, events, EventCatalogWeightsAdded, "a.gguf")
+	store.Save("k", []byte(`{"model":"a.gguf"}`))
+	waitCatalogEvent(t, events, EventCatalogKonfigAdded, "k")
+
+	stop()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch didn't return once its context was done")
+	}
+}
+
+// unwatchableStore hides the directory of a store, so the catalog has to
+// poll it.
+type unwatchableStore struct {
+	types.KonfigStore
+}
+
+func Test_CatalogPolling(t *testing.T) {
+	dir := t.TempDir()
+	files, err := types.NewFileStore(filepath.Join(t.TempDir(), "konfigs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := unwatchableStore{files}
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe()
+	defer cancel()
+	c := NewCatalog(dir, store, bus)
+	c.pollInterval = 50 * time.Millisecond
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go c.Watch(ctx)
+
+	store.Save("k", []byte(`{"model":"a.gguf"}`))
+	waitCatalogEvent(t, events, EventCatalogKonfigAdded, "k")
+
+	//a directory that can't be watched is polled as well
+	missing := filepath.Join(dir, "missing")
+	polled := NewCatalog(missing, store, nil)
+	polled.pollInterval = 50 * time.Millisecond
+	go polled.Watch(ctx)
+	time.Sleep(100 * time.Millisecond)
+	os.Mkdir(missing, 0755)
+	os.WriteFile(filepath.Join(missing, "a.gguf"), []byte("weights"), 0644)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(polled.Models()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("polling didn't find the new weights")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// slowStore holds up loading konfigs until release is closed.
+type slowStore struct {
+	types.KonfigStore
+	loading chan struct{}
+	release chan struct{}
+}
+
+func (s *slowStore) Load(name string) ([]byte, error) {
+	select {
+	case s.loading <- struct{}{}:
+	default:
+	}
+	<-s.release
+	return s.KonfigStore.Load(name)
+}
+
+func Test_CatalogRescanUnlocked(t *testing.T) {
+	dir := t.TempDir()
+	files, err := types.NewFileStore(filepath.Join(dir, "konfigs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &slowStore{KonfigStore: files, loading: make(chan struct{}, 1), release: make(chan struct{})}
+	c := NewCatalog(dir, store, nil)
+
+	files.Save("k", []byte(`{"model":"m.gguf"}`))
+	done := make(chan struct{})
+	go func() {
+		c.Rescan()
+		close(done)
+	}()
+	<-store.loading
+
+	//listings don't wait for konfigs to be validated
+	listed := make(chan []string)
+	go func() { listed <- c.Konfigs() }()
+	select {
+	case got := <-listed:
+		if len(got) != 0 {
+			t.Errorf("konfigs before the rescan finished %v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listing blocked by the rescan")
+	}
+	close(store.release)
+	<-done
+	if got := c.Konfigs(); len(got) != 1 || got[0] != "k" {
+		t.Errorf("konfigs %v", got)
+	}
+}
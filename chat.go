@@ -0,0 +1,265 @@
+package chatterbox
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/schnapper79/chatterbox/grammar"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// randomID returns prefix followed by 24 random hex digits.
+func randomID(prefix string) string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return prefix + hex.EncodeToString(b)
+}
+
+// checkChatRequest checks what the OpenAI API would reject before anything
+// is rendered.
+func checkChatRequest(req *types.ChatCompletion_Request) error {
+	if req.Stream {
+		return fmt.Errorf("stream is not supported by /v1/chat/completions")
+	}
+	if len(req.Messages) == 0 {
+		return fmt.Errorf("messages is required")
+	}
+	for i, m := range req.Messages {
+		switch m.Role {
+		case "system", "user", "assistant", "tool":
+		default:
+			return fmt.Errorf("messages[%d]: unknown role %q", i, m.Role)
+		}
+	}
+	names := map[string]bool{}
+	for i, t := range req.Tools {
+		if t.Type != "" && t.Type != "function" {
+			return fmt.Errorf("tools[%d]: unsupported type %q", i, t.Type)
+		}
+		if t.Function.Name == "" {
+			return fmt.Errorf("tools[%d]: function name is required", i)
+		}
+		if names[t.Function.Name] {
+			return fmt.Errorf("tools[%d]: function %q is defined twice", i, t.Function.Name)
+		}
+		names[t.Function.Name] = true
+	}
+	if c := req.ToolChoice; c != nil {
+		switch {
+		case c.Function != "" && !names[c.Function]:
+			return fmt.Errorf("tool_choice names the unknown function %q", c.Function)
+		case c.Function == "" && c.Mode != types.ToolChoiceNone && c.Mode != types.ToolChoiceAuto && c.Mode != types.ToolChoiceRequired:
+			return fmt.Errorf("unknown tool_choice %q", c.Mode)
+		case c.Forced() && len(req.Tools) == 0:
+			return fmt.Errorf("tool_choice requires tools")
+		}
+	}
+	return nil
+}
+
+// toolGrammar returns a grammar allowing only tool calls permitted by
+// choice: exactly one call of the named function, or one or more calls of any
+// tool. The arguments are constrained by the tools' parameter schemas.
+func toolGrammar(tools []types.Tool, choice *types.ToolChoice) (string, error) {
+	parts := []string{}
+	alts := []string{}
+	for i, t := range tools {
+		if choice.Function != "" && t.Function.Name != choice.Function {
+			continue
+		}
+		params := &grammar.Schema{Type: []string{"object"}}
+		if len(t.Function.Parameters) > 0 {
+			var err error
+			if params, err = grammar.ParseSchema(t.Function.Parameters); err != nil {
+				return "", fmt.Errorf("tools[%d]: parameters: %v", i, err)
+			}
+		}
+		args := fmt.Sprintf("tool%d-arguments", i)
+		rules, err := params.Rules(args)
+		if err != nil {
+			return "", fmt.Errorf("tools[%d]: parameters: %v", i, err)
+		}
+		parts = append(parts, rules)
+		name, _ := json.Marshal(t.Function.Name)
+		alts = append(alts, grammar.Literal(`{"name": `+string(name)+`, "arguments": `)+" "+args+` "}"`)
+	}
+
+	root := `root ::= tool-call ("\n" tool-call)*` + "\n"
+	if choice.Function != "" {
+		root = "root ::= tool-call\n"
+	}
+	call := "tool-call ::= " + grammar.Literal(types.ToolCallStart+"\n") + " (" + strings.Join(alts, " | ") + ") " + grammar.Literal("\n"+types.ToolCallEnd) + "\n"
+	g, err := grammar.Join(append([]string{root, call}, parts...)...)
+	if err != nil {
+		return "", err
+	}
+	if err := grammar.Check(g); err != nil {
+		return "", fmt.Errorf("generated tool grammar is invalid: %v", err)
+	}
+	return g, nil
+}
+
+// chatFields returns the completion request for a chat: the konfig's
+// defaults overridden by the request's sampling parameters.
+func chatFields(config *types.Model_Request, req *types.ChatCompletion_Request) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if config.Defaults != nil {
+		for name, value := range config.Defaults.Overrides() {
+			fields[name] = value
+		}
+	}
+	//grammars of the defaults would fight the chat template
+	delete(fields, "grammar")
+	delete(fields, "grammar_name")
+	delete(fields, "response_format")
+	if req.Temperature != nil {
+		fields["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		fields["top_p"] = *req.TopP
+	}
+	if req.Seed != nil {
+		fields["seed"] = *req.Seed
+	}
+	if req.MaxTokens != nil {
+		fields["n_predict"] = *req.MaxTokens
+	}
+	stop, _ := fields["stop"].([]string)
+	if req.Stop != nil {
+		stop = req.Stop
+	}
+	fields["stop"] = append(append([]string{}, stop...), types.ChatStop(config.ChatTemplate)...)
+	fields["stream"] = false
+	fields["cache_prompt"] = true
+	return fields
+}
+
+// openAIChatHandler implements the OpenAI chat completions API, including
+// tool calling, on top of the llama.cpp /completion endpoint. Tools are
+// described to the model through the konfig's chat template, and a grammar
+// enforces calls if tool_choice requires them.
+func (s *Server) openAIChatHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &types.ChatCompletion_Request{}
+	if err := json.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkChatRequest(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var runner *Runner
+	pool, target, ok := s.routePool(req.Model)
+	if ok {
+		pool, runner, _ = s.pick(pool, Affinity{Replica: -1, Slot: -1}, requestID(r.Context()))
+	}
+	if runner == nil {
+		worker, ok := s.workerFor(target)
+		if !ok {
+			http.Error(w, "Model not loaded", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		audit := s.startRemoteAudit(r, req.Model, target, worker)
+		w = audit.track(w)
+		defer audit.done()
+		s.forwardToWorker(w, r, worker, req.Model, target)
+		return
+	}
+	defer runner.Release(requestID(r.Context()))
+	config := runner.Config
+	audit := s.startAudit(r, req.Model, pool)
+	w = audit.track(w)
+	defer audit.done()
+
+	tools := req.Tools
+	if req.ToolChoice != nil && req.ToolChoice.Mode == types.ToolChoiceNone {
+		tools = nil
+	}
+	prompt, err := types.RenderChat(config.ChatTemplate, types.ToolMessages(config.ChatTemplate, req.Messages, tools))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fields := chatFields(config, req)
+	fields["prompt"] = prompt
+	if req.ToolChoice.Forced() {
+		g, err := toolGrammar(req.Tools, req.ToolChoice)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fields["grammar"] = g
+	}
+
+	//validate what llama.cpp will get, like a completion request
+	data, err := json.Marshal(fields)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pr := &types.Prediction_Request{}
+	if err := json.Unmarshal(data, pr); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := s.nPredictCap(config)
+	if err := pr.Validate(limit); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if limit > 0 && pr.NPredict < 0 {
+		fields["n_predict"] = limit
+	}
+
+	data, _ = json.Marshal(fields)
+	audit.setRequest(data)
+	result := &types.Result{}
+	if err := callRunner(r.Context(), runner, "/completion", fields, result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	audit.setResult(result)
+
+	message := types.ChatMessage{Role: "assistant", Content: strings.TrimSpace(result.Content)}
+	finish := "stop"
+	if result.StoppedLimit {
+		finish = "length"
+	}
+	if len(tools) > 0 {
+		text, calls := types.ParseToolCalls(result.Content, func() string { return randomID("call_") })
+		if len(calls) > 0 {
+			message.Content = text
+			message.ToolCalls = calls
+			finish = "tool_calls"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(BackendHeader, config.ModelName)
+	json.NewEncoder(w).Encode(&types.ChatCompletion_Response{
+		ID:      randomID("chatcmpl-"),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []types.ChatChoice{{Index: 0, Message: message, FinishReason: finish}},
+		Usage: types.OpenAIUsage{
+			PromptTokens:     result.TokensEvaluated,
+			CompletionTokens: result.TokensPredicted,
+			TotalTokens:      result.TokensEvaluated + result.TokensPredicted,
+		},
+	})
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/schnapper79/chatterbox"
+	"github.com/schnapper79/chatterbox/types"
 )
 
 func main() {
@@ -30,20 +36,156 @@ func main() {
 
 	var startmodel string
 	var host string
+	var storeType string
+	var storePath string
+	var coordinator string
+	var advertise string
+	var workerID string
+	var workerSecret string
+	var maxNPredict int
+	var cacheType string
+	var cacheSize int
+	var cacheMaxBytes int64
+	var cacheTTL time.Duration
+	var cachePath string
+	var auditPath string
+	var auditMaxSize int64
+	var auditKeep int
+	var auditRedact string
+	var logFormat string
+	var logLevel string
+	var otlpEndpoint string
+	var eventOrigins string
 	flag.StringVar(&startmodel, "s", "", "Start model")
 	flag.StringVar(&PathToLLama, "llama", "./llama.cpp", "Path to llama.cpp")
 	flag.StringVar(&host, "host", ":8080", "Host")
+	flag.StringVar(&storeType, "konfig-store", "file", "Konfig store: file or bolt")
+	flag.StringVar(&storePath, "konfig-store-path", "", "Konfig directory (file) or database (bolt), defaults to MODEL_PATH/konfigs[.db]")
+
+	flag.IntVar(&maxNPredict, "max-n-predict", 0, "Cap on n_predict of completion requests, 0 for no cap")
+	flag.StringVar(&cacheType, "cache", "", "Cache deterministic completions: memory or disk, empty to disable")
+	flag.IntVar(&cacheSize, "cache-size", 1000, "Responses kept by the cache")
+	flag.Int64Var(&cacheMaxBytes, "cache-max-bytes", 1<<30, "Bytes kept by the disk cache, 0 for no limit")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 24*time.Hour, "Lifetime of cached responses, 0 to keep them forever")
+	flag.StringVar(&cachePath, "cache-path", "", "Directory of the disk cache, defaults to MODEL_PATH/cache")
+
+	flag.StringVar(&auditPath, "audit", "", "Write an audit record of every generation request to this file, empty to disable")
+	flag.Int64Var(&auditMaxSize, "audit-max-size", 100<<20, "Rotate the audit log once it is larger, in bytes, 0 to never rotate")
+	flag.IntVar(&auditKeep, "audit-keep", 10, "Rotated audit logs kept")
+	flag.StringVar(&auditRedact, "audit-redact", "", "JSON file of redaction rules for the audit log")
+
+	flag.StringVar(&logFormat, "log-format", "text", "Server log format: text or json, the access log is always json")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+
+	flag.StringVar(&eventOrigins, "event-origins", "", "Comma separated origins, e.g. https://dash.example.com, allowed to open the events WebSocket besides the server's own, * for any")
+
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "Export traces via OTLP/HTTP to this URL, e.g. http://localhost:4318, empty to disable")
+
+	flag.StringVar(&coordinator, "coordinator", "", "Run as worker of the coordinator at this URL")
+	flag.StringVar(&advertise, "advertise", "", "URL the coordinator reaches this worker at, defaults to http://<hostname><host>")
+	flag.StringVar(&workerID, "worker-id", "", "Worker id, defaults to the hostname")
+	flag.StringVar(&workerSecret, "worker-secret", os.Getenv("CHATTERBOX_WORKER_SECRET"), "Secret shared by the coordinator and its workers, required to accept workers (env CHATTERBOX_WORKER_SECRET)")
 
 	flag.Parse()
 
-	server := chatterbox.GetServer(ModelPath, PathToLLama, host)
+	if err := chatterbox.ConfigureLogging(logFormat, logLevel); err != nil {
+		log.Fatal(err)
+	}
+
+	if otlpEndpoint != "" {
+		shutdown, err := chatterbox.SetupTracing(context.Background(), otlpEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer shutdown(context.Background())
+	}
+
+	var store types.KonfigStore
+	var err error
+	switch storeType {
+	case "file":
+		if storePath == "" {
+			storePath = ModelPath + "/konfigs"
+		}
+		store, err = types.NewFileStore(storePath)
+	case "bolt":
+		if storePath == "" {
+			storePath = ModelPath + "/konfigs.db"
+		}
+		store, err = types.NewBoltStore(storePath)
+	default:
+		log.Fatalf("Unknown konfig store %q", storeType)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	server := chatterbox.NewServer(ModelPath, PathToLLama, host, store)
+	defer server.Close()
+	server.MaxNPredict = maxNPredict
+	server.WorkerSecret = workerSecret
+	if eventOrigins != "" {
+		server.EventOrigins = strings.Split(eventOrigins, ",")
+	}
+
+	switch cacheType {
+	case "":
+	case "memory":
+		server.Cache = chatterbox.NewResponseCache(chatterbox.NewMemoryCache(cacheSize), cacheTTL)
+	case "disk":
+		if cachePath == "" {
+			cachePath = ModelPath + "/cache"
+		}
+		cache, err := chatterbox.NewDiskCache(cachePath, cacheSize, cacheMaxBytes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Cache = chatterbox.NewResponseCache(cache, cacheTTL)
+	default:
+		log.Fatalf("Unknown cache %q", cacheType)
+	}
+
+	if auditPath != "" {
+		rules := []types.RedactionRule{}
+		if auditRedact != "" {
+			rules, err = types.LoadRedactionRules(auditRedact)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		server.Audit, err = chatterbox.NewAuditLog(auditPath, auditMaxSize, auditKeep, rules)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer server.Audit.Close()
+	}
 
 	if startmodel != "" {
 		server.LoadModellFromFile(startmodel)
 	}
 
+	if coordinator != "" {
+		if workerSecret == "" {
+			log.Fatal("-worker-secret is required to register with a coordinator")
+		}
+		hostname, _ := os.Hostname()
+		if workerID == "" {
+			workerID = hostname
+		}
+		if advertise == "" {
+			advertise = "http://" + hostname + host
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			server.RunWorker(ctx, coordinator, advertise, workerID)
+			server.Server.Shutdown(context.Background())
+		}()
+	}
+
 	log.Printf("Server started on %s\n", host)
-	err := server.Server.ListenAndServe()
+	err = server.Server.ListenAndServe()
 	if err != nil {
 		if err.Error() == "http: Server closed" {
 			log.Println("Server closed")
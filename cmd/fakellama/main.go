@@ -0,0 +1,16 @@
+// Command fakellama is a stand-in for the llama.cpp server binary. Install it
+// as <llama path>/server to run chatterbox without llama.cpp.
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/schnapper79/chatterbox/internal/fakellama"
+)
+
+func main() {
+	if err := fakellama.Main(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
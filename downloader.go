@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"os"
 	"strings"
+
+	"github.com/schnapper79/chatterbox/types"
 )
 
 type ProgressReader struct {
@@ -40,14 +42,26 @@ func (s *Server) downloadModelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	out_split := strings.Split(url, "/")
+	filename := out_split[len(out_split)-1]
+	// Strip query and fragment, they are not part of the file name
+	filename = strings.SplitN(strings.SplitN(filename, "?", 2)[0], "#", 2)[0]
+	outPath, err := types.SafeJoin(s.ModelPath, filename)
+	if err != nil {
+		http.Error(w, "Invalid file name in 'url' parameter", http.StatusBadRequest)
+		return
+	}
+
 	resp, err := http.Get(url)
 	if err != nil {
+		s.Events.Publish(EventDownloadFailed, DownloadEvent{URL: url, File: filename, Error: err.Error()})
 		http.Error(w, "Failed to start download", http.StatusInternalServerError)
 		return
 	}
 	defer resp.Body.Close()
 
 	// Initialize ProgressReader
+	lastPercent := -1
 	progressReader := &ProgressReader{
 		reader: resp.Body,
 		total:  resp.ContentLength,
@@ -56,22 +70,33 @@ func (s *Server) downloadModelHandler(w http.ResponseWriter, r *http.Request) {
 			if f, ok := w.(http.Flusher); ok {
 				f.Flush()
 			}
+			// Only publish whole percent steps to the event bus
+			percentage := float64(bytesRead) / float64(total) * 100
+			if int(percentage) != lastPercent {
+				lastPercent = int(percentage)
+				s.Events.Publish(EventDownloadProgress, DownloadEvent{URL: url, File: filename, BytesRead: bytesRead, Total: total, Progress: percentage})
+			}
 		},
 	}
 
 	// Create a new file to save the downloaded content
-	out_split := strings.Split(url, "/")
-	outFile, err := os.Create(s.ModelPath + "/" + out_split[len(out_split)-1])
+	outFile, err := os.Create(outPath)
 
 	if err != nil {
+		s.Events.Publish(EventDownloadFailed, DownloadEvent{URL: url, File: filename, Error: err.Error()})
 		http.Error(w, "Failed to create file", http.StatusInternalServerError)
 		return
 	}
 	defer outFile.Close()
+	s.Events.Publish(EventDownloadStarted, DownloadEvent{URL: url, File: filename, Total: resp.ContentLength})
 
 	// Download the file (this will trigger the progress reporting)
-	_, err = io.Copy(outFile, progressReader)
+	n, err := io.Copy(outFile, progressReader)
 	if err != nil {
+		s.Events.Publish(EventDownloadFailed, DownloadEvent{URL: url, File: filename, BytesRead: n, Total: resp.ContentLength, Error: err.Error()})
 		http.Error(w, "Failed to complete download", http.StatusInternalServerError)
+	} else {
+		s.Events.Publish(EventDownloadCompleted, DownloadEvent{URL: url, File: filename, BytesRead: n, Total: resp.ContentLength, Progress: 100})
 	}
+	s.Catalog.Rescan()
 }
@@ -0,0 +1,140 @@
+package chatterbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// maxEmbeddingInputs caps the inputs of one OpenAI embeddings request, like
+// the OpenAI API does.
+const maxEmbeddingInputs = 2048
+
+// checkEmbeddings returns an error for the client and the HTTP status to
+// send if runner can't compute embeddings.
+func checkEmbeddings(runner *Runner) (int, error) {
+	if !runner.Config.Embeddings {
+		return http.StatusBadRequest, fmt.Errorf("Model %s was not loaded with embeddings enabled, set \"embeddings\": true in its konfig", runner.Config.ModelName)
+	}
+	if _, ok := runner.Backend.Endpoint("/embedding"); !ok {
+		return http.StatusNotImplemented, fmt.Errorf("/embedding is not supported by the %s backend", runner.Config.Backend)
+	}
+	return http.StatusOK, nil
+}
+
+func (s *Server) embeddingProxy(w http.ResponseWriter, r *http.Request) {
+	// Access the model value from the path
+	vars := mux.Vars(r)
+	modelname := vars["model"]
+
+	id := requestID(r.Context())
+	runner, target, ok := s.pickRunner(modelname, id)
+	if !ok {
+		if s.routeToWorker(w, r, modelname, target) {
+			return
+		}
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
+	}
+	defer runner.Release(id)
+	if status, err := checkEmbeddings(runner); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set(BackendHeader, runner.Config.ModelName)
+	s.genericProxy(w, r, "/embedding", runner, nil)
+}
+
+// openAIEmbeddingsHandler implements the OpenAI embeddings API on top of the
+// llama.cpp /embedding endpoint. The inputs are sent concurrently, at most
+// one per parallel slot of the model. llama.cpp doesn't report how many
+// tokens an embedding took, so every input costs an extra /tokenize call for
+// the usage.
+func (s *Server) openAIEmbeddingsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &types.OpenAIEmbeddings_Request{}
+	if err := json.Unmarshal(body, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Input) == 0 {
+		http.Error(w, "input is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.Input) > maxEmbeddingInputs {
+		http.Error(w, fmt.Sprintf("At most %d inputs are allowed, got %d", maxEmbeddingInputs, len(req.Input)), http.StatusBadRequest)
+		return
+	}
+	if req.EncodingFormat != "" && req.EncodingFormat != "float" {
+		http.Error(w, fmt.Sprintf("Unsupported encoding_format %q, only float is supported", req.EncodingFormat), http.StatusBadRequest)
+		return
+	}
+
+	id := requestID(r.Context())
+	runner, target, ok := s.pickRunner(req.Model, id)
+	if !ok {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if s.routeToWorker(w, r, req.Model, target) {
+			return
+		}
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
+	}
+	defer runner.Release(id)
+	if status, err := checkEmbeddings(runner); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	res := &types.OpenAIEmbeddings_Response{
+		Object: "list",
+		Data:   make([]types.OpenAIEmbedding, len(req.Input)),
+		Model:  req.Model,
+	}
+	tokens := make([]int, len(req.Input))
+	errs := make([]error, len(req.Input))
+	sem := make(chan struct{}, max(runner.Config.ParallelSlots, 1))
+	var wg sync.WaitGroup
+	for i, input := range req.Input {
+		//taken before spawning, so there are never more goroutines than slots
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, input string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			emb := &types.Embedding_Response{}
+			if errs[i] = callRunner(r.Context(), runner, "/embedding", types.Embedding_Request{Content: input}, emb); errs[i] != nil {
+				return
+			}
+			res.Data[i] = types.OpenAIEmbedding{Object: "embedding", Index: i, Embedding: emb.Embedding}
+			toks, err := tokenize(r.Context(), runner, input)
+			errs[i] = err
+			tokens[i] = len(toks)
+		}(i, input)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			http.Error(w, fmt.Sprintf("input %d: %v", i, err), http.StatusBadGateway)
+			return
+		}
+		res.Usage.PromptTokens += tokens[i]
+	}
+	res.Usage.TotalTokens = res.Usage.PromptTokens
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(BackendHeader, runner.Config.ModelName)
+	json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,256 @@
+package chatterbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type EventType string
+
+const (
+	// Model state transitions
+	EventModelLoading  EventType = "model.loading"
+	EventModelReady    EventType = "model.ready"
+	EventModelUnloaded EventType = "model.unloaded"
+	EventModelReloaded EventType = "model.reloaded" //traffic switched to the replicas of a new konfig
+
+	// Runner lifecycle
+	EventRunnerCrashed   EventType = "runner.crashed"
+	EventRunnerStopped   EventType = "runner.stopped"
+	EventRunnerRestarted EventType = "runner.restarted"
+
+	// Downloads
+	EventDownloadStarted   EventType = "download.started"
+	EventDownloadProgress  EventType = "download.progress"
+	EventDownloadCompleted EventType = "download.completed"
+	EventDownloadFailed    EventType = "download.failed"
+
+	// Konfig CRUD through the API
+	EventKonfigSaved   EventType = "konfig.saved"
+	EventKonfigDeleted EventType = "konfig.deleted"
+
+	// Alias and routing rule CRUD
+	EventRouteSaved   EventType = "route.saved"
+	EventRouteDeleted EventType = "route.deleted"
+
+	// Grammar registry CRUD, the data is the grammar name
+	EventGrammarSaved   EventType = "grammar.saved"
+	EventGrammarDeleted EventType = "grammar.deleted"
+
+	// Remote workers joining and leaving the coordinator
+	EventWorkerRegistered EventType = "worker.registered"
+	EventWorkerRemoved    EventType = "worker.removed"
+
+	// Changes of the model directory seen by the catalog
+	EventCatalogWeightsAdded    EventType = "catalog.weights.added"
+	EventCatalogWeightsRemoved  EventType = "catalog.weights.removed"
+	EventCatalogWeightsModified EventType = "catalog.weights.modified"
+	EventCatalogKonfigAdded     EventType = "catalog.konfig.added"
+	EventCatalogKonfigRemoved   EventType = "catalog.konfig.removed"
+	EventCatalogKonfigModified  EventType = "catalog.konfig.modified"
+	EventCatalogKonfigInvalid   EventType = "catalog.konfig.invalid"
+)
+
+type Event struct {
+	Type EventType   `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type ModelEvent struct {
+	Model    string `json:"model"`
+	Port     int    `json:"port,omitempty"`
+	Ports    []int  `json:"ports,omitempty"`    //all replicas, set on reload
+	Revision int    `json:"revision,omitempty"` //konfig revision, set on reload
+	Error    string `json:"error,omitempty"`
+}
+
+type DownloadEvent struct {
+	URL       string  `json:"url"`
+	File      string  `json:"file"`
+	BytesRead int64   `json:"bytesRead"`
+	Total     int64   `json:"total"`
+	Progress  float64 `json:"progress"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type KonfigEvent struct {
+	Konfig string `json:"konfig"`
+}
+
+// EventBus fans published events out to all current subscribers.
+// Slow subscribers drop events instead of blocking the publisher.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscribers: map[chan Event]struct{}{},
+	}
+}
+
+func (b *EventBus) Publish(eventType EventType, data interface{}) {
+	ev := Event{Type: eventType, Time: time.Now(), Data: data}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all future events and a function
+// to cancel the subscription.
+func (b *EventBus) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch, func() {
+		b.mu.Lock()
+		if _, ok := b.subscribers[ch]; ok {
+			delete(b.subscribers, ch)
+			close(ch)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// eventFilter returns a predicate for the comma separated type prefixes in
+// the "types" query parameter, e.g. ?types=model.,runner.
+func eventFilter(r *http.Request) func(Event) bool {
+	param := r.URL.Query().Get("types")
+	if param == "" {
+		return func(Event) bool { return true }
+	}
+	prefixes := strings.Split(param, ",")
+	return func(ev Event) bool {
+		for _, p := range prefixes {
+			if strings.HasPrefix(string(ev.Type), p) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// checkOrigin lets clients without an Origin header (not browsers), pages
+// served from our own host and the origins in EventOrigins open the events
+// WebSocket, so other web pages can't read the events with the browser of
+// someone who can reach the server.
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range s.EventOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventsHandler streams events as SSE, or over a WebSocket if the client
+// asks for an upgrade.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if websocket.IsWebSocketUpgrade(r) {
+		s.eventsWebSocket(w, r)
+		return
+	}
+
+	// Set headers for SSE
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	events, cancel := s.Events.Subscribe()
+	defer cancel()
+	match := eventFilter(r)
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if !match(ev) {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+}
+
+func (s *Server) eventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{CheckOrigin: s.checkOrigin}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response
+		return
+	}
+	defer conn.Close()
+
+	events, cancel := s.Events.Subscribe()
+	defer cancel()
+	match := eventFilter(r)
+
+	// Read from the connection so close frames are handled
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if !match(ev) {
+				continue
+			}
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		}
+	}
+}
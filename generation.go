@@ -0,0 +1,203 @@
+package chatterbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// applyGenerationDefaults merges the konfig's default prediction parameters
+// and the preset requested with ?preset= under the caller's JSON body.
+// Fields sent by the caller always win, then the preset, then the defaults.
+func applyGenerationDefaults(r *http.Request, config *types.Model_Request) error {
+	preset := r.URL.Query().Get("preset")
+	if config.Defaults == nil && preset == "" {
+		return nil
+	}
+
+	layers := []*types.Prediction_Request{}
+	if preset != "" {
+		p, ok := config.Presets[preset]
+		if !ok {
+			return fmt.Errorf("Unknown preset %q", preset)
+		}
+		layers = append(layers, p)
+	}
+	if config.Defaults != nil {
+		layers = append(layers, config.Defaults)
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return fmt.Errorf("Request body must be a JSON object: %v", err)
+		}
+	}
+
+	for _, layer := range layers {
+		for name, value := range layer.SetFields() {
+			if _, ok := fields[name]; ok {
+				continue
+			}
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			fields[name] = data
+		}
+	}
+
+	body, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
+
+// nPredictCap returns the n_predict limit for a konfig: the lower of the
+// konfig's and the server's caps, 0 if neither sets one.
+func (s *Server) nPredictCap(config *types.Model_Request) int {
+	limit := config.MaxNPredict
+	if s.MaxNPredict > 0 && (limit == 0 || s.MaxNPredict < limit) {
+		limit = s.MaxNPredict
+	}
+	return limit
+}
+
+// validateCompletion decodes the request's body as a completion request and
+// validates it against the caps for config. An unlimited n_predict is
+// replaced with the cap, everything else in the body is left alone.
+func (s *Server) validateCompletion(r *http.Request, config *types.Model_Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	pr := types.NewPredictionRequestWithDefaults()
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, pr); err != nil {
+			return fmt.Errorf("Request body is not a valid completion request: %v", err)
+		}
+	}
+
+	limit := s.nPredictCap(config)
+	if err := pr.Validate(limit); err != nil {
+		return err
+	}
+	if limit > 0 && pr.NPredict < 0 {
+		return setBodyField(r, "n_predict", limit)
+	}
+	return nil
+}
+
+// writeRequestError answers with a 400, carrying the field errors as JSON if
+// err is a *types.ValidationError.
+func writeRequestError(w http.ResponseWriter, err error) {
+	var verr *types.ValidationError
+	if errors.As(err, &verr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(verr)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// affinityPrefixLen is how much of a cache_prompt request's prompt is used to
+// pick its replica.
+const affinityPrefixLen = 256
+
+// requestAffinity extracts the slot, prompt and pinned replica of a request
+// without consuming its body.
+func requestAffinity(r *http.Request) (Affinity, error) {
+	aff := Affinity{Replica: -1, Slot: -1}
+	if pinned := r.Header.Get(ReplicaHeader); pinned != "" {
+		if n, err := strconv.Atoi(pinned); err == nil {
+			aff.Replica = n
+		}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return aff, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if len(bytes.TrimSpace(body)) == 0 {
+		return aff, nil
+	}
+
+	var fields struct {
+		IDSlot      *int        `json:"id_slot"`
+		SlotID      *int        `json:"slot_id"` //before llama.cpp renamed it to id_slot
+		CachePrompt bool        `json:"cache_prompt"`
+		Prompt      interface{} `json:"prompt"`
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return aff, fmt.Errorf("Request body must be a JSON object: %v", err)
+	}
+	if fields.IDSlot == nil && fields.SlotID != nil {
+		fields.IDSlot = fields.SlotID
+		if err := editBody(r, func(f map[string]json.RawMessage) {
+			f["id_slot"] = f["slot_id"]
+			delete(f, "slot_id")
+		}); err != nil {
+			return aff, err
+		}
+	}
+	if fields.IDSlot != nil && *fields.IDSlot >= 0 {
+		aff.Slot = *fields.IDSlot
+	}
+	if fields.CachePrompt {
+		prompt, _ := json.Marshal(fields.Prompt)
+		if len(prompt) > affinityPrefixLen {
+			prompt = prompt[:affinityPrefixLen]
+		}
+		aff.Key = string(prompt)
+	}
+	return aff, nil
+}
+
+// setBodyField sets a top level field of the request's JSON body.
+func setBodyField(r *http.Request, name string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return editBody(r, func(fields map[string]json.RawMessage) {
+		fields[name] = data
+	})
+}
+
+// editBody lets edit change the top level fields of the request's JSON body.
+func editBody(r *http.Request, edit func(fields map[string]json.RawMessage)) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	fields := map[string]json.RawMessage{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return fmt.Errorf("Request body must be a JSON object: %v", err)
+		}
+	}
+	edit(fields)
+	body, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return nil
+}
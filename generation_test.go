@@ -0,0 +1,92 @@
+package chatterbox
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+func Test_ApplyGenerationDefaults(t *testing.T) {
+	config := types.NewModelRequestWithDefaults()
+	err := json.Unmarshal([]byte(`{
+		"model": "m.gguf",
+		"defaults": {"temperature": 0.2, "top_k": 10, "n_predict": 50},
+		"presets": {
+			"greedy": {"temperature": 0, "top_k": 0},
+			"creative": {"temperature": 1.5, "n_predict": 200},
+			"standard": {"temperature": 0.8}
+		}
+	}`), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		preset string
+		body   string
+		want   map[string]interface{}
+	}{
+		{"defaults", "", `{"prompt":"hi"}`,
+			map[string]interface{}{"prompt": "hi", "temperature": 0.2, "top_k": 10.0, "n_predict": 50.0}},
+		{"empty body", "", ``,
+			map[string]interface{}{"temperature": 0.2, "top_k": 10.0, "n_predict": 50.0}},
+		{"zero preset", "greedy", `{"prompt":"hi"}`,
+			map[string]interface{}{"prompt": "hi", "temperature": 0.0, "top_k": 0.0, "n_predict": 50.0}},
+		{"preset over defaults", "creative", `{}`,
+			map[string]interface{}{"temperature": 1.5, "top_k": 10.0, "n_predict": 200.0}},
+		{"request over preset", "creative", `{"temperature":0.7,"n_predict":0}`,
+			map[string]interface{}{"temperature": 0.7, "top_k": 10.0, "n_predict": 0.0}},
+		{"preset repeating the built-in default", "standard", `{"prompt":"hi"}`,
+			map[string]interface{}{"prompt": "hi", "temperature": 0.8, "top_k": 10.0, "n_predict": 50.0}},
+		{"request repeating the built-in default", "", `{"temperature":0.8,"top_k":40}`,
+			map[string]interface{}{"temperature": 0.8, "top_k": 40.0, "n_predict": 50.0}},
+	} {
+		target := "/api/v1/m/completion"
+		if tc.preset != "" {
+			target += "?preset=" + tc.preset
+		}
+		r := httptest.NewRequest("POST", target, strings.NewReader(tc.body))
+		if err := applyGenerationDefaults(r, config); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		//float32 defaults come out as e.g. 0.20000000298023224
+		for name, value := range got {
+			if f, ok := value.(float64); ok {
+				got[name] = float64(float32(f))
+			}
+		}
+		for name, value := range tc.want {
+			if f, ok := value.(float64); ok {
+				tc.want[name] = float64(float32(f))
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/m/completion?preset=nope", strings.NewReader(`{}`))
+	if err := applyGenerationDefaults(r, config); err == nil || !strings.Contains(err.Error(), "Unknown preset") {
+		t.Errorf("unknown preset: %v", err)
+	}
+
+	//without defaults the body is left alone
+	plain := types.NewModelRequestWithDefaults()
+	r = httptest.NewRequest("POST", "/api/v1/m/completion", strings.NewReader(`{"prompt":"hi"}`))
+	if err := applyGenerationDefaults(r, plain); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != `{"prompt":"hi"}` {
+		t.Errorf("body rewritten to %s", body)
+	}
+}
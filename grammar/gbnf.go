@@ -0,0 +1,335 @@
+// Package grammar works with GBNF, the grammar format llama.cpp uses to
+// constrain generation.
+package grammar
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SyntaxError points at the first problem found in a grammar.
+type SyntaxError struct {
+	Line int //1-based
+	Col  int //1-based, in bytes
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Col, e.Msg)
+}
+
+// Check parses src the way llama.cpp's grammar parser does and reports
+// syntax errors, rules that are referenced but never defined and a missing
+// root rule.
+func Check(src string) error {
+	p := &parser{src: src}
+	if err := p.parse(); err != nil {
+		return err
+	}
+	if _, ok := p.defined["root"]; !ok {
+		return &SyntaxError{Line: 1, Col: 1, Msg: "grammar does not contain a root rule"}
+	}
+	undefined := []string{}
+	for name := range p.referenced {
+		if _, ok := p.defined[name]; !ok {
+			undefined = append(undefined, name)
+		}
+	}
+	if len(undefined) > 0 {
+		sort.Strings(undefined)
+		name := undefined[0]
+		line, col := p.position(p.referenced[name])
+		return &SyntaxError{Line: line, Col: col, Msg: fmt.Sprintf("undefined rule %q", name)}
+	}
+	return nil
+}
+
+type parser struct {
+	src        string
+	pos        int
+	defined    map[string]int //rule name => offset of its last definition
+	referenced map[string]int //rule name => offset of its first use
+}
+
+func (p *parser) position(offset int) (int, int) {
+	line := 1 + strings.Count(p.src[:offset], "\n")
+	col := offset - strings.LastIndex(p.src[:offset], "\n")
+	return line, col
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	line, col := p.position(p.pos)
+	return &SyntaxError{Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *parser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// space skips blanks and comments, and newlines if newlineOK is set.
+func (p *parser) space(newlineOK bool) {
+	for !p.eof() {
+		c := p.peek()
+		switch {
+		case c == ' ' || c == '\t':
+			p.pos++
+		case c == '#':
+			for !p.eof() && p.peek() != '\r' && p.peek() != '\n' {
+				p.pos++
+			}
+		case newlineOK && (c == '\r' || c == '\n'):
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-'
+}
+
+func (p *parser) name() (string, error) {
+	start := p.pos
+	for !p.eof() && isWordChar(p.peek()) {
+		p.pos++
+	}
+	if start == p.pos {
+		return "", p.errorf("expecting name")
+	}
+	return p.src[start:p.pos], nil
+}
+
+func (p *parser) parse() error {
+	p.defined = map[string]int{}
+	p.referenced = map[string]int{}
+	p.space(true)
+	for !p.eof() {
+		if err := p.rule(); err != nil {
+			return err
+		}
+		p.space(true)
+	}
+	return nil
+}
+
+func (p *parser) rule() error {
+	start := p.pos
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	//like llama.cpp, a later definition of a rule replaces the earlier one
+	p.defined[name] = start
+	p.space(false)
+	if !strings.HasPrefix(p.src[p.pos:], "::=") {
+		return p.errorf("expecting ::=")
+	}
+	p.pos += 3
+	p.space(true)
+	if err := p.alternates(false); err != nil {
+		return err
+	}
+	if !p.eof() && p.peek() != '\r' && p.peek() != '\n' {
+		return p.errorf("expecting newline or end, got %q", p.peek())
+	}
+	return nil
+}
+
+func (p *parser) alternates(nested bool) error {
+	if err := p.sequence(nested); err != nil {
+		return err
+	}
+	for p.peek() == '|' {
+		p.pos++
+		p.space(true)
+		if err := p.sequence(nested); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sequence parses elements until the end of the alternative. An empty
+// sequence is allowed, e.g. ( "a" | ).
+func (p *parser) sequence(nested bool) error {
+	last := false //whether there is an element a repetition can apply to
+	for !p.eof() {
+		c := p.peek()
+		switch {
+		case c == '"':
+			p.pos++
+			if err := p.literal(); err != nil {
+				return err
+			}
+			last = true
+		case c == '[':
+			p.pos++
+			if err := p.charClass(); err != nil {
+				return err
+			}
+			last = true
+		case c == '.':
+			p.pos++
+			last = true
+		case isWordChar(c):
+			start := p.pos
+			name, _ := p.name()
+			if _, ok := p.referenced[name]; !ok {
+				p.referenced[name] = start
+			}
+			last = true
+		case c == '(':
+			p.pos++
+			p.space(true)
+			if err := p.alternates(true); err != nil {
+				return err
+			}
+			if p.peek() != ')' {
+				return p.errorf("expecting ')'")
+			}
+			p.pos++
+			last = true
+		case c == '*' || c == '+' || c == '?' || c == '{':
+			if !last {
+				return p.errorf("expecting preceding item to %q", c)
+			}
+			if c == '{' {
+				if err := p.repetition(); err != nil {
+					return err
+				}
+			} else {
+				p.pos++
+			}
+			last = false
+		default:
+			return nil
+		}
+		p.space(nested)
+	}
+	return nil
+}
+
+// literal parses the rest of a "..." string.
+func (p *parser) literal() error {
+	for {
+		if p.eof() {
+			return p.errorf("unexpected end of input in string")
+		}
+		c := p.peek()
+		if c == '"' {
+			p.pos++
+			return nil
+		}
+		if err := p.char(); err != nil {
+			return err
+		}
+	}
+}
+
+// charClass parses the rest of a [...] class.
+func (p *parser) charClass() error {
+	if p.peek() == '^' {
+		p.pos++
+	}
+	for {
+		if p.eof() {
+			return p.errorf("unexpected end of input in character class")
+		}
+		if p.peek() == ']' {
+			p.pos++
+			return nil
+		}
+		if err := p.char(); err != nil {
+			return err
+		}
+		if p.peek() == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] != ']' {
+			p.pos++
+			if p.eof() {
+				return p.errorf("unexpected end of input in character range")
+			}
+			if err := p.char(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// char parses one possibly escaped character.
+func (p *parser) char() error {
+	if p.peek() != '\\' {
+		p.pos++
+		return nil
+	}
+	p.pos++
+	if p.eof() {
+		return p.errorf("unexpected end of input in escape sequence")
+	}
+	digits := 0
+	switch p.peek() {
+	case 'x':
+		digits = 2
+	case 'u':
+		digits = 4
+	case 'U':
+		digits = 8
+	case 't', 'r', 'n', '\\', '"', '[', ']', '-', '^':
+		p.pos++
+		return nil
+	default:
+		return p.errorf("unknown escape \\%c", p.peek())
+	}
+	p.pos++
+	for i := 0; i < digits; i++ {
+		if p.eof() || !strings.ContainsRune("0123456789abcdefABCDEF", rune(p.peek())) {
+			return p.errorf("expecting %d hex digits", digits)
+		}
+		p.pos++
+	}
+	return nil
+}
+
+// repetition parses {n}, {n,} or {n,m}.
+func (p *parser) repetition() error {
+	p.pos++
+	p.space(false)
+	number := func() (int, bool) {
+		n, start := 0, p.pos
+		for !p.eof() && p.peek() >= '0' && p.peek() <= '9' {
+			n = n*10 + int(p.peek()-'0')
+			p.pos++
+		}
+		return n, p.pos > start
+	}
+	min, ok := number()
+	if !ok {
+		return p.errorf("expecting number")
+	}
+	p.space(false)
+	max := min
+	if p.peek() == ',' {
+		p.pos++
+		p.space(false)
+		max, ok = number()
+		if !ok {
+			max = -1
+		}
+		p.space(false)
+	}
+	if p.peek() != '}' {
+		return p.errorf("expecting '}'")
+	}
+	p.pos++
+	if max >= 0 && max < min {
+		return p.errorf("repetition maximum %d is below minimum %d", max, min)
+	}
+	return nil
+}
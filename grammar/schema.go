@@ -0,0 +1,612 @@
+package grammar
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Schema is the subset of JSON Schema that can be turned into a grammar.
+// Annotations like title and description are ignored, keywords that change
+// what is valid but aren't supported are rejected by ParseSchema.
+type Schema struct {
+	Any     bool //true or {}, any JSON value
+	Nothing bool //false, no value at all
+
+	Type       []string
+	Properties []Property //in document order, which the grammar keeps
+	Required   []string
+	Additional *Schema //additionalProperties, only checked by Validate
+	Items      *Schema
+	MinItems   *int
+	MaxItems   *int
+	MinLength  *int
+	MaxLength  *int
+	Pattern    string
+
+	Minimum          *float64
+	Maximum          *float64
+	ExclusiveMinimum *float64
+	ExclusiveMaximum *float64
+
+	Enum  []json.RawMessage
+	Const json.RawMessage
+	AnyOf []*Schema
+	OneOf []*Schema
+	Ref   string
+	Defs  map[string]*Schema //$defs and definitions
+}
+
+type Property struct {
+	Name   string
+	Schema *Schema
+}
+
+// unsupported lists keywords whose meaning would be lost.
+var unsupported = []string{"allOf", "not", "if", "then", "else", "patternProperties", "dependentSchemas", "prefixItems", "contains"}
+
+// ParseSchema reads a JSON Schema.
+func ParseSchema(data []byte) (*Schema, error) {
+	s := &Schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	switch string(bytes.TrimSpace(data)) {
+	case "true":
+		*s = Schema{Any: true}
+		return nil
+	case "false":
+		*s = Schema{Nothing: true}
+		return nil
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("schema must be an object or a boolean: %v", err)
+	}
+	for _, k := range unsupported {
+		if _, ok := raw[k]; ok {
+			return fmt.Errorf("schema keyword %q is not supported", k)
+		}
+	}
+
+	var fields struct {
+		Type                 json.RawMessage    `json:"type"`
+		Required             []string           `json:"required"`
+		AdditionalProperties *Schema            `json:"additionalProperties"`
+		Items                *Schema            `json:"items"`
+		MinItems             *int               `json:"minItems"`
+		MaxItems             *int               `json:"maxItems"`
+		MinLength            *int               `json:"minLength"`
+		MaxLength            *int               `json:"maxLength"`
+		Pattern              string             `json:"pattern"`
+		Minimum              *float64           `json:"minimum"`
+		Maximum              *float64           `json:"maximum"`
+		ExclusiveMinimum     *float64           `json:"exclusiveMinimum"`
+		ExclusiveMaximum     *float64           `json:"exclusiveMaximum"`
+		Enum                 []json.RawMessage  `json:"enum"`
+		Const                json.RawMessage    `json:"const"`
+		AnyOf                []*Schema          `json:"anyOf"`
+		OneOf                []*Schema          `json:"oneOf"`
+		Ref                  string             `json:"$ref"`
+		Defs                 map[string]*Schema `json:"$defs"`
+		Definitions          map[string]*Schema `json:"definitions"`
+		Properties           map[string]*Schema `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*s = Schema{
+		Required:         fields.Required,
+		Additional:       fields.AdditionalProperties,
+		Items:            fields.Items,
+		MinItems:         fields.MinItems,
+		MaxItems:         fields.MaxItems,
+		MinLength:        fields.MinLength,
+		MaxLength:        fields.MaxLength,
+		Pattern:          fields.Pattern,
+		Minimum:          fields.Minimum,
+		Maximum:          fields.Maximum,
+		ExclusiveMinimum: fields.ExclusiveMinimum,
+		ExclusiveMaximum: fields.ExclusiveMaximum,
+		Enum:             fields.Enum,
+		Const:            fields.Const,
+		AnyOf:            fields.AnyOf,
+		OneOf:            fields.OneOf,
+		Ref:              fields.Ref,
+		Defs:             fields.Defs,
+	}
+	for name, def := range fields.Definitions {
+		if s.Defs == nil {
+			s.Defs = map[string]*Schema{}
+		}
+		s.Defs[name] = def
+	}
+
+	if len(fields.Type) > 0 {
+		var one string
+		if err := json.Unmarshal(fields.Type, &one); err == nil {
+			s.Type = []string{one}
+		} else if err := json.Unmarshal(fields.Type, &s.Type); err != nil {
+			return fmt.Errorf("type must be a string or a list of strings, got %s", fields.Type)
+		}
+		for _, t := range s.Type {
+			switch t {
+			case "object", "array", "string", "number", "integer", "boolean", "null":
+			default:
+				return fmt.Errorf("unknown type %q", t)
+			}
+		}
+	}
+
+	if props, ok := raw["properties"]; ok {
+		names, err := objectKeys(props)
+		if err != nil {
+			return fmt.Errorf("properties: %v", err)
+		}
+		for _, name := range names {
+			s.Properties = append(s.Properties, Property{Name: name, Schema: fields.Properties[name]})
+		}
+	}
+	return nil
+}
+
+// objectKeys returns the keys of a JSON object in document order.
+func objectKeys(data []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("must be an object")
+	}
+	keys := []string{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, tok.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// resolve returns the schema a $ref of root points at. Only references into
+// the root's $defs or definitions, and to the root itself, are supported.
+func (root *Schema) resolve(ref string) (string, *Schema, error) {
+	if ref == "#" {
+		return "root", root, nil
+	}
+	for _, prefix := range []string{"#/$defs/", "#/definitions/"} {
+		if name, ok := strings.CutPrefix(ref, prefix); ok {
+			if def, ok := root.Defs[name]; ok && def != nil {
+				return name, def, nil
+			}
+		}
+	}
+	return "", nil, fmt.Errorf("unresolvable $ref %q", ref)
+}
+
+// primitives are the rules shared by all generated grammars, added to a
+// grammar when used.
+var primitives = map[string]string{
+	"space":   `" "?`,
+	"char":    `[^"\\\x7F\x00-\x1F] | "\\" (["\\/bfnrt] | "u" [0-9a-fA-F]{4})`,
+	"string":  `"\"" char* "\"" space`,
+	"number":  `"-"? ("0" | [1-9] [0-9]*) ("." [0-9]+)? ([eE] [-+]? [0-9]+)? space`,
+	"integer": `"-"? ("0" | [1-9] [0-9]*) space`,
+	"boolean": `("true" | "false") space`,
+	"null":    `"null" space`,
+	"value":   `object | array | string | number | boolean | null`,
+	"object":  `"{" space (string ":" space value ("," space string ":" space value)*)? "}" space`,
+	"array":   `"[" space (value ("," space value)*)? "]" space`,
+}
+
+// primitiveDeps lists the primitives each primitive refers to.
+var primitiveDeps = map[string][]string{
+	"string":  {"char", "space"},
+	"number":  {"space"},
+	"integer": {"space"},
+	"boolean": {"space"},
+	"null":    {"space"},
+	"value":   {"object", "array", "string", "number", "boolean", "null"},
+	"object":  {"space", "string", "value"},
+	"array":   {"space", "value"},
+}
+
+type converter struct {
+	root   *Schema
+	prefix string //name of the rule matching root
+	rules  map[string]string
+	order  []string          //generated rules in the order they were added
+	refs   map[string]string //$ref => rule name
+}
+
+// Grammar converts the schema to GBNF that only allows JSON documents
+// matching it. Properties are generated in the order of the schema, and no
+// properties beyond the declared ones. Keywords a grammar can't express
+// sensibly, like pattern and numeric bounds, are only checked by Validate.
+func (s *Schema) Grammar() (string, error) {
+	g, err := s.Rules("root")
+	if err != nil {
+		return "", err
+	}
+	if err := Check(g); err != nil {
+		return "", fmt.Errorf("generated grammar is invalid: %v", err)
+	}
+	return g, nil
+}
+
+// Rules converts the schema like Grammar, but calls the rule matching the
+// whole schema name instead of root and prefixes the rules of its
+// definitions with name. With Join, this embeds schemas in larger grammars.
+func (s *Schema) Rules(name string) (string, error) {
+	c := &converter{root: s, prefix: name, rules: map[string]string{}, refs: map[string]string{"#": name}}
+	c.rules[name] = "" //reserved for recursive references
+	c.order = append(c.order, name)
+	body, err := c.body(s, name)
+	if err != nil {
+		return "", err
+	}
+	c.rules[name] = body
+
+	out := &strings.Builder{}
+	for _, rule := range c.order {
+		fmt.Fprintf(out, "%s ::= %s\n", rule, c.rules[rule])
+	}
+	return out.String(), nil
+}
+
+// Join concatenates grammars made of one rule per line, as Rules generates
+// them. Rules defined identically in several grammars, like the shared space
+// and string rules, are kept once; rules defined differently are an error.
+func Join(grammars ...string) (string, error) {
+	out := &strings.Builder{}
+	seen := map[string]string{}
+	for _, g := range grammars {
+		for _, line := range strings.Split(g, "\n") {
+			name, _, ok := strings.Cut(line, " ::= ")
+			if !ok {
+				if strings.TrimSpace(line) != "" {
+					out.WriteString(line + "\n")
+				}
+				continue
+			}
+			if prev, dup := seen[name]; dup {
+				if prev != line {
+					return "", fmt.Errorf("rule %q is defined differently in two grammars", name)
+				}
+				continue
+			}
+			seen[name] = line
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.String(), nil
+}
+
+// use adds a primitive and the primitives it depends on.
+func (c *converter) use(name string) string {
+	if _, ok := c.rules[name]; ok {
+		return name
+	}
+	c.rules[name] = primitives[name]
+	c.order = append(c.order, name)
+	for _, dep := range primitiveDeps[name] {
+		c.use(dep)
+	}
+	return name
+}
+
+// add adds a rule under a unique name derived from hint.
+func (c *converter) add(hint, body string) string {
+	name := c.unique(hint)
+	c.rules[name] = body
+	c.order = append(c.order, name)
+	return name
+}
+
+func (c *converter) unique(hint string) string {
+	name := strings.Map(func(r rune) rune {
+		if r < 128 && isWordChar(byte(r)) {
+			return r
+		}
+		return '-'
+	}, hint)
+	if name == "" {
+		name = "rule"
+	}
+	candidate := name
+	for i := 2; ; i++ {
+		_, taken := c.rules[candidate]
+		_, primitive := primitives[candidate]
+		if !taken && !primitive {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// rule returns a single rule name matching s, adding rules as needed.
+func (c *converter) rule(s *Schema, hint string) (string, error) {
+	if s == nil || s.Any {
+		return c.use("value"), nil
+	}
+	if s.Ref != "" {
+		return c.ref(s.Ref)
+	}
+	if len(s.Type) == 1 && len(s.Enum) == 0 && s.Const == nil {
+		switch t := s.Type[0]; {
+		case t == "number" || t == "integer" || t == "boolean" || t == "null":
+			return c.use(t), nil
+		case t == "string" && s.MinLength == nil && s.MaxLength == nil:
+			return c.use("string"), nil
+		case t == "object" && len(s.Properties) == 0:
+			return c.use("object"), nil
+		case t == "array" && s.Items == nil && s.MinItems == nil && s.MaxItems == nil:
+			return c.use("array"), nil
+		}
+	}
+	name := c.unique(hint)
+	c.rules[name] = "" //reserve the name while the body is built
+	c.order = append(c.order, name)
+	body, err := c.body(s, name)
+	if err != nil {
+		return "", err
+	}
+	c.rules[name] = body
+	return name, nil
+}
+
+func (c *converter) ref(ref string) (string, error) {
+	if name, ok := c.refs[ref]; ok {
+		return name, nil
+	}
+	hint, def, err := c.root.resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	name := c.unique(c.prefix + "-" + hint)
+	c.refs[ref] = name
+	c.rules[name] = ""
+	c.order = append(c.order, name)
+	body, err := c.body(def, name)
+	if err != nil {
+		return "", err
+	}
+	c.rules[name] = body
+	return name, nil
+}
+
+// body returns the right hand side of a rule matching s.
+func (c *converter) body(s *Schema, name string) (string, error) {
+	switch {
+	case s.Nothing:
+		return "", fmt.Errorf("%s: the schema false matches nothing", name)
+	case s.Any:
+		return c.use("value"), nil
+	case s.Ref != "":
+		return c.ref(s.Ref)
+	case s.Const != nil:
+		return jsonLiteral(s.Const) + " " + c.use("space"), nil
+	case len(s.Enum) > 0:
+		alts := make([]string, len(s.Enum))
+		for i, v := range s.Enum {
+			alts[i] = jsonLiteral(v)
+		}
+		return "(" + strings.Join(alts, " | ") + ") " + c.use("space"), nil
+	case len(s.AnyOf) > 0 || len(s.OneOf) > 0:
+		alts := []string{}
+		for i, sub := range append(append([]*Schema{}, s.AnyOf...), s.OneOf...) {
+			r, err := c.rule(sub, fmt.Sprintf("%s-%d", name, i))
+			if err != nil {
+				return "", err
+			}
+			alts = append(alts, r)
+		}
+		return strings.Join(alts, " | "), nil
+	}
+
+	types := s.Type
+	if len(types) == 0 {
+		switch {
+		case len(s.Properties) > 0:
+			types = []string{"object"}
+		case s.Items != nil:
+			types = []string{"array"}
+		default:
+			return c.use("value"), nil
+		}
+	}
+	alts := []string{}
+	for _, t := range types {
+		alt, err := c.typed(s, t, name)
+		if err != nil {
+			return "", err
+		}
+		alts = append(alts, alt)
+	}
+	if len(alts) == 1 {
+		return alts[0], nil
+	}
+	return "(" + strings.Join(alts, ") | (") + ")", nil
+}
+
+// typed returns a sequence matching s restricted to type t.
+func (c *converter) typed(s *Schema, t, name string) (string, error) {
+	switch t {
+	case "object":
+		return c.object(s, name)
+	case "array":
+		if s.Items == nil && s.MinItems == nil && s.MaxItems == nil {
+			return c.use("array"), nil
+		}
+		item, err := c.rule(s.Items, name+"-item")
+		if err != nil {
+			return "", err
+		}
+		c.use("space")
+		min, max := bounds(s.MinItems, s.MaxItems)
+		list := item
+		if max != 1 {
+			more := max - 1
+			if max < 0 {
+				more = -1
+			}
+			list += ` ("," space ` + item + ")" + repetition(0, more)
+			if min > 1 {
+				list = item + ` ("," space ` + item + ")" + repetition(min-1, more)
+			}
+		}
+		switch {
+		case max == 0:
+			list = ""
+		case min == 0:
+			list = "(" + list + ")?"
+		}
+		return `"[" space ` + list + ` "]" space`, nil
+	case "string":
+		if s.MinLength == nil && s.MaxLength == nil {
+			return c.use("string"), nil
+		}
+		c.use("string")
+		min, max := bounds(s.MinLength, s.MaxLength)
+		return `"\"" char` + repetition(min, max) + ` "\"" space`, nil
+	default:
+		return c.use(t), nil
+	}
+}
+
+// object returns a sequence matching an object with the declared properties,
+// required ones always and optional ones in order.
+func (c *converter) object(s *Schema, name string) (string, error) {
+	if len(s.Properties) == 0 {
+		return c.use("object"), nil
+	}
+	c.use("space")
+	required := map[string]bool{}
+	for _, r := range s.Required {
+		required[r] = true
+	}
+	var must, may []string
+	for _, p := range s.Properties {
+		value, err := c.rule(p.Schema, name+"-"+p.Name)
+		if err != nil {
+			return "", err
+		}
+		key, _ := json.Marshal(p.Name)
+		kv := jsonLiteral(key) + ` space ":" space ` + value
+		if required[p.Name] {
+			must = append(must, kv)
+		} else {
+			may = append(may, kv)
+		}
+	}
+	for _, r := range s.Required {
+		if !s.hasProperty(r) {
+			return "", fmt.Errorf("%s: required property %q is not declared", name, r)
+		}
+	}
+
+	optional := func(kvs []string) string {
+		out := ""
+		for _, kv := range kvs {
+			out += ` ("," space ` + kv + ")?"
+		}
+		return out
+	}
+	var members string
+	if len(must) > 0 {
+		members = strings.Join(must, ` "," space `) + optional(may)
+	} else {
+		//any optional property may come first
+		alts := make([]string, len(may))
+		for i, kv := range may {
+			alts[i] = kv + optional(may[i+1:])
+		}
+		members = "(" + strings.Join(alts, " | ") + ")?"
+	}
+	return `"{" space ` + members + ` "}" space`, nil
+}
+
+func (s *Schema) hasProperty(name string) bool {
+	for _, p := range s.Properties {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bounds returns the minimum and maximum count, -1 for no maximum.
+func bounds(min, max *int) (int, int) {
+	lo, hi := 0, -1
+	if min != nil && *min > 0 {
+		lo = *min
+	}
+	if max != nil && *max >= 0 {
+		hi = *max
+	}
+	return lo, hi
+}
+
+// repetition returns the GBNF suffix repeating an item min to max times,
+// max -1 for unbounded.
+func repetition(min, max int) string {
+	switch {
+	case min == 0 && max < 0:
+		return "*"
+	case min == 1 && max < 0:
+		return "+"
+	case min == 0 && max == 1:
+		return "?"
+	case max < 0:
+		return fmt.Sprintf("{%d,}", min)
+	case min == max:
+		return fmt.Sprintf("{%d}", min)
+	default:
+		return fmt.Sprintf("{%d,%d}", min, max)
+	}
+}
+
+// jsonLiteral returns a GBNF literal matching the compact form of a JSON
+// value.
+func jsonLiteral(v json.RawMessage) string {
+	compact := &bytes.Buffer{}
+	if err := json.Compact(compact, v); err != nil {
+		compact.Write(v)
+	}
+	return Literal(compact.String())
+}
+
+// Literal quotes s as a GBNF string literal.
+func Literal(s string) string {
+	out := &strings.Builder{}
+	out.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c == '\n':
+			out.WriteString(`\n`)
+		case c == '\r':
+			out.WriteString(`\r`)
+		case c == '\t':
+			out.WriteString(`\t`)
+		case c < 0x20 || c == 0x7F:
+			fmt.Fprintf(out, `\x%02X`, c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	out.WriteByte('"')
+	return out.String()
+}
@@ -0,0 +1,42 @@
+package grammar
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_SchemaGrammar(t *testing.T) {
+	s, err := ParseSchema([]byte(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "maxLength": 8},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "minItems": 1},
+			"next": {"$ref": "#"}
+		},
+		"required": ["name"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := s.Grammar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`root ::= "{" space "\"name\"" space ":" space root-name ("," space "\"tags\"" space ":" space root-tags)? ("," space "\"next\"" space ":" space root)? "}" space`,
+		`root-name ::= "\"" char{0,8} "\"" space`,
+		`root-tags ::= "[" space root-tags-item ("," space root-tags-item)* "]" space`,
+		`root-tags-item ::= ("\"a\"" | "\"b\"") space`,
+	} {
+		if !strings.Contains(g, want+"\n") {
+			t.Errorf("grammar lacks %s:\n%s", want, g)
+		}
+	}
+
+	if err := s.Validate([]byte(`{"name":"bob","next":{"name":"alice","tags":["a"]}}`)); err != nil {
+		t.Errorf("valid document rejected: %v", err)
+	}
+	if err := s.Validate([]byte(`{"name":"bob","next":{"tags":[]}}`)); err == nil || !strings.HasPrefix(err.Error(), "/next:") {
+		t.Errorf("expected an error for /next, got %v", err)
+	}
+}
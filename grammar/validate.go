@@ -0,0 +1,218 @@
+package grammar
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Validate checks that data is a JSON document matching the schema. Unlike
+// the grammar, it also checks pattern, numeric bounds and
+// additionalProperties. The error names the first offending value by its JSON
+// pointer.
+func (s *Schema) Validate(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return fmt.Errorf("not valid JSON: %v", err)
+	}
+	return s.check(s, v, "")
+}
+
+func (s *Schema) check(root *Schema, v interface{}, pointer string) error {
+	fail := func(format string, args ...interface{}) error {
+		at := pointer
+		if at == "" {
+			at = "/"
+		}
+		return fmt.Errorf("%s: %s", at, fmt.Sprintf(format, args...))
+	}
+	switch {
+	case s == nil || s.Any:
+		return nil
+	case s.Nothing:
+		return fail("no value is allowed")
+	case s.Ref != "":
+		_, def, err := root.resolve(s.Ref)
+		if err != nil {
+			return err
+		}
+		return def.check(root, v, pointer)
+	}
+
+	if s.Const != nil && !equalJSON(s.Const, v) {
+		return fail("must be %s", s.Const)
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equalJSON(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("must be one of the enum values")
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var first error
+		for _, sub := range s.AnyOf {
+			err := sub.check(root, v, pointer)
+			if err == nil {
+				first = nil
+				break
+			}
+			if first == nil {
+				first = err
+			}
+		}
+		if first != nil {
+			return fail("matches none of anyOf: %v", first)
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if sub.check(root, v, pointer) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("must match exactly one of oneOf, matches %d", matches)
+		}
+	}
+
+	if len(s.Type) > 0 {
+		ok := false
+		for _, t := range s.Type {
+			if hasType(v, t) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fail("must be of type %v", s.Type)
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, r := range s.Required {
+			if _, ok := v[r]; !ok {
+				return fail("required property %q is missing", r)
+			}
+		}
+		for name, value := range v {
+			sub := pointer + "/" + escapePointer(name)
+			if p := s.property(name); p != nil {
+				if err := p.check(root, value, sub); err != nil {
+					return err
+				}
+			} else if s.Additional != nil {
+				if err := s.Additional.check(root, value, sub); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fail("must have at least %d items, has %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail("must have at most %d items, has %d", *s.MaxItems, len(v))
+		}
+		for i, item := range v {
+			if err := s.Items.check(root, item, pointer+"/"+strconv.Itoa(i)); err != nil {
+				return err
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail("must be at least %d characters long", *s.MinLength)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail("must be at most %d characters long", *s.MaxLength)
+		}
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return fail("invalid pattern %q: %v", s.Pattern, err)
+			}
+			if !re.MatchString(v) {
+				return fail("must match %q", s.Pattern)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fail("must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fail("must be at most %v", *s.Maximum)
+		}
+		if s.ExclusiveMinimum != nil && v <= *s.ExclusiveMinimum {
+			return fail("must be greater than %v", *s.ExclusiveMinimum)
+		}
+		if s.ExclusiveMaximum != nil && v >= *s.ExclusiveMaximum {
+			return fail("must be less than %v", *s.ExclusiveMaximum)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) property(name string) *Schema {
+	for _, p := range s.Properties {
+		if p.Name == name {
+			if p.Schema == nil {
+				return &Schema{Any: true}
+			}
+			return p.Schema
+		}
+	}
+	return nil
+}
+
+func hasType(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return t == "object"
+	case []interface{}:
+		return t == "array"
+	case string:
+		return t == "string"
+	case float64:
+		return t == "number" || t == "integer" && v == math.Trunc(v)
+	case bool:
+		return t == "boolean"
+	case nil:
+		return t == "null"
+	}
+	return false
+}
+
+func equalJSON(raw json.RawMessage, v interface{}) bool {
+	var want interface{}
+	if err := json.Unmarshal(raw, &want); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(want, v)
+}
+
+func escapePointer(key string) string {
+	out := []byte{}
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '~':
+			out = append(out, "~0"...)
+		case '/':
+			out = append(out, "~1"...)
+		default:
+			out = append(out, key[i])
+		}
+	}
+	return string(out)
+}
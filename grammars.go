@@ -0,0 +1,242 @@
+package chatterbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/grammar"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+func (s *Server) getGrammarsHandler(w http.ResponseWriter, r *http.Request) {
+	names, err := types.ListGrammars(s.grammarsPath)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(names)
+}
+
+func (s *Server) getGrammarHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the grammar name from the path
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	g, err := types.LoadGrammar(s.grammarsPath, name)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Grammar not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(g)
+}
+
+// saveGrammarHandler stores a grammar, or the grammar converted from a JSON
+// Schema, after checking its syntax.
+func (s *Server) saveGrammarHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the grammar name from the path
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	req := &types.Grammar_Request{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g := &types.Grammar{Name: name, Grammar: req.Grammar}
+	switch {
+	case req.Grammar != "" && len(req.Schema) > 0:
+		http.Error(w, "Only one of grammar and schema may be set", http.StatusBadRequest)
+		return
+	case len(req.Schema) > 0:
+		schema, err := grammar.ParseSchema(req.Schema)
+		if err == nil {
+			g.Grammar, err = schema.Grammar()
+		}
+		if err != nil {
+			http.Error(w, "Invalid schema: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		if err := grammar.Check(g.Grammar); err != nil {
+			http.Error(w, "Invalid grammar: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := types.SaveGrammar(s.grammarsPath, g); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Events.Publish(EventGrammarSaved, g.Name)
+	json.NewEncoder(w).Encode(g)
+}
+
+func (s *Server) deleteGrammarHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the grammar name from the path
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	err := types.DeleteGrammar(s.grammarsPath, name)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "Grammar not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Events.Publish(EventGrammarDeleted, name)
+	w.Write([]byte("Grammar deleted"))
+}
+
+// applyGrammar replaces grammar_name and response_format in the request's
+// body with the grammar they stand for. It returns the schema the generated
+// content has to match, nil if there is none. The request must have been
+// validated.
+func (s *Server) applyGrammar(r *http.Request) (*grammar.Schema, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var fields struct {
+		GrammarName    string                `json:"grammar_name"`
+		ResponseFormat *types.ResponseFormat `json:"response_format"`
+	}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return nil, err
+		}
+	}
+
+	gbnf, schema, err := s.resolveGrammar(fields.GrammarName, fields.ResponseFormat)
+	if err != nil || gbnf == "" {
+		return nil, err
+	}
+
+	data, err := json.Marshal(gbnf)
+	if err != nil {
+		return nil, err
+	}
+	return schema, editBody(r, func(f map[string]json.RawMessage) {
+		delete(f, "grammar_name")
+		delete(f, "response_format")
+		f["grammar"] = data
+	})
+}
+
+// resolveGrammar returns the GBNF of the stored grammar name or of the JSON
+// schema of format, with the schema the output must match. Without either it
+// returns "".
+func (s *Server) resolveGrammar(name string, format *types.ResponseFormat) (string, *grammar.Schema, error) {
+	switch {
+	case name != "":
+		g, err := types.LoadGrammar(s.grammarsPath, name)
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil, fmt.Errorf("Unknown grammar %q", name)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		return g.Grammar, nil, nil
+	case format != nil:
+		schema := &grammar.Schema{Type: []string{"object"}}
+		if data := format.SchemaJSON(); len(data) > 0 {
+			var err error
+			if schema, err = grammar.ParseSchema(data); err != nil {
+				return "", nil, err
+			}
+		}
+		gbnf, err := schema.Grammar()
+		if err != nil {
+			return "", nil, err
+		}
+		return gbnf, schema, nil
+	}
+	return "", nil, nil
+}
+
+// schemaCheck returns a response hook validating the generated content
+// against schema. A plain response that doesn't match is replaced by an
+// error, a stream gets an error event after its final event.
+func schemaCheck(schema *grammar.Schema) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			upstream := resp.Body
+			pr, pw := io.Pipe()
+			go func() {
+				defer upstream.Close()
+				pw.CloseWithError(checkStream(schema, upstream, pw))
+			}()
+			resp.Body = pr
+			return nil
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		res := &types.Result{}
+		if err := json.Unmarshal(body, res); err != nil {
+			return fmt.Errorf("Invalid upstream response: %v", err)
+		}
+		if err := schema.Validate([]byte(res.Content)); err != nil {
+			return fmt.Errorf("Response does not match the schema: %v", err)
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return nil
+	}
+}
+
+// checkStream copies a llama.cpp event stream, collecting the content and
+// validating it once the final event has passed.
+func checkStream(schema *grammar.Schema, src io.Reader, dst io.Writer) error {
+	content := &strings.Builder{}
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if _, err := fmt.Fprintln(dst, line); err != nil {
+			return err
+		}
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		var chunk struct {
+			Content string `json:"content"`
+			Stop    bool   `json:"stop"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		content.WriteString(chunk.Content)
+		if !chunk.Stop {
+			continue
+		}
+		if err := schema.Validate([]byte(content.String())); err != nil {
+			msg, _ := json.Marshal(map[string]string{"error": "Response does not match the schema: " + err.Error()})
+			if _, err := fmt.Fprintf(dst, "\ndata: %s\n\n", msg); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
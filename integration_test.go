@@ -0,0 +1,1398 @@
+package chatterbox
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/schnapper79/chatterbox/internal/fakellama"
+	"github.com/schnapper79/chatterbox/types"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// The test binary doubles as the fake llama.cpp server: the runners start it
+// through a symlink named server with fakeLlamaEnv set.
+const fakeLlamaEnv = "CHATTERBOX_FAKE_LLAMA"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeLlamaEnv) == "1" {
+		if err := fakellama.Main(os.Args[1:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Setenv(fakeLlamaEnv, "1")
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	*Server
+	t      *testing.T
+	URL    string
+	events <-chan Event
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	llamaPath := t.TempDir()
+	if err := os.Symlink(exe, filepath.Join(llamaPath, "server")); err != nil {
+		t.Fatal(err)
+	}
+	modelPath := t.TempDir()
+	if err := os.WriteFile(filepath.Join(modelPath, "m.gguf"), []byte("weights"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := types.NewFileStore(filepath.Join(modelPath, "konfigs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(modelPath, llamaPath, "", store)
+	events, cancel := s.Events.Subscribe()
+	ts := httptest.NewServer(s.Router)
+	t.Cleanup(func() {
+		s.mu.RLock()
+		for _, pool := range s.LoadedModels {
+			pool.Stop()
+		}
+		s.mu.RUnlock()
+		ts.Close()
+		cancel()
+		s.Close()
+	})
+	return &testServer{Server: s, t: t, URL: ts.URL, events: events}
+}
+
+// freeTCPPort returns a port nothing listens on right now.
+func freeTCPPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func (ts *testServer) do(method, path, body string) (int, string) {
+	ts.t.Helper()
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// waitEvent waits for an event of type et about model.
+func (ts *testServer) waitEvent(et EventType, model string) Event {
+	ts.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case ev := <-ts.events:
+			if me, ok := ev.Data.(ModelEvent); ev.Type == et && ok && me.Model == model {
+				return ev
+			}
+		case <-timeout:
+			ts.t.Fatalf("no %s event for %s", et, model)
+		}
+	}
+}
+
+func (ts *testServer) load(model string, konfig string) {
+	ts.t.Helper()
+	code, body := ts.do("POST", "/api/v1/"+model+"/load", konfig)
+	if code != http.StatusOK {
+		ts.t.Fatalf("load %s: %d %s", model, code, body)
+	}
+	ts.waitEvent(EventModelReady, model)
+}
+
+func (ts *testServer) loaded() []string {
+	ts.t.Helper()
+	_, body := ts.do("GET", "/api/v1/models/loaded", "")
+	configs := map[string]*types.Model_Request{}
+	if err := json.Unmarshal([]byte(body), &configs); err != nil {
+		ts.t.Fatalf("loaded models: %v: %s", err, body)
+	}
+	names := []string{}
+	for name := range configs {
+		names = append(names, name)
+	}
+	return names
+}
+
+func Test_LoadProxyUnload(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+
+	code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"hello","n_predict":3}`)
+	if code != http.StatusOK {
+		t.Fatalf("completion: %d %s", code, body)
+	}
+	res := types.Result{}
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Content != " tok0 tok1 tok2" || res.Model != "m" || !res.Stop {
+		t.Errorf("unexpected completion %+v", res)
+	}
+
+	code, body = ts.do("POST", "/api/v1/m/completion", `{"prompt":"hello","n_predict":2,"stream":true}`)
+	if code != http.StatusOK {
+		t.Fatalf("streamed completion: %d %s", code, body)
+	}
+	content := ""
+	events := 0
+	for _, line := range strings.Split(body, "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		chunk := types.Result{}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		content += chunk.Content
+		events++
+	}
+	if content != " tok0 tok1" || events != 3 {
+		t.Errorf("unexpected stream %q", body)
+	}
+
+	code, body = ts.do("POST", "/api/v1/m/infill", `{"input_prefix":"a","input_suffix":"b"}`)
+	res = types.Result{}
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || res.Content != "a<fill>b" {
+		t.Errorf("infill: %d %s", code, body)
+	}
+
+	code, body = ts.do("GET", "/api/v1/m/unload", "")
+	if code != http.StatusOK {
+		t.Fatalf("unload: %d %s", code, body)
+	}
+	if names := ts.loaded(); len(names) != 0 {
+		t.Errorf("still loaded after unload: %v", names)
+	}
+	code, _ = ts.do("POST", "/api/v1/m/completion", `{"prompt":"hello"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("completion after unload: got %d", code)
+	}
+}
+
+func Test_LoadRejectsBadKonfig(t *testing.T) {
+	ts := newTestServer(t)
+	code, body := ts.do("POST", "/api/v1/m/load", `{"model":"missing.gguf"}`)
+	if code != http.StatusUnprocessableEntity || !strings.Contains(body, "/model") {
+		t.Errorf("load of missing weights: %d %s", code, body)
+	}
+	if names := ts.loaded(); len(names) != 0 {
+		t.Errorf("loaded after failed load: %v", names)
+	}
+}
+
+func Test_RunnerCrash(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+
+	ts.do("POST", "/api/v1/m/completion", fmt.Sprintf(`{"prompt":%q}`, fakellama.CrashPrompt))
+	ts.waitEvent(EventRunnerCrashed, "m")
+	ts.waitEvent(EventModelUnloaded, "m")
+	if names := ts.loaded(); len(names) != 0 {
+		t.Errorf("crashed model still loaded: %v", names)
+	}
+
+	// The port is free again, so the model can be loaded once more
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+	if code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"again"}`); code != http.StatusOK {
+		t.Errorf("completion after reload: %d %s", code, body)
+	}
+}
+
+func Test_LoadEvents(t *testing.T) {
+	ts := newTestServer(t)
+	// modelEvents returns the types of the events of model up to the first
+	// of until
+	modelEvents := func(model string, until ...EventType) []EventType {
+		seen := []EventType{}
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case ev := <-ts.events:
+				if me, ok := ev.Data.(ModelEvent); ok && me.Model == model {
+					seen = append(seen, ev.Type)
+					for _, et := range until {
+						if ev.Type == et {
+							return seen
+						}
+					}
+				}
+			case <-timeout:
+				t.Fatalf("events of %s: %v", model, seen)
+			}
+		}
+	}
+
+	if code, body := ts.do("POST", "/api/v1/m/load", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t))); code != http.StatusOK {
+		t.Fatalf("load: %d %s", code, body)
+	}
+	if seen := modelEvents("m", EventModelReady); seen[0] != EventModelLoading {
+		t.Errorf("model.ready before model.loading: %v", seen)
+	}
+
+	// without a server binary the replica can't start
+	ts.PathToLLama = t.TempDir()
+	if code, body := ts.do("POST", "/api/v1/broken/load", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t))); code != http.StatusBadRequest {
+		t.Errorf("load without a server binary: %d %s", code, body)
+	}
+	if seen := modelEvents("broken", EventModelUnloaded); seen[0] != EventModelLoading {
+		t.Errorf("failed load: %v", seen)
+	}
+}
+
+func Test_SaveExtendingKonfig(t *testing.T) {
+	ts := newTestServer(t)
+	if code, body := ts.do("POST", "/api/v1/base", `{"model":"m.gguf","contextSize":512}`); code != http.StatusOK {
+		t.Fatalf("save base: %d %s", code, body)
+	}
+	ts.load("child", fmt.Sprintf(`{"extends":"base","port":%d}`, freeTCPPort(t)))
+	if code, body := ts.do("GET", "/api/v1/child/savetofile", ""); code != http.StatusOK {
+		t.Fatalf("save loaded child: %d %s", code, body)
+	}
+	stored, err := ts.Konfigs.Load("child")
+	if err != nil || strings.Contains(string(stored), "contextSize") {
+		t.Errorf("base inlined into the saved child: %s %v", stored, err)
+	}
+
+	//changes of the base still reach the child
+	ts.do("POST", "/api/v1/base", `{"model":"m.gguf","contextSize":1024}`)
+	_, body := ts.do("GET", "/api/v1/child/resolved", "")
+	var resolved struct {
+		Konfig types.Model_Request `json:"konfig"`
+	}
+	if json.Unmarshal([]byte(body), &resolved); resolved.Konfig.ContextSize != 1024 {
+		t.Errorf("child not following its base: %s", body)
+	}
+}
+
+func Test_Restart(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+	old, _ := ts.pool("m")
+	oldRunners := old.Runners()
+
+	port := freeTCPPort(t)
+	code, body := ts.do("POST", "/api/v1/m/reload", fmt.Sprintf(`{"model":"m.gguf","port":%d,"parallelSlots":2}`, port))
+	if code != http.StatusOK {
+		t.Fatalf("reload: %d %s", code, body)
+	}
+	if ev := ts.waitEvent(EventModelReloaded, "m").Data.(ModelEvent); len(ev.Ports) != 1 || ev.Ports[0] != port {
+		t.Errorf("unexpected reload event %+v", ev)
+	}
+
+	// slot 1 only exists with the new konfig
+	if code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"hi","slot_id":1}`); code != http.StatusOK {
+		t.Errorf("completion on new replica: %d %s", code, body)
+	}
+	select {
+	case <-oldRunners[0].Done():
+	case <-time.After(10 * time.Second):
+		t.Error("old runner not stopped after reload")
+	}
+	if names := ts.loaded(); len(names) != 1 || names[0] != "m" {
+		t.Errorf("loaded after reload: %v", names)
+	}
+}
+
+func Test_ReloadUnderLoad(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d,"parallelSlots":2}`, freeTCPPort(t)))
+	old, _ := ts.pool("m")
+	oldRunner := old.Runners()[0]
+
+	// a slow completion keeps the old runner busy across the switch
+	slow := make(chan string, 1)
+	go func() {
+		code, body := ts.do("POST", "/api/v1/m/completion", fmt.Sprintf(`{"prompt":%q}`, fakellama.SlowPrompt))
+		slow <- fmt.Sprintf("%d %s", code, body)
+	}()
+	for old.InFlight() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"hi"}`); code != http.StatusOK {
+					t.Errorf("completion during reload: %d %s", code, body)
+				}
+			}
+		}()
+	}
+
+	code, body := ts.do("POST", "/api/v1/m/reload", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+	if code != http.StatusOK {
+		t.Fatalf("reload: %d %s", code, body)
+	}
+	ts.waitEvent(EventModelReloaded, "m")
+	select {
+	case result := <-slow:
+		// the reload took longer than the slow completion
+		slow <- result
+	default:
+		select {
+		case <-oldRunner.Done():
+			t.Error("old runner stopped with a request in flight")
+		default:
+		}
+	}
+	if result := <-slow; !strings.HasPrefix(result, "200 ") {
+		t.Errorf("slow completion across the reload: %s", result)
+	}
+	close(stop)
+	wg.Wait()
+
+	select {
+	case <-oldRunner.Done():
+	case <-time.After(10 * time.Second):
+		t.Error("old runner not stopped after its requests finished")
+	}
+}
+
+func Test_TokenizeAndCount(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d,"contextSize":64,"parallelSlots":2}`, freeTCPPort(t)))
+
+	code, body := ts.do("POST", "/api/v1/m/tokenize", `{"content":"abc"}`)
+	tok := types.Tokenize_Response{}
+	json.Unmarshal([]byte(body), &tok)
+	if code != http.StatusOK || len(tok.Tokens) != 3 {
+		t.Fatalf("tokenize: %d %s", code, body)
+	}
+	data, _ := json.Marshal(types.Detokenize_Request{Tokens: tok.Tokens})
+	code, body = ts.do("POST", "/api/v1/m/detokenize", string(data))
+	detok := types.Detokenize_Response{}
+	json.Unmarshal([]byte(body), &detok)
+	if code != http.StatusOK || detok.Content != "abc" {
+		t.Errorf("detokenize: %d %s", code, body)
+	}
+
+	code, body = ts.do("POST", "/api/v1/m/count", `{"prompt":"0123456789"}`)
+	count := types.Count_Response{}
+	json.Unmarshal([]byte(body), &count)
+	if code != http.StatusOK || count != (types.Count_Response{Tokens: 10, ContextSize: 32, Remaining: 22}) {
+		t.Errorf("count prompt: %d %s", code, body)
+	}
+
+	code, body = ts.do("POST", "/api/v1/m/count", `{"messages":[{"role":"user","content":"hi"}]}`)
+	prompt, _ := types.RenderChat(types.ChatTemplateChatML, []types.ChatMessage{{Role: "user", Content: "hi"}})
+	count = types.Count_Response{}
+	json.Unmarshal([]byte(body), &count)
+	if code != http.StatusOK || count.Tokens != len(prompt) {
+		t.Errorf("count messages: %d %s", code, body)
+	}
+
+	if code, _ := ts.do("POST", "/api/v1/m/count", `{}`); code != http.StatusBadRequest {
+		t.Errorf("count without prompt: got %d", code)
+	}
+}
+
+func Test_Embeddings(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("plain", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+	ts.load("emb", fmt.Sprintf(`{"model":"m.gguf","port":%d,"embeddings":true,"parallelSlots":2}`, freeTCPPort(t)))
+
+	code, body := ts.do("POST", "/api/v1/plain/embedding", `{"content":"hi"}`)
+	if code != http.StatusBadRequest || !strings.Contains(body, "embeddings enabled") {
+		t.Errorf("embedding without --embedding: %d %s", code, body)
+	}
+	code, body = ts.do("POST", "/api/v1/emb/embedding", `{"content":"hi"}`)
+	single := types.Embedding_Response{}
+	json.Unmarshal([]byte(body), &single)
+	if code != http.StatusOK || len(single.Embedding) != 8 {
+		t.Fatalf("embedding: %d %s", code, body)
+	}
+
+	code, body = ts.do("POST", "/v1/embeddings", `{"model":"emb","input":["hi","there","you"]}`)
+	res := types.OpenAIEmbeddings_Response{}
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || len(res.Data) != 3 || res.Usage.PromptTokens != 10 || res.Usage.TotalTokens != 10 {
+		t.Fatalf("openai embeddings: %d %s", code, body)
+	}
+	for i, d := range res.Data {
+		if d.Index != i || d.Object != "embedding" || len(d.Embedding) != 8 {
+			t.Errorf("entry %d: %+v", i, d)
+		}
+	}
+	if fmt.Sprint(res.Data[0].Embedding) != fmt.Sprint(single.Embedding) {
+		t.Errorf("embeddings of the same input differ")
+	}
+
+	code, body = ts.do("POST", "/v1/embeddings", `{"model":"emb","input":"single"}`)
+	res = types.OpenAIEmbeddings_Response{}
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || len(res.Data) != 1 {
+		t.Errorf("openai embeddings of a string: %d %s", code, body)
+	}
+	if code, body := ts.do("POST", "/v1/embeddings", `{"model":"plain","input":"x"}`); code != http.StatusBadRequest {
+		t.Errorf("openai embeddings without --embedding: %d %s", code, body)
+	}
+	inputs, _ := json.Marshal(make([]string, maxEmbeddingInputs+1))
+	if code, body := ts.do("POST", "/v1/embeddings", fmt.Sprintf(`{"model":"emb","input":%s}`, inputs)); code != http.StatusBadRequest || !strings.Contains(body, "At most") {
+		t.Errorf("too many inputs: %d %s", code, body)
+	}
+}
+
+func Test_Sessions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d,"contextSize":256,"parallelSlots":2}`, freeTCPPort(t)))
+
+	code, body := ts.do("POST", "/api/v1/sessions", `{"model":"m","system":"sys","params":{"n_predict":4}}`)
+	sess := types.Session{}
+	json.Unmarshal([]byte(body), &sess)
+	if code != http.StatusCreated || sess.ID == "" || sess.Slot != 0 {
+		t.Fatalf("create session: %d %s", code, body)
+	}
+	code, body = ts.do("POST", "/api/v1/sessions", `{"model":"m"}`)
+	other := types.Session{}
+	json.Unmarshal([]byte(body), &other)
+	if code != http.StatusCreated || other.Slot != 1 {
+		t.Errorf("second session not on the free slot: %d %s", code, body)
+	}
+
+	// every turn takes about 100 of the 124 tokens a slot has left for the prompt
+	var reply types.SessionMessage_Response
+	for i := 0; i < 3; i++ {
+		code, body = ts.do("POST", "/api/v1/sessions/"+sess.ID+"/messages", fmt.Sprintf(`{"content":"message %d %s"}`, i, strings.Repeat("x", 30)))
+		reply = types.SessionMessage_Response{}
+		json.Unmarshal([]byte(body), &reply)
+		if code != http.StatusOK || reply.Message.Content != "tok0 tok1 tok2 tok3" {
+			t.Fatalf("message %d: %d %s", i, code, body)
+		}
+		if reply.Tokens > 124 {
+			t.Errorf("message %d: prompt of %d tokens doesn't fit", i, reply.Tokens)
+		}
+	}
+	if reply.Trimmed == 0 || !strings.HasPrefix(reply.Result.Prompt, "<|im_start|>system\nsys<|im_end|>") {
+		t.Errorf("history not trimmed or system message dropped: %+v", reply)
+	}
+
+	stored, err := types.LoadSessions(ts.sessionsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stored[sess.ID]; got == nil || len(got.Messages) != 6 {
+		t.Errorf("transcript not persisted: %+v", got)
+	}
+
+	code, body = ts.do("POST", "/api/v1/sessions/"+other.ID+"/messages", fmt.Sprintf(`{"content":"%s"}`, strings.Repeat("y", 200)))
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized message: %d %s", code, body)
+	}
+
+	if code, _ := ts.do("DELETE", "/api/v1/sessions/"+sess.ID, ""); code != http.StatusOK {
+		t.Errorf("delete session: %d", code)
+	}
+	if code, _ := ts.do("GET", "/api/v1/sessions/"+sess.ID, ""); code != http.StatusNotFound {
+		t.Errorf("deleted session still there: %d", code)
+	}
+
+	//a message waiting for the session while it is deleted must not bring
+	//the file back
+	live, _ := ts.getSession(other.ID)
+	live.mu.Lock()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ts.do("POST", "/api/v1/sessions/"+other.ID+"/messages", `{"content":"hi"}`)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		defer wg.Done()
+		if code, body := ts.do("DELETE", "/api/v1/sessions/"+other.ID, ""); code != http.StatusOK {
+			t.Errorf("delete busy session: %d %s", code, body)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	live.mu.Unlock()
+	wg.Wait()
+	stored, err = types.LoadSessions(ts.sessionsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 0 {
+		t.Errorf("deleted sessions still stored: %v", stored)
+	}
+
+	//stored grammars are resolved for llama.cpp, which answers with the
+	//prompt when it gets a grammar
+	ts.do("PUT", "/api/v1/grammars/yesno", `{"grammar":"root ::= \"yes\" | \"no\"\n"}`)
+	code, body = ts.do("POST", "/api/v1/sessions", `{"model":"m","params":{"grammar_name":"yesno"}}`)
+	constrained := types.Session{}
+	json.Unmarshal([]byte(body), &constrained)
+	code, body = ts.do("POST", "/api/v1/sessions/"+constrained.ID+"/messages", `{"content":"yes or no?"}`)
+	reply = types.SessionMessage_Response{}
+	json.Unmarshal([]byte(body), &reply)
+	if code != http.StatusOK || !strings.Contains(reply.Message.Content, "yes or no?") {
+		t.Errorf("session grammar not applied: %d %s", code, body)
+	}
+	ts.do("DELETE", "/api/v1/grammars/yesno", "")
+	if code, body := ts.do("POST", "/api/v1/sessions/"+constrained.ID+"/messages", `{"content":"again"}`); code != http.StatusBadRequest {
+		t.Errorf("message with a deleted grammar: %d %s", code, body)
+	}
+}
+
+func Test_CompletionValidation(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d,"maxNPredict":2}`, freeTCPPort(t)))
+
+	code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"hi","temperature":-1,"top_p":0,"mirostat":3,"grammar":"root ::= item","n_predict":5}`)
+	verr := types.ValidationError{}
+	if err := json.Unmarshal([]byte(body), &verr); code != http.StatusBadRequest || err != nil {
+		t.Fatalf("invalid completion: %d %s", code, body)
+	}
+	pointers := map[string]bool{}
+	for _, fe := range verr.Errors {
+		pointers[fe.Pointer] = true
+	}
+	for _, p := range []string{"/temperature", "/top_p", "/mirostat", "/grammar", "/n_predict"} {
+		if !pointers[p] {
+			t.Errorf("no error for %s in %s", p, body)
+		}
+	}
+
+	// an unlimited n_predict is capped by the konfig
+	code, body = ts.do("POST", "/api/v1/m/completion", `{"prompt":"hi"}`)
+	res := types.Result{}
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || res.Content != " tok0 tok1" {
+		t.Errorf("capped completion: %d %s", code, body)
+	}
+}
+
+func Test_Grammars(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+
+	if code, body := ts.do("PUT", "/api/v1/grammars/yesno", `{"grammar":"root ::= answer\n"}`); code != http.StatusBadRequest {
+		t.Errorf("save of invalid grammar: %d %s", code, body)
+	}
+	if code, body := ts.do("PUT", "/api/v1/grammars/yesno", `{"grammar":"root ::= \"yes\" | \"no\"\n"}`); code != http.StatusOK {
+		t.Fatalf("save grammar: %d %s", code, body)
+	}
+	if code, body := ts.do("GET", "/api/v1/grammars", ""); code != http.StatusOK || body != "[\"yesno\"]\n" {
+		t.Errorf("list grammars: %d %s", code, body)
+	}
+	if code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"yes","grammar_name":"yesno"}`); code != http.StatusOK {
+		t.Errorf("completion with stored grammar: %d %s", code, body)
+	}
+	if code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"yes","grammar_name":"missing"}`); code != http.StatusBadRequest {
+		t.Errorf("completion with unknown grammar: %d %s", code, body)
+	}
+
+	// the fake server answers grammar constrained requests with the prompt
+	format := `{"type":"json_schema","json_schema":{"name":"person","schema":{"type":"object","properties":{"name":{"type":"string"},"age":{"type":"integer","minimum":0}},"required":["name"]}}}`
+	code, body := ts.do("POST", "/api/v1/m/completion", fmt.Sprintf(`{"prompt":%q,"response_format":%s}`, `{"name":"bob","age":3}`, format))
+	if code != http.StatusOK {
+		t.Errorf("completion matching the schema: %d %s", code, body)
+	}
+	code, body = ts.do("POST", "/api/v1/m/completion", fmt.Sprintf(`{"prompt":%q,"response_format":%s}`, `{"name":"bob","age":-3}`, format))
+	if code != http.StatusBadGateway || !strings.Contains(body, "/age") {
+		t.Errorf("completion violating the schema: %d %s", code, body)
+	}
+	code, body = ts.do("POST", "/api/v1/m/completion", fmt.Sprintf(`{"prompt":%q,"stream":true,"response_format":%s}`, `{"age":3}`, format))
+	if code != http.StatusOK || !strings.Contains(body, `"error":"Response does not match the schema`) {
+		t.Errorf("streamed completion violating the schema: %d %s", code, body)
+	}
+	code, body = ts.do("POST", "/api/v1/m/completion", `{"prompt":"{}","response_format":{"type":"json_schema","schema":{"allOf":[]}}}`)
+	if code != http.StatusBadRequest || !strings.Contains(body, "/response_format/schema") {
+		t.Errorf("completion with unsupported schema: %d %s", code, body)
+	}
+
+	if code, body := ts.do("DELETE", "/api/v1/grammars/yesno", ""); code != http.StatusOK {
+		t.Errorf("delete grammar: %d %s", code, body)
+	}
+}
+
+func Test_ChatCompletionsWithTools(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+
+	tools := `[{"type":"function","function":{"name":"get_weather","parameters":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}}]`
+	messages := `[{"role":"user","content":"Weather in Bern?"},` +
+		`{"role":"assistant","content":"","tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Bern\"}"}}]},` +
+		`{"role":"tool","tool_call_id":"call_1","content":"sunny"}]`
+
+	code, body := ts.do("POST", "/v1/chat/completions", fmt.Sprintf(`{"model":"m","messages":%s,"tools":%s,"max_tokens":2}`, messages, tools))
+	res := types.ChatCompletion_Response{}
+	if err := json.Unmarshal([]byte(body), &res); code != http.StatusOK || err != nil {
+		t.Fatalf("chat: %d %s", code, body)
+	}
+	if msg := res.Choices[0].Message; msg.Content != "tok0 tok1" || res.Choices[0].FinishReason != "length" {
+		t.Errorf("unexpected chat answer %+v", res.Choices[0])
+	}
+
+	// the fake server answers with the prompt when it gets a grammar, which
+	// shows what the chat template made of tools, calls and results
+	code, body = ts.do("POST", "/v1/chat/completions", fmt.Sprintf(`{"model":"m","messages":%s,"tools":%s,"tool_choice":{"type":"function","function":{"name":"get_weather"}}}`, messages, tools))
+	res = types.ChatCompletion_Response{}
+	if err := json.Unmarshal([]byte(body), &res); code != http.StatusOK || err != nil {
+		t.Fatalf("forced tool call: %d %s", code, body)
+	}
+	choice := res.Choices[0]
+	for _, want := range []string{"<tools>", "<|im_start|>tool\n<tool_response>\nsunny"} {
+		if !strings.Contains(choice.Message.Content, want) {
+			t.Errorf("prompt lacks %q:\n%s", want, choice.Message.Content)
+		}
+	}
+	// the earlier call rendered into the prompt comes back as a tool call
+	calls := choice.Message.ToolCalls
+	if choice.FinishReason != "tool_calls" || len(calls) != 1 || calls[0].Function.Name != "get_weather" || calls[0].Function.Arguments != `{"city":"Bern"}` {
+		t.Errorf("unexpected tool calls %+v", choice)
+	}
+
+	if code, body := ts.do("POST", "/v1/chat/completions", fmt.Sprintf(`{"model":"m","messages":%s,"tool_choice":"required"}`, messages)); code != http.StatusBadRequest {
+		t.Errorf("forced tool call without tools: %d %s", code, body)
+	}
+
+	//a grammar in the defaults doesn't constrain chat answers
+	ts.load("g", fmt.Sprintf(`{"model":"m.gguf","port":%d,"defaults":{"grammar":"root ::= \"x\""}}`, freeTCPPort(t)))
+	code, body = ts.do("POST", "/v1/chat/completions", `{"model":"g","messages":[{"role":"user","content":"hi"}],"max_tokens":2}`)
+	res = types.ChatCompletion_Response{}
+	if err := json.Unmarshal([]byte(body), &res); code != http.StatusOK || err != nil {
+		t.Fatalf("chat with a default grammar: %d %s", code, body)
+	}
+	if msg := res.Choices[0].Message; msg.Content != "tok0 tok1" {
+		t.Errorf("default grammar forwarded: %+v", res.Choices[0])
+	}
+}
+
+func Test_ResponseCache(t *testing.T) {
+	ts := newTestServer(t)
+	ts.Cache = NewResponseCache(NewMemoryCache(10), time.Minute)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+
+	for _, body := range []string{
+		`{"prompt":"hi","temperature":0}`,
+		`{"prompt":"hi","temperature":0,"top_k":40,"id_slot":0}`, // same request, spelled out
+		`{"prompt":"hi","temperature":0.5,"seed":42}`,
+		`{"prompt":"hi","temperature":0.5,"seed":42}`,
+		`{"prompt":"hi","temperature":0,"stream":true}`,
+		`{"prompt":"hi","temperature":0,"stream":true}`,
+		`{"prompt":"hi"}`, // sampled, not cacheable
+	} {
+		if code, resp := ts.do("POST", "/api/v1/m/completion", body); code != http.StatusOK {
+			t.Fatalf("completion %s: %d %s", body, code, resp)
+		}
+	}
+	stats := types.CacheStats{}
+	_, body := ts.do("GET", "/api/v1/cache", "")
+	json.Unmarshal([]byte(body), &stats)
+	want := types.CacheStats{Entries: 3, Hits: 3, Misses: 3, Bypasses: 1, Stores: 3}
+	if stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+
+	// a cached stream is replayed as it was received
+	req, _ := http.NewRequest("POST", ts.URL+"/api/v1/m/completion", strings.NewReader(`{"prompt":"hi","temperature":0,"stream":true}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get(CacheHeader) != "hit" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") || !strings.Contains(string(data), `"stop":true`) {
+		t.Errorf("unexpected replay %v %s", resp.Header, data)
+	}
+
+	req, _ = http.NewRequest("POST", ts.URL+"/api/v1/m/completion", strings.NewReader(`{"prompt":"hi","temperature":0}`))
+	req.Header.Set(CacheHeader, "bypass")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get(CacheHeader) != "bypass" {
+		t.Errorf("bypass header ignored: %v", resp.Header)
+	}
+
+	dir := t.TempDir()
+	disk, err := NewDiskCache(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.Put("fresh", &CachedResponse{Status: 200, Body: []byte("{}")})
+	disk.Put("stale", &CachedResponse{Status: 200, Body: []byte("{}"), Expires: time.Now().Add(-time.Second)})
+	if _, ok := disk.Get("fresh"); !ok {
+		t.Error("disk cache lost an entry")
+	}
+	if _, ok := disk.Get("stale"); ok || disk.Len() != 1 {
+		t.Errorf("disk cache kept an expired entry, %d entries", disk.Len())
+	}
+	disk.Put("stale", &CachedResponse{Status: 200, Body: []byte("{}"), Expires: time.Now().Add(-time.Second)})
+	if n := disk.Sweep(); n != 1 || disk.Len() != 1 {
+		t.Errorf("sweep removed %d entries, %d left", n, disk.Len())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "stale.json")); !os.IsNotExist(err) {
+		t.Errorf("swept entry still on disk: %v", err)
+	}
+}
+
+func Test_DiskCacheLimits(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := NewDiskCache(dir, 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := NewResponseCache(disk, 0)
+	defer cache.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		disk.Put(key, &CachedResponse{Status: 200, Body: []byte(key)})
+	}
+	//a is used again, so b is the least recently used
+	disk.Get("a")
+	disk.Put("d", &CachedResponse{Status: 200, Body: []byte("d")})
+	if _, ok := disk.Get("b"); ok || disk.Len() != 3 {
+		t.Errorf("least recently used entry not evicted, %d entries", disk.Len())
+	}
+	if stats := cache.Stats(); stats.Evictions != 1 {
+		t.Errorf("%d evictions counted", stats.Evictions)
+	}
+
+	//the order of use survives a restart
+	time.Sleep(10 * time.Millisecond)
+	disk.Get("c")
+	time.Sleep(10 * time.Millisecond)
+	disk.Get("a")
+	reopened, err := NewDiskCache(dir, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reopened.Get("d"); ok || reopened.Len() != 2 {
+		t.Errorf("reopened cache kept the wrong entries, %d entries", reopened.Len())
+	}
+
+	//room for two and a half responses
+	size, _ := json.Marshal(&CachedResponse{Status: 200, Body: []byte("a")})
+	bounded, err := NewDiskCache(t.TempDir(), 0, int64(len(size))*5/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		bounded.Put(key, &CachedResponse{Status: 200, Body: []byte(key)})
+	}
+	if _, ok := bounded.Get("a"); ok || bounded.Len() != 2 {
+		t.Errorf("byte limit not enforced, %d entries", bounded.Len())
+	}
+}
+
+func Test_AuditLog(t *testing.T) {
+	ts := newTestServer(t)
+	audit, err := NewAuditLog(t.TempDir()+"/audit.log", 0, 0, []types.RedactionRule{{Pattern: `secret-\w+`}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	ts.Audit = audit
+
+	if code, body := ts.do("POST", "/api/v1/m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t))); code != http.StatusOK {
+		t.Fatalf("save konfig: %d %s", code, body)
+	}
+	if code, body := ts.do("GET", "/api/v1/m/load", ""); code != http.StatusOK {
+		t.Fatalf("load: %d %s", code, body)
+	}
+	ts.waitEvent(EventModelReady, "m")
+
+	for _, body := range []string{
+		`{"prompt":"my secret-token","n_predict":2}`,
+		`{"prompt":"again","n_predict":3,"stream":true}`,
+		`{"prompt":"hi","temperature":-1}`,                          // rejected before proxying
+		`{"prompt":"[1]","response_format":{"type":"json_object"}}`, // rejected after generating
+	} {
+		req, _ := http.NewRequest("POST", ts.URL+"/api/v1/m/completion", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer key-1")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	records := []*types.AuditRecord{}
+	_, body := ts.do("GET", "/api/v1/audit?model=m", "")
+	if err := json.Unmarshal([]byte(body), &records); err != nil || len(records) != 4 {
+		t.Fatalf("expected 4 records, got %v: %s", err, body)
+	}
+	if invalid := records[2]; invalid.Status != http.StatusBadRequest || invalid.Prompt != "hi" || invalid.Error == "" {
+		t.Errorf("unexpected record of an invalid request %+v", invalid)
+	}
+	if mismatch := records[3]; mismatch.Status != http.StatusBadGateway || !strings.Contains(mismatch.Error, "schema") {
+		t.Errorf("unexpected record of a schema mismatch %+v", mismatch)
+	}
+	first, second := records[0], records[1]
+	if first.Prompt != "my [REDACTED]" || first.Content != " tok0 tok1" || first.StopReason != "limit" || first.TokensPredicted != 2 {
+		t.Errorf("unexpected record %+v", first)
+	}
+	if first.Revision != 1 || first.Konfig != "m" || first.Status != http.StatusOK || first.Params["n_predict"] != 2.0 {
+		t.Errorf("unexpected record %+v", first)
+	}
+	if first.APIKey == "" || strings.Contains(first.APIKey, "key-1") || first.APIKey != second.APIKey {
+		t.Errorf("unexpected api key fingerprints %q %q", first.APIKey, second.APIKey)
+	}
+	if second.Content != " tok0 tok1 tok2" || second.TokensPredicted != 3 {
+		t.Errorf("stream not recorded: %+v", second)
+	}
+
+	future := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	_, body = ts.do("GET", "/api/v1/audit?from="+future, "")
+	if strings.TrimSpace(body) != "[]" {
+		t.Errorf("time filter ignored: %s", body)
+	}
+	if code, _ := ts.do("GET", "/api/v1/audit?to=yesterday", ""); code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid time, got %d", code)
+	}
+
+	// rotation keeps the newest records
+	rotating, err := NewAuditLog(t.TempDir()+"/audit.log", 200, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotating.Close()
+	for i := 0; i < 10; i++ {
+		rotating.Write(&types.AuditRecord{Time: time.Now(), Model: "m", Prompt: strconv.Itoa(i)})
+	}
+	kept, err := rotating.Query(time.Time{}, time.Time{}, "")
+	if err != nil || len(kept) == 0 || len(kept) >= 10 || kept[len(kept)-1].Prompt != "9" {
+		t.Errorf("unexpected records after rotation: %v %d", err, len(kept))
+	}
+}
+
+func Test_RequestIDs(t *testing.T) {
+	runnerLog := logtest.NewLocal(logger)
+	access := logtest.NewLocal(accessLog)
+	defer logger.ReplaceHooks(logrus.LevelHooks{})
+	defer accessLog.ReplaceHooks(logrus.LevelHooks{})
+
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+
+	req, _ := http.NewRequest("POST", ts.URL+"/api/v1/m/completion", strings.NewReader(`{"prompt":"hi"}`))
+	req.Header.Set(RequestIDHeader, "req-42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if ids := resp.Header.Values(RequestIDHeader); len(ids) != 1 || ids[0] != "req-42" {
+		t.Errorf("request id not propagated: %v", ids)
+	}
+
+	// the runner got the id and its log line is tagged with it
+	deadline := time.Now().Add(5 * time.Second)
+	found := false
+	for !found && time.Now().Before(deadline) {
+		for _, e := range runnerLog.AllEntries() {
+			if strings.Contains(e.Message, "X-Request-ID=req-42") && e.Data["request_id"] == "req-42" && e.Data["model"] == "m" {
+				found = true
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !found {
+		t.Error("no runner log line tagged with the request id")
+	}
+
+	// errors get a generated id, and the access log tells what went wrong
+	req, _ = http.NewRequest("POST", ts.URL+"/api/v1/missing/completion", strings.NewReader(`{}`))
+	req.Header.Set(RequestIDHeader, "bad id")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	id := resp.Header.Get(RequestIDHeader)
+	if resp.StatusCode != http.StatusBadRequest || id == "" || id == "bad id" {
+		t.Fatalf("expected 400 with a generated id, got %d %q", resp.StatusCode, id)
+	}
+	entry := access.LastEntry()
+	if entry == nil || entry.Data["request_id"] != id || entry.Data["status"] != http.StatusBadRequest || entry.Data["error"] != "Model not loaded" {
+		t.Errorf("unexpected access log entry %+v", entry)
+	}
+}
+
+func Test_Tracing(t *testing.T) {
+	// a collector stub receiving OTLP/HTTP protobuf exports
+	var mu sync.Mutex
+	spans := map[string]*tracepb.Span{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		req := &coltracepb.ExportTraceServiceRequest{}
+		if r.URL.Path != "/v1/traces" || proto.Unmarshal(data, req) != nil {
+			http.Error(w, "bad export", http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					spans[span.Name] = span
+				}
+			}
+		}
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(nil)
+	}))
+	defer collector.Close()
+
+	// SetupTracing installs a global provider and propagator, put back the
+	// previous ones so later tests don't export to the closed collector
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	shutdown, err := SetupTracing(context.Background(), collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := newTestServer(t)
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+	if code, body := ts.do("POST", "/api/v1/m/completion", `{"prompt":"hello","n_predict":3}`); code != http.StatusOK {
+		t.Fatalf("completion: %d %s", code, body)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range []string{"runner start", "POST /api/v1/{model}/completion", "route", "queue", "proxy /completion"} {
+		if spans[name] == nil {
+			t.Errorf("span %q not exported, got %v", name, spans)
+		}
+	}
+	proxy, server := spans["proxy /completion"], spans["POST /api/v1/{model}/completion"]
+	if proxy == nil || server == nil {
+		t.FailNow()
+	}
+	if !bytes.Equal(proxy.TraceId, server.TraceId) || !bytes.Equal(proxy.ParentSpanId, server.SpanId) {
+		t.Error("proxy span is not a child of the server span")
+	}
+	attrs := map[string]float64{}
+	for _, kv := range proxy.Attributes {
+		attrs[kv.Key] = kv.Value.GetDoubleValue()
+	}
+	if attrs["llama.prompt_ms"] != 5 || attrs["llama.predicted_ms"] != 30 {
+		t.Errorf("timings missing from the proxy span: %v", proxy.Attributes)
+	}
+}
+
+func Test_Workers(t *testing.T) {
+	coordinator := newTestServer(t)
+	coordinator.WorkerSecret = "s3cret"
+	worker := newTestServer(t)
+	worker.WorkerSecret = "s3cret"
+	worker.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+	audit, err := NewAuditLog(t.TempDir()+"/audit.log", 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+	coordinator.Audit = audit
+
+	workers := func() []*types.WorkerInfo {
+		_, body := coordinator.do("GET", "/api/v1/workers", "")
+		infos := []*types.WorkerInfo{}
+		if err := json.Unmarshal([]byte(body), &infos); err != nil {
+			t.Fatalf("workers: %v: %s", err, body)
+		}
+		return infos
+	}
+	waitWorkers := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for len(workers()) != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d workers, got %+v", n, workers())
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// registering needs the shared secret
+	if code, _ := coordinator.do("POST", "/api/v1/workers/register", `{"id":"rogue","url":"http://localhost:1","models":["m"]}`); code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without the secret, got %d", code)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		worker.RunWorker(ctx, coordinator.URL, worker.URL, "w1")
+		close(done)
+	}()
+	waitWorkers(1)
+	if infos := workers(); infos[0].ID != "w1" || !infos[0].HasModel("m") {
+		t.Errorf("unexpected worker %+v", infos[0])
+	}
+
+	// the coordinator has no model m and falls back to the worker
+	req, _ := http.NewRequest("POST", coordinator.URL+"/api/v1/m/completion", strings.NewReader(`{"prompt":"hi"}`))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(WorkerHeader) != "w1" {
+		t.Errorf("remote fallback: %d %v", resp.StatusCode, resp.Header)
+	}
+
+	// a heartbeat only updates the load, the worker stays reachable
+	req, _ = http.NewRequest("POST", coordinator.URL+"/api/v1/workers/w1/heartbeat", strings.NewReader(`{"models":["m"],"capacity":{"inFlight":1}}`))
+	req.Header.Set(WorkerSecretHeader, "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if infos := workers(); resp.StatusCode != http.StatusOK || infos[0].URL != worker.URL {
+		t.Errorf("heartbeat without url: %d %+v", resp.StatusCode, infos[0])
+	}
+
+	// route targets are looked up on the workers too
+	if code, body := coordinator.do("PUT", "/api/v1/routes/alias", `{"targets":[{"model":"m"}]}`); code != http.StatusOK {
+		t.Fatalf("save route: %d %s", code, body)
+	}
+	req, _ = http.NewRequest("POST", coordinator.URL+"/api/v1/alias/completion", strings.NewReader(`{"prompt":"hi"}`))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(WorkerHeader) != "w1" {
+		t.Errorf("route to a worker: %d %v", resp.StatusCode, resp.Header)
+	}
+	if code, body := coordinator.do("POST", "/v1/chat/completions", `{"model":"alias","messages":[{"role":"user","content":"hi"}]}`); code != http.StatusOK {
+		t.Errorf("chat routed to a worker: %d %s", code, body)
+	}
+
+	// the coordinator audits what it forwards, with the worker that served it
+	records := []*types.AuditRecord{}
+	_, body := coordinator.do("GET", "/api/v1/audit", "")
+	if err := json.Unmarshal([]byte(body), &records); err != nil || len(records) != 3 {
+		t.Fatalf("expected 3 records, got %v: %s", err, body)
+	}
+	for _, rec := range records {
+		if rec.Worker != "w1" || rec.Konfig != "m" || rec.Status != http.StatusOK {
+			t.Errorf("unexpected record of a forwarded request %+v", rec)
+		}
+	}
+	if records[0].Model != "m" || records[0].Prompt != "hi" || records[1].Model != "alias" {
+		t.Errorf("unexpected records of forwarded completions %+v %+v", records[0], records[1])
+	}
+
+	// stopping the worker deregisters it
+	stop()
+	<-done
+	waitWorkers(0)
+	if code, _ := coordinator.do("POST", "/api/v1/m/completion", `{"prompt":"hi"}`); code != http.StatusBadRequest {
+		t.Errorf("expected 400 without workers, got %d", code)
+	}
+
+	// a worker missing its heartbeats is reaped
+	req, _ = http.NewRequest("POST", coordinator.URL+"/api/v1/workers/register", strings.NewReader(fmt.Sprintf(`{"id":"w2","url":%q,"models":["m"]}`, worker.URL)))
+	req.Header.Set(WorkerSecretHeader, "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitWorkers(1)
+	coordinator.updateWorker("w2", func(w *types.WorkerInfo) { w.LastSeen = time.Now().Add(-2 * heartbeatTimeout) })
+	coordinator.reapStaleWorkers()
+	waitWorkers(0)
+	req, _ = http.NewRequest("POST", coordinator.URL+"/api/v1/workers/w2/heartbeat", strings.NewReader(`{}`))
+	req.Header.Set(WorkerSecretHeader, "s3cret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("heartbeat of a reaped worker: expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func Test_OpenAIUpstream(t *testing.T) {
+	ts := newTestServer(t)
+	t.Setenv("TEST_UPSTREAM_KEY", "s3cret")
+	fake := fakellama.NewHandler(&fakellama.Options{Alias: "gpt", Parallel: 1})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "missing API key", http.StatusUnauthorized)
+			return
+		}
+		fake.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	port := freeTCPPort(t)
+	ts.load("remote", fmt.Sprintf(`{"backend":"openai","upstream":{"url":%q,"model":"gpt","apiKeyEnv":"TEST_UPSTREAM_KEY"},"model":"m.gguf","port":%d,"replicas":2}`, upstream.URL+"/v1", port))
+	ts.mu.RLock()
+	reserved := ts.usedPorts[port] || ts.usedPorts[port+1]
+	ts.mu.RUnlock()
+	if reserved {
+		t.Error("ports reserved for an external upstream")
+	}
+	//the port is still free for a local runner
+	ts.load("m", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, port))
+
+	code, body := ts.do("POST", "/api/v1/remote/completion", `{"prompt":"hi","n_predict":2}`)
+	res := types.Result{}
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || res.Content != " tok0 tok1" || !res.StoppedLimit || res.TokensPredicted != 2 || res.Model != "gpt" {
+		t.Errorf("completion: %d %s", code, body)
+	}
+
+	code, body = ts.do("POST", "/api/v1/remote/completion", `{"prompt":"hi","n_predict":3,"stream":true}`)
+	if code != http.StatusOK || strings.Contains(body, "[DONE]") {
+		t.Fatalf("streamed completion: %d %s", code, body)
+	}
+	content := ""
+	for _, line := range strings.Split(body, "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			chunk := types.Result{}
+			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+				t.Fatal(err)
+			}
+			content += chunk.Content
+		}
+	}
+	if content != " tok0 tok1 tok2" {
+		t.Errorf("streamed content %q", content)
+	}
+
+	//chat and sessions call the upstream themselves
+	code, body = ts.do("POST", "/v1/chat/completions", `{"model":"remote","messages":[{"role":"user","content":"hi"}],"max_tokens":2}`)
+	chat := types.ChatCompletion_Response{}
+	if err := json.Unmarshal([]byte(body), &chat); code != http.StatusOK || err != nil || len(chat.Choices) == 0 {
+		t.Fatalf("chat: %d %s", code, body)
+	}
+	if msg := chat.Choices[0].Message; msg.Content != "tok0 tok1" || chat.Choices[0].FinishReason != "length" {
+		t.Errorf("unexpected chat answer %+v", chat.Choices[0])
+	}
+
+	code, body = ts.do("POST", "/api/v1/sessions", `{"model":"remote","params":{"n_predict":2}}`)
+	sess := types.Session{}
+	json.Unmarshal([]byte(body), &sess)
+	if code != http.StatusCreated {
+		t.Fatalf("create session: %d %s", code, body)
+	}
+	code, body = ts.do("POST", "/api/v1/sessions/"+sess.ID+"/messages", `{"content":"hi"}`)
+	reply := types.SessionMessage_Response{}
+	json.Unmarshal([]byte(body), &reply)
+	if code != http.StatusOK || reply.Message.Content != "tok0 tok1" {
+		t.Errorf("session message: %d %s", code, body)
+	}
+
+	if code, body := ts.do("POST", "/api/v1/remote/infill", `{"input_prefix":"a"}`); code != http.StatusNotImplemented {
+		t.Errorf("infill on an openai upstream: %d %s", code, body)
+	}
+}
+
+func Test_EventStreams(t *testing.T) {
+	ts := newTestServer(t)
+	ts.EventOrigins = []string{"https://dash.example"}
+
+	//SSE, filtered by type prefix
+	req, _ := http.NewRequest("GET", ts.URL+"/api/v1/events?types=model.", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("SSE content type %q", ct)
+	}
+	//the headers are flushed once the handler has subscribed
+	ts.Events.Publish(EventRunnerCrashed, ModelEvent{Model: "filtered"})
+	ts.Events.Publish(EventModelReady, ModelEvent{Model: "m", Port: 1234})
+	reader := bufio.NewReader(resp.Body)
+	lines := []string{}
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	ev := Event{}
+	data, _ := strings.CutPrefix(lines[1], "data: ")
+	if lines[0] != "event: model.ready" || json.Unmarshal([]byte(data), &ev) != nil || ev.Type != EventModelReady {
+		t.Errorf("unexpected SSE event %q", lines)
+	}
+
+	//WebSocket
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/api/v1/events?types=model.ready"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//wait for the handler to subscribe
+	time.Sleep(50 * time.Millisecond)
+	ts.Events.Publish(EventModelLoading, ModelEvent{Model: "filtered"})
+	ts.Events.Publish(EventModelReady, ModelEvent{Model: "m"})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg struct {
+		Type EventType  `json:"type"`
+		Data ModelEvent `json:"data"`
+	}
+	if err := conn.ReadJSON(&msg); err != nil || msg.Type != EventModelReady || msg.Data.Model != "m" {
+		t.Errorf("unexpected WebSocket event %+v: %v", msg, err)
+	}
+
+	//browsers on other sites can't listen in
+	for origin, allowed := range map[string]bool{
+		ts.URL:                       true,
+		"https://evil.example":       false,
+		"https://dash.example":       true,
+		"https://dash.example.other": false,
+	} {
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {origin}})
+		if conn != nil {
+			conn.Close()
+		}
+		if allowed && err != nil {
+			t.Errorf("origin %s rejected: %v", origin, err)
+		}
+		if !allowed && (err == nil || resp == nil || resp.StatusCode != http.StatusForbidden) {
+			t.Errorf("origin %s accepted", origin)
+		}
+	}
+}
+
+func Test_Routes(t *testing.T) {
+	ts := newTestServer(t)
+	ts.load("a", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+	ts.load("b", fmt.Sprintf(`{"model":"m.gguf","port":%d}`, freeTCPPort(t)))
+
+	if code, body := ts.do("PUT", "/api/v1/routes/r", `{"targets":[{"model":"a","weight":-1}]}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("invalid route: %d %s", code, body)
+	}
+	if code, body := ts.do("PUT", "/api/v1/routes/r", `{"targets":[{"model":"a","weight":3},{"model":"b","weight":1},{"model":"gone","weight":5}]}`); code != http.StatusOK {
+		t.Fatalf("save route: %d %s", code, body)
+	}
+
+	//backends reports the share each model got
+	backends := func(name string, n int) map[string]int {
+		t.Helper()
+		got := map[string]int{}
+		for i := 0; i < n; i++ {
+			req, _ := http.NewRequest("POST", ts.URL+"/api/v1/"+name+"/completion", strings.NewReader(`{"prompt":"hi","n_predict":1}`))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("completion via %s: %d", name, resp.StatusCode)
+			}
+			got[resp.Header.Get(BackendHeader)]++
+		}
+		return got
+	}
+	//targets that aren't loaded are skipped, a gets 3/4 of the traffic
+	got := backends("r", 400)
+	if len(got) != 2 || got["a"] < 250 || got["a"] > 350 {
+		t.Errorf("weighted split 3:1 came out as %v", got)
+	}
+
+	//a route shadows the model of the same name, unweighted targets share equally
+	if code, body := ts.do("PUT", "/api/v1/routes/a", `{"targets":[{"model":"b"}]}`); code != http.StatusOK {
+		t.Fatalf("save alias: %d %s", code, body)
+	}
+	if got := backends("a", 5); got["b"] != 5 {
+		t.Errorf("alias served by %v", got)
+	}
+
+	//routes survive a restart
+	stored, err := types.LoadRoutes(filepath.Join(ts.ModelPath, "routes.json"))
+	if err != nil || len(stored) != 2 || len(stored["r"].Targets) != 3 || stored["r"].Targets[0].Weight != 3 {
+		t.Errorf("persisted routes %v: %v", stored, err)
+	}
+	restarted := NewServer(ts.ModelPath, ts.PathToLLama, "", ts.Konfigs)
+	restarted.Close()
+	if restarted.routes["a"] == nil || restarted.routes["r"] == nil {
+		t.Errorf("routes after restart %v", restarted.routes)
+	}
+
+	if code, _ := ts.do("DELETE", "/api/v1/routes/a", ""); code != http.StatusOK {
+		t.Errorf("delete route: %d", code)
+	}
+	if code, _ := ts.do("DELETE", "/api/v1/routes/a", ""); code != http.StatusNotFound {
+		t.Errorf("delete of a deleted route: %d", code)
+	}
+	if code, _ := ts.do("GET", "/api/v1/routes/a", ""); code != http.StatusNotFound {
+		t.Errorf("deleted route still there: %d", code)
+	}
+	//the model is reachable under its own name again
+	if got := backends("a", 3); got["a"] != 3 {
+		t.Errorf("model behind a deleted route served by %v", got)
+	}
+	if stored, _ := types.LoadRoutes(filepath.Join(ts.ModelPath, "routes.json")); len(stored) != 1 || stored["r"] == nil {
+		t.Errorf("deletion not persisted: %v", stored)
+	}
+
+	//a route without loaded targets is not served
+	ts.do("PUT", "/api/v1/routes/r", `{"targets":[{"model":"gone"}]}`)
+	if code, _ := ts.do("POST", "/api/v1/r/completion", `{"prompt":"hi"}`); code != http.StatusBadRequest {
+		t.Errorf("route without loaded targets: %d", code)
+	}
+}
@@ -0,0 +1,387 @@
+// Package fakellama mimics the llama.cpp server binary closely enough to test
+// chatterbox without a llama.cpp build. All outputs are deterministic:
+//
+//   - /completion generates n_predict (default 4) tokens " tok0", " tok1", ...
+//     and streams them as SSE if stream is set; with a grammar it checks the
+//     grammar and answers with the prompt instead, as if that was all the
+//     grammar allowed
+//   - completions report 1ms per prompt byte and 10ms per generated token as
+//     timings, without taking that long
+//   - /infill returns input_prefix + "<fill>" + input_suffix
+//   - /tokenize returns the bytes of content, /detokenize reverses that
+//   - /embedding returns an 8 dimensional vector derived from content, and
+//     fails unless started with --embedding
+//   - /v1/models and /v1/completions act as an OpenAI-compatible upstream:
+//     completions generate max_tokens (default 4) tokens like /completion,
+//     stream them as OpenAI chunks ending in [DONE] if stream is set, and
+//     finish with "length"
+//
+// Every request but health checks is logged to stdout with its X-Request-ID
+// header. A completion with the prompt CrashPrompt makes the server exit with
+// status 3, one with SlowPrompt takes SlowDelay to answer.
+package fakellama
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schnapper79/chatterbox/grammar"
+)
+
+// CrashPrompt makes the fake server exit as if llama.cpp had crashed.
+const CrashPrompt = "__crash__"
+
+// SlowPrompt keeps a completion in flight for SlowDelay.
+const SlowPrompt = "__slow__"
+
+// SlowDelay is how long a completion with SlowPrompt takes.
+const SlowDelay = 2 * time.Second
+
+// boolFlags are the llama.cpp server flags without a value.
+var boolFlags = map[string]bool{
+	"--memory-f32":    true,
+	"--mlock":         true,
+	"--no-mmap":       true,
+	"--embedding":     true,
+	"--numa":          true,
+	"--cont-batching": true,
+}
+
+// Options are the parsed command line flags.
+type Options struct {
+	Host      string
+	Port      int
+	Alias     string
+	Model     string
+	Parallel  int
+	Embedding bool
+	Flags     map[string]string //every flag given, bool flags map to ""
+}
+
+// ParseArgs parses llama.cpp server style arguments. Unknown flags are kept
+// in Flags so tests can inspect what chatterbox passed.
+func ParseArgs(args []string) (*Options, error) {
+	opts := &Options{Host: "127.0.0.1", Port: 8080, Parallel: 1, Flags: map[string]string{}}
+	for i := 0; i < len(args); i++ {
+		name := args[i]
+		if !strings.HasPrefix(name, "--") {
+			return nil, fmt.Errorf("unexpected argument %q", name)
+		}
+		value := ""
+		if !boolFlags[name] {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("flag %s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		opts.Flags[name] = value
+	}
+
+	var err error
+	for name, value := range opts.Flags {
+		switch name {
+		case "--host":
+			opts.Host = value
+		case "--port":
+			opts.Port, err = strconv.Atoi(value)
+		case "--alias":
+			opts.Alias = value
+		case "--model":
+			opts.Model = value
+		case "--parallel":
+			opts.Parallel, err = strconv.Atoi(value)
+		case "--embedding":
+			opts.Embedding = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("flag %s: %v", name, err)
+		}
+	}
+	if opts.Model == "" {
+		return nil, fmt.Errorf("--model is required")
+	}
+	if opts.Alias == "" {
+		opts.Alias = opts.Model
+	}
+	return opts, nil
+}
+
+// Main runs the fake server with the given arguments until it fails.
+func Main(args []string) error {
+	opts, err := ParseArgs(args)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(opts.Model); err != nil {
+		return fmt.Errorf("failed to load model: %v", err)
+	}
+	return http.ListenAndServe(fmt.Sprintf("%s:%d", opts.Host, opts.Port), NewHandler(opts))
+}
+
+// NewHandler returns the HTTP API of the fake server.
+func NewHandler(opts *Options) http.Handler {
+	s := &server{opts: opts}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", s.health)
+	mux.HandleFunc("/completion", s.completion)
+	mux.HandleFunc("/infill", s.infill)
+	mux.HandleFunc("/tokenize", s.tokenize)
+	mux.HandleFunc("/detokenize", s.detokenize)
+	mux.HandleFunc("/embedding", s.embedding)
+	mux.HandleFunc("/v1/models", s.openAIModels)
+	mux.HandleFunc("/v1/completions", s.openAICompletion)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			fmt.Printf("request: %s %s X-Request-ID=%s\n", r.Method, r.URL.Path, r.Header.Get("X-Request-ID"))
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+type server struct {
+	opts *Options
+}
+
+func (s *server) health(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// decode reads the JSON body into v, answering 400 if that fails.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// result is the final completion result, a subset of the real one.
+func (s *server) result(content, prompt string, slot, predicted int) map[string]interface{} {
+	return map[string]interface{}{
+		"content":          content,
+		"model":            s.opts.Alias,
+		"prompt":           prompt,
+		"id_slot":          slot,
+		"stop":             true,
+		"stopped_eos":      false,
+		"stopped_limit":    true,
+		"stopped_word":     false,
+		"stopping_word":    "",
+		"tokens_cached":    0,
+		"tokens_evaluated": len(prompt),
+		"tokens_predicted": predicted,
+		"truncated":        false,
+		"timings": map[string]interface{}{
+			"prompt_n":     len(prompt),
+			"prompt_ms":    float64(len(prompt)),
+			"predicted_n":  predicted,
+			"predicted_ms": float64(10 * predicted),
+		},
+		"generation_settings": map[string]interface{}{
+			"model":     s.opts.Alias,
+			"n_predict": predicted,
+		},
+	}
+}
+
+func (s *server) completion(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Prompt   interface{} `json:"prompt"`
+		NPredict *int        `json:"n_predict"`
+		Stream   bool        `json:"stream"`
+		IDSlot   *int        `json:"id_slot"`
+		SlotID   *int        `json:"slot_id"` //older servers
+		Grammar  string      `json:"grammar"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	prompt := fmt.Sprint(req.Prompt)
+	if s, ok := req.Prompt.(string); ok {
+		prompt = s
+	}
+	if prompt == CrashPrompt {
+		os.Exit(3)
+	}
+	if prompt == SlowPrompt {
+		time.Sleep(SlowDelay)
+	}
+	n := 4
+	if req.NPredict != nil && *req.NPredict >= 0 {
+		n = *req.NPredict
+	}
+	slot := 0
+	for _, id := range []*int{req.IDSlot, req.SlotID} {
+		if id != nil && *id >= 0 {
+			slot = *id
+		}
+	}
+	if slot >= s.opts.Parallel {
+		http.Error(w, fmt.Sprintf("slot %d does not exist", slot), http.StatusBadRequest)
+		return
+	}
+
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf(" tok%d", i)
+	}
+	if req.Grammar != "" {
+		if err := grammar.Check(req.Grammar); err != nil {
+			http.Error(w, "failed to parse grammar: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		tokens = []string{prompt}
+	}
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.result(strings.Join(tokens, ""), prompt, slot, n))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	for _, tok := range tokens {
+		data, _ := json.Marshal(map[string]interface{}{"content": tok, "stop": false, "id_slot": slot})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	data, _ := json.Marshal(s.result("", prompt, slot, n))
+	fmt.Fprintf(w, "data: %s\n\n", data)
+}
+
+func (s *server) infill(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		InputPrefix string `json:"input_prefix"`
+		InputSuffix string `json:"input_suffix"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.result(req.InputPrefix+"<fill>"+req.InputSuffix, "", 0, 1))
+}
+
+func (s *server) tokenize(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Content string `json:"content"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	tokens := make([]int, len(req.Content))
+	for i := 0; i < len(req.Content); i++ {
+		tokens[i] = int(req.Content[i])
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tokens": tokens})
+}
+
+func (s *server) detokenize(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Tokens []int `json:"tokens"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	content := make([]byte, len(req.Tokens))
+	for i, t := range req.Tokens {
+		content[i] = byte(t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"content": string(content)})
+}
+
+func (s *server) embedding(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Content string `json:"content"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if !s.opts.Embedding {
+		http.Error(w, "embedding is disabled, start the server with --embedding", http.StatusNotImplemented)
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(req.Content))
+	seed := h.Sum64()
+	embedding := make([]float64, 8)
+	for i := range embedding {
+		embedding[i] = float64((seed>>(8*i))&0xff)/255*2 - 1
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"embedding": embedding})
+}
+
+func (s *server) openAIModels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"object": "list",
+		"data":   []map[string]string{{"id": s.opts.Alias, "object": "model"}},
+	})
+}
+
+// openAIChunk is an OpenAI completion, or a stream chunk of one if usage is
+// nil.
+func openAIChunk(model, text string, finishReason interface{}, usage map[string]int) map[string]interface{} {
+	c := map[string]interface{}{
+		"object":  "text_completion",
+		"model":   model,
+		"choices": []map[string]interface{}{{"index": 0, "text": text, "finish_reason": finishReason}},
+	}
+	if usage != nil {
+		c["usage"] = usage
+	}
+	return c
+}
+
+func (s *server) openAICompletion(w http.ResponseWriter, r *http.Request) {
+	req := struct {
+		Model     string `json:"model"`
+		Prompt    string `json:"prompt"`
+		MaxTokens *int   `json:"max_tokens"`
+		Stream    bool   `json:"stream"`
+	}{}
+	if !decode(w, r, &req) {
+		return
+	}
+	n := 4
+	if req.MaxTokens != nil {
+		n = *req.MaxTokens
+	}
+	tokens := make([]string, n)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf(" tok%d", i)
+	}
+	usage := map[string]int{"prompt_tokens": len(req.Prompt), "completion_tokens": n, "total_tokens": len(req.Prompt) + n}
+	if !req.Stream {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(openAIChunk(req.Model, strings.Join(tokens, ""), "length", usage))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	for _, tok := range tokens {
+		data, _ := json.Marshal(openAIChunk(req.Model, tok, nil, nil))
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	data, _ := json.Marshal(openAIChunk(req.Model, "", "length", usage))
+	fmt.Fprintf(w, "data: %s\n\ndata: [DONE]\n\n", data)
+}
@@ -0,0 +1,161 @@
+package chatterbox
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader carries the id correlating a client request with the
+// access log, the runner it was sent to and the runner's log lines. A valid
+// id sent by the client is kept, otherwise one is generated.
+const RequestIDHeader = "X-Request-ID"
+
+// accessLog writes one JSON line per request, whatever format the rest of the
+// log uses.
+var accessLog = logrus.New()
+
+// ConfigureLogging sets the format ("text" or "json") of the server log and
+// the level of both the server and the access log.
+func ConfigureLogging(format, level string) error {
+	switch format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(lvl)
+	accessLog.SetLevel(lvl)
+	return nil
+}
+
+type requestIDKey struct{}
+
+// requestID returns the id of the request ctx belongs to, "" if it has none.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID accepts up to 128 printable ASCII characters, so client
+// ids can't forge log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// statusRecorder remembers what a handler answered, for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	errMsg strings.Builder //start of a plain text error body
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") && w.errMsg.Len() < 512 {
+		w.errMsg.Write(p[:min(len(p), 512-w.errMsg.Len())])
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps event streams working through the recorder.
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking is not supported")
+	}
+	return h.Hijack()
+}
+
+// logRequests assigns every request its id, sets it on the request (so it is
+// forwarded upstream) and on the response, and writes the access log line.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = randomID("")
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		fields := logrus.Fields{
+			"request_id":  id,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      rec.status,
+			"bytes":       rec.bytes,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"remote_addr": r.RemoteAddr,
+		}
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			fields["trace_id"] = sc.TraceID().String()
+		}
+		if ua := r.UserAgent(); ua != "" {
+			fields["user_agent"] = ua
+		}
+		for name, header := range map[string]string{"backend": BackendHeader, "replica": ReplicaHeader, "worker": WorkerHeader, "cache": CacheHeader} {
+			if value := w.Header().Get(header); value != "" {
+				fields[name] = value
+			}
+		}
+		if msg := strings.TrimSpace(rec.errMsg.String()); msg != "" {
+			fields["error"] = msg
+		}
+		entry := accessLog.WithFields(fields)
+		switch {
+		case rec.status >= 500:
+			entry.Error("request")
+		case rec.status >= 400:
+			entry.Warn("request")
+		default:
+			entry.Info("request")
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package chatterbox
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// ReplicaHeader reports the replica that served a request. Clients can send
+// it back to pin follow-up requests to the same replica.
+const ReplicaHeader = "X-Chatterbox-Replica"
+
+// Pool is the set of replica runners serving one model name.
+type Pool struct {
+	Config   *types.Model_Request
+	Konfig   *types.Model_Request //Config before merging the konfigs it extends, what savetofile stores
+	Revision int                  //konfig revision the pool was loaded from, 0 if the konfig came with the request
+
+	mu      sync.RWMutex
+	runners []*Runner
+	next    uint32
+	retired bool //replaced by a reload, Pick returns nothing
+}
+
+// Affinity carries the parts of a request that tie it to a replica.
+type Affinity struct {
+	Replica int    //replica pinned with ReplicaHeader, -1 if none
+	Slot    int    //requested slot id, -1 if none
+	Key     string //prompt prefix of cache_prompt requests
+}
+
+func NewPool(config *types.Model_Request, runners []*Runner) *Pool {
+	return &Pool{Config: config, runners: runners}
+}
+
+// Runners returns the replicas that are still running.
+func (p *Pool) Runners() []*Runner {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Runner(nil), p.runners...)
+}
+
+// remove drops r from the pool and reports whether it was part of it and
+// how many replicas are left.
+func (p *Pool) remove(r *Runner) (bool, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, runner := range p.runners {
+		if runner == r {
+			p.runners = append(p.runners[:i], p.runners[i+1:]...)
+			return true, len(p.runners)
+		}
+	}
+	return false, len(p.runners)
+}
+
+func (p *Pool) replica(index int) *Runner {
+	for _, r := range p.runners {
+		if r.Replica == index {
+			return r
+		}
+	}
+	return nil
+}
+
+// Pick returns the replica for a request and the slot id to forward to it.
+// The replica is acquired for the request id under the pool's lock, so a
+// reload can't drain and stop it before the request is counted; the caller
+// must Release it. A retired pool returns no replica.
+//
+// Slot ids are global across the pool: replica i owns the slots
+// i*parallelSlots .. (i+1)*parallelSlots-1, and the slot id is translated to
+// the replica's local id. Requests pinned with ReplicaHeader keep their slot
+// id. cache_prompt requests without a slot go to the replica chosen by their
+// prompt prefix, so they hit the same KV cache. Everything else goes to the
+// ready replica with the least outstanding requests.
+func (p *Pool) Pick(aff Affinity, id string) (*Runner, int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.retired {
+		return nil, -1
+	}
+	r, slot := p.pick(aff)
+	if r != nil {
+		r.Acquire(id)
+	}
+	return r, slot
+}
+
+func (p *Pool) pick(aff Affinity) (*Runner, int) {
+	if aff.Replica >= 0 {
+		if r := p.replica(aff.Replica); r != nil {
+			return r, aff.Slot
+		}
+	}
+	replicas := max(p.Config.Replicas, 1)
+	if aff.Slot >= 0 {
+		slots := max(p.Config.ParallelSlots, 1)
+		if r := p.replica(aff.Slot / slots % replicas); r != nil {
+			return r, aff.Slot % slots
+		}
+	} else if aff.Key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(aff.Key))
+		if r := p.replica(int(h.Sum32() % uint32(replicas))); r != nil {
+			return r, -1
+		}
+	}
+
+	//start at a rotating offset so ties are spread over the replicas
+	var best *Runner
+	offset := int(atomic.AddUint32(&p.next, 1))
+	for i := range p.runners {
+		r := p.runners[(offset+i)%len(p.runners)]
+		switch {
+		case best == nil:
+			best = r
+		case r.Ready() != best.Ready():
+			if r.Ready() {
+				best = r
+			}
+		case r.InFlight() < best.InFlight():
+			best = r
+		}
+	}
+	return best, -1
+}
+
+// retire stops Pick from handing out replicas. Once it returns, every
+// request picked from the pool is counted by InFlight.
+func (p *Pool) retire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.retired = true
+}
+
+// Retired reports whether the pool was replaced by a reload.
+func (p *Pool) Retired() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.retired
+}
+
+// Drain waits for all replicas to finish their in-flight requests.
+func (p *Pool) Drain(timeout time.Duration) bool {
+	drained := true
+	deadline := time.Now().Add(timeout)
+	for _, r := range p.Runners() {
+		if !r.Drain(time.Until(deadline)) {
+			drained = false
+		}
+	}
+	return drained
+}
+
+// Stop terminates all replicas.
+func (p *Pool) Stop() {
+	for _, r := range p.Runners() {
+		r.Stop()
+	}
+}
+
+// InFlight returns the number of requests in flight across all replicas.
+func (p *Pool) InFlight() int64 {
+	var n int64
+	for _, r := range p.Runners() {
+		n += r.InFlight()
+	}
+	return n
+}
@@ -0,0 +1,98 @@
+package chatterbox
+
+import (
+	"testing"
+
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// testPool returns a pool of three replicas with two slots each, with the
+// given readiness and requests in flight per replica.
+func testPool(ready []bool, inflight []int64) *Pool {
+	config := &types.Model_Request{ModelName: "m", Replicas: 3, ParallelSlots: 2}
+	runners := []*Runner{}
+	for i := range ready {
+		r := &Runner{Config: config, Replica: i, requests: map[string]int{}, inflight: inflight[i]}
+		if ready[i] {
+			r.ready = 1
+		}
+		runners = append(runners, r)
+	}
+	return NewPool(config, runners)
+}
+
+func Test_PoolPick(t *testing.T) {
+	allReady := []bool{true, true, true}
+	idle := []int64{0, 0, 0}
+	for _, tc := range []struct {
+		name        string
+		ready       []bool
+		inflight    []int64
+		aff         Affinity
+		wantReplica int
+		wantSlot    int
+	}{
+		{"pinned replica keeps its slot", allReady, idle, Affinity{Replica: 2, Slot: 1}, 2, 1},
+		{"unknown pinned replica is balanced", allReady, []int64{1, 0, 1}, Affinity{Replica: 7, Slot: -1}, 1, -1},
+		{"global slot", allReady, idle, Affinity{Replica: -1, Slot: 3}, 1, 1},
+		{"slot out of range wraps", allReady, idle, Affinity{Replica: -1, Slot: 9}, 1, 1},
+		{"least in flight", allReady, []int64{3, 1, 2}, Affinity{Replica: -1, Slot: -1}, 1, -1},
+		{"ready before idle", []bool{false, true, false}, []int64{0, 5, 0}, Affinity{Replica: -1, Slot: -1}, 1, -1},
+		{"all unready", []bool{false, false, false}, []int64{2, 2, 0}, Affinity{Replica: -1, Slot: -1}, 2, -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pool := testPool(tc.ready, tc.inflight)
+			r, slot := pool.Pick(tc.aff, "req")
+			if r == nil {
+				t.Fatal("no replica picked")
+			}
+			if r.Replica != tc.wantReplica || slot != tc.wantSlot {
+				t.Errorf("picked replica %d slot %d, want replica %d slot %d", r.Replica, slot, tc.wantReplica, tc.wantSlot)
+			}
+			if r.InFlight() != tc.inflight[r.Replica]+1 {
+				t.Errorf("picked replica not acquired, %d in flight", r.InFlight())
+			}
+		})
+	}
+}
+
+func Test_PoolPickKeyAffinity(t *testing.T) {
+	pool := testPool([]bool{true, true, true}, []int64{0, 0, 0})
+	seen := map[int]bool{}
+	for _, key := range []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta"} {
+		first, _ := pool.Pick(Affinity{Replica: -1, Slot: -1, Key: key}, "")
+		for i := 0; i < 5; i++ {
+			//load on the chosen replica doesn't move the key
+			if r, _ := pool.Pick(Affinity{Replica: -1, Slot: -1, Key: key}, ""); r != first {
+				t.Fatalf("key %q moved from replica %d to %d", key, first.Replica, r.Replica)
+			}
+		}
+		seen[first.Replica] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("all keys went to the same replica")
+	}
+}
+
+func Test_PoolPickBalances(t *testing.T) {
+	pool := testPool([]bool{true, true, true}, []int64{0, 0, 0})
+	for i := 0; i < 30; i++ {
+		pool.Pick(Affinity{Replica: -1, Slot: -1}, "")
+	}
+	for _, r := range pool.Runners() {
+		if r.InFlight() != 10 {
+			t.Errorf("replica %d has %d requests in flight, want 10", r.Replica, r.InFlight())
+		}
+	}
+}
+
+func Test_PoolPickRetired(t *testing.T) {
+	pool := testPool([]bool{true, true, true}, []int64{0, 0, 0})
+	pool.retire()
+	if r, _ := pool.Pick(Affinity{Replica: 0, Slot: -1}, ""); r != nil {
+		t.Errorf("retired pool picked replica %d", r.Replica)
+	}
+	if pool.InFlight() != 0 {
+		t.Errorf("retired pool has %d requests in flight", pool.InFlight())
+	}
+}
@@ -0,0 +1,124 @@
+package chatterbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// loadKonfigRevision loads revision rev of a konfig. An empty rev or
+// "current" loads the konfig file itself.
+func (s *Server) loadKonfigRevision(konfigname, rev string) (*types.Model_Request, error) {
+	config := types.NewModelRequestWithDefaults()
+	if rev == "" || rev == "current" {
+		return config, config.Load(s.Konfigs, konfigname)
+	}
+	n, err := strconv.Atoi(rev)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid revision %q", rev)
+	}
+	return config, config.LoadRevision(s.Konfigs, konfigname, n)
+}
+
+// latestRevision returns the newest revision of a konfig, 0 if it has none.
+func (s *Server) latestRevision(konfigname string) int {
+	revs, err := s.Konfigs.Revisions(konfigname)
+	if err != nil {
+		return 0
+	}
+	latest := 0
+	for _, rev := range revs {
+		latest = max(latest, rev.Rev)
+	}
+	return latest
+}
+
+func (s *Server) getRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the konfig value from the path
+	vars := mux.Vars(r)
+	konfigname := vars["konfig"]
+
+	revs, err := s.Konfigs.Revisions(konfigname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(revs)
+}
+
+func (s *Server) getRevisionHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the konfig and revision values from the path
+	vars := mux.Vars(r)
+	konfigname := vars["konfig"]
+
+	config, err := s.loadKonfigRevision(konfigname, vars["rev"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(config)
+}
+
+// diffRevisionsHandler compares two revisions given as ?from=&to=.
+// A missing "to" compares against the current konfig.
+func (s *Server) diffRevisionsHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the konfig value from the path
+	vars := mux.Vars(r)
+	konfigname := vars["konfig"]
+
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		http.Error(w, "Missing 'from' parameter", http.StatusBadRequest)
+		return
+	}
+	a, err := s.loadKonfigRevision(konfigname, from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	b, err := s.loadKonfigRevision(konfigname, r.URL.Query().Get("to"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	diffs, err := types.Diff(a, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(diffs)
+}
+
+// rollbackKonfigHandler saves an earlier revision as the current konfig.
+// This adds a new revision, so the rollback itself can be undone.
+func (s *Server) rollbackKonfigHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the konfig and revision values from the path
+	vars := mux.Vars(r)
+	konfigname := vars["konfig"]
+
+	config, err := s.loadKonfigRevision(konfigname, vars["rev"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	config.ModelName = konfigname
+	if _, err := s.resolveKonfig(config); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	err = config.Save(s.Konfigs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.Catalog.Rescan()
+	s.Events.Publish(EventKonfigSaved, KonfigEvent{Konfig: konfigname})
+	json.NewEncoder(w).Encode(config)
+}
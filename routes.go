@@ -0,0 +1,166 @@
+package chatterbox
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// BackendHeader reports which model actually served a proxied request.
+const BackendHeader = "X-Chatterbox-Backend"
+
+// routeTarget returns the model serving name. Routes take precedence over
+// loaded models, so a route may shadow a model of the same name and send part
+// of its traffic elsewhere. A route's target is picked by weight among those
+// loaded here or on a worker; it reports false if none is.
+func (s *Server) routeTarget(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rt, ok := s.routes[name]
+	if !ok {
+		return name, true
+	}
+
+	weights := rt.Weights()
+	candidates := []string{}
+	candidateWeights := []int{}
+	total := 0
+	for i, t := range rt.Targets {
+		if weights[i] > 0 && s.servedLocked(t.Model) {
+			candidates = append(candidates, t.Model)
+			candidateWeights = append(candidateWeights, weights[i])
+			total += weights[i]
+		}
+	}
+	if total == 0 {
+		return "", false
+	}
+	n := rand.Intn(total)
+	for i, w := range candidateWeights {
+		if n < w {
+			return candidates[i], true
+		}
+		n -= w
+	}
+	return "", false
+}
+
+// servedLocked reports whether model is loaded here or on a worker. s.mu
+// must be held.
+func (s *Server) servedLocked(model string) bool {
+	if _, ok := s.LoadedModels[model]; ok {
+		return true
+	}
+	for _, worker := range s.workers {
+		if worker.HasModel(model) {
+			return true
+		}
+	}
+	return false
+}
+
+// routePool returns the pool for name following routes, and the model the
+// route picked. If that model isn't loaded here, the pool is nil and the
+// model may be on a worker.
+func (s *Server) routePool(name string) (*Pool, string, bool) {
+	target, ok := s.routeTarget(name)
+	if !ok {
+		return nil, "", false
+	}
+	p, ok := s.pool(target)
+	return p, target, ok
+}
+
+func (s *Server) getRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	routes := make([]*types.Route, 0, len(s.routes))
+	for _, rt := range s.routes {
+		routes = append(routes, rt)
+	}
+	s.mu.RUnlock()
+	json.NewEncoder(w).Encode(routes)
+}
+
+func (s *Server) getRouteHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the route name from the path
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	s.mu.RLock()
+	rt, ok := s.routes[name]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(rt)
+}
+
+func (s *Server) saveRouteHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the route name from the path
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	rt := &types.Route{}
+	err := json.NewDecoder(r.Body).Decode(rt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rt.Name = name
+	if err := rt.Validate(); err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	old := s.routes[name]
+	s.routes[name] = rt
+	err = types.SaveRoutes(s.routesPath, s.routes)
+	if err != nil {
+		if old != nil {
+			s.routes[name] = old
+		} else {
+			delete(s.routes, name)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.Events.Publish(EventRouteSaved, rt)
+	w.Write([]byte("Route saved"))
+}
+
+func (s *Server) deleteRouteHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the route name from the path
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	s.mu.Lock()
+	old, ok := s.routes[name]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "Route not found", http.StatusNotFound)
+		return
+	}
+	delete(s.routes, name)
+	err := types.SaveRoutes(s.routesPath, s.routes)
+	if err != nil {
+		s.routes[name] = old
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.Events.Publish(EventRouteDeleted, old)
+	w.Write([]byte("Route deleted"))
+}
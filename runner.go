@@ -1,11 +1,15 @@
 package chatterbox
 
 import (
+	"bytes"
 	"context"
 	"fmt"
-	"os"
 	"os/exec"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/schnapper79/chatterbox/types"
 )
@@ -14,72 +18,243 @@ type Runner struct {
 	cmd       *exec.Cmd
 	Cancel    context.CancelFunc
 	ErrorChan chan error
-	LogChan   chan string
+	LogChan   chan RunnerLog
 	Config    *types.Model_Request
+	Replica   int
+	Backend   Backend
+
+	ctx      context.Context
+	done     chan struct{}
+	inflight int64
+	ready    int32
+	requests map[string]int //ids of the requests in flight, or just finished
+	mu       sync.Mutex
+}
+
+// RunnerLog is a line of the runner's output with the ids of the requests in
+// flight when it was read.
+type RunnerLog struct {
+	Text       string
+	RequestIDs []string
+}
+
+// logWriter splits the runner's output into lines for LogChan.
+type logWriter struct {
+	runner *Runner
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		w.send(string(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+	}
 }
 
-func NewRunner(ctx context.Context, Cancel context.CancelFunc, llamaPath, ModelPath string, config *types.Model_Request) *Runner {
+func (w *logWriter) send(line string) {
+	line = strings.TrimSpace(line)
+	if line != "" {
+		w.runner.LogChan <- RunnerLog{Text: line, RequestIDs: w.runner.RequestIDs()}
+	}
+}
+
+// BuildArgs returns the llama.cpp server arguments for config, sorted by flag.
+func BuildArgs(ModelPath string, config *types.Model_Request) ([]string, error) {
 	// Convert args map to string slice
 	args := config.ToMap()
-	args["--model"] = ModelPath + "/" + config.Model
+	// Files referenced by the konfig must live inside the model directory
+	files := map[string]string{
+		"--model":              config.Model,
+		"--lora":               config.LoraAdapter,
+		"--lora-base":          config.LoraBase,
+		"--system-prompt-file": config.SystemPromtFile,
+	}
+	for flag, name := range files {
+		if name == "" {
+			continue
+		}
+		path, err := types.SafeJoin(ModelPath, name)
+		if err != nil {
+			return nil, err
+		}
+		args[flag] = path
+	}
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
 	var argSlice []string
-	for k, v := range args {
-		if v == "" {
+	for _, k := range keys {
+		if args[k] == "" {
 			argSlice = append(argSlice, k)
 		} else {
-			argSlice = append(argSlice, k, v)
+			argSlice = append(argSlice, k, args[k])
 		}
 	}
+	return argSlice, nil
+}
 
-	cmd := exec.CommandContext(ctx, fmt.Sprintf("%s/server", llamaPath), argSlice...)
-	logger.Info("Starting server with args: ", strings.Join(cmd.Args, " "))
-	return &Runner{
-		cmd:       cmd,
+// NewRunner prepares the backend selected by config for one replica. Backends
+// without a local process get a runner that only lives until it is stopped.
+func NewRunner(ctx context.Context, Cancel context.CancelFunc, llamaPath, ModelPath string, config *types.Model_Request, replica int) (*Runner, error) {
+	backend, err := backendFor(config)
+	if err != nil {
+		return nil, err
+	}
+	runner := &Runner{
 		Cancel:    Cancel,
 		ErrorChan: make(chan error, 1),
-		LogChan:   make(chan string, 100), // Buffer of 100, adjust as needed
+		LogChan:   make(chan RunnerLog, 100), // Buffer of 100, adjust as needed
 		Config:    config,
+		Replica:   replica,
+		Backend:   backend,
+		ctx:       ctx,
+		done:      make(chan struct{}),
+		requests:  map[string]int{},
+	}
+
+	executable := backend.Executable(llamaPath)
+	if executable == "" {
+		logger.Infof("Using %s upstream %s for %s", config.Backend, backend.BaseURL(config), config.ModelName)
+		return runner, nil
+	}
+	argSlice, err := backend.Args(ModelPath, config)
+	if err != nil {
+		return nil, err
 	}
+	command := append(config.PinCommand(replica), executable)
+	runner.cmd = exec.CommandContext(ctx, command[0], append(command[1:], argSlice...)...)
+	logger.Info("Starting server with args: ", strings.Join(runner.cmd.Args, " "))
+	return runner, nil
 }
 
 func (r *Runner) Run() error {
-	/*var stdout, stderr bytes.Buffer
-	r.cmd.Stdout = &stdout
-	r.cmd.Stderr = &stderr
-	*/
-	r.cmd.Stdout = os.Stdout
-	r.cmd.Stderr = os.Stderr
+	if r.cmd == nil {
+		go func() {
+			<-r.ctx.Done()
+			close(r.done)
+			close(r.LogChan)
+			close(r.ErrorChan)
+		}()
+		return nil
+	}
+	//Stdout and Stderr are the same writer, so exec never calls it concurrently
+	output := &logWriter{runner: r}
+	r.cmd.Stdout = output
+	r.cmd.Stderr = output
 	if err := r.cmd.Start(); err != nil {
 		return err
 	}
-	/*
-		go func() {
-			for {
-				line, err := stdout.ReadString('\n')
-				if err != nil {
-					break
-				}
-				r.LogChan <- strings.TrimSpace(line)
-			}
-		}()
-
-		go func() {
-			for {
-				line, err := stderr.ReadString('\n')
-				if err != nil {
-					break
-				}
-				r.LogChan <- strings.TrimSpace(line)
-			}
-		}()
-	*/
 	go func() {
 		if err := r.cmd.Wait(); err != nil {
 			r.ErrorChan <- err
-			close(r.LogChan)
-			close(r.ErrorChan)
-			return
 		}
+		output.send(string(output.buf))
+		close(r.done)
+		close(r.LogChan)
+		close(r.ErrorChan)
 	}()
 	return nil
 }
+
+// WaitReady polls the backend's health check until it reports ready, the
+// runner exits or ctx is done.
+func (r *Runner) WaitReady(ctx context.Context) error {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if err := r.Backend.Health(ctx, r.Config); err == nil {
+			atomic.StoreInt32(&r.ready, 1)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.done:
+			return fmt.Errorf("runner for %s exited before becoming ready", r.Config.ModelName)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Ready reports whether WaitReady has seen the server become ready.
+func (r *Runner) Ready() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// Acquire marks a request as in flight on this runner. id is the request's
+// id, "" if it has none.
+func (r *Runner) Acquire(id string) {
+	atomic.AddInt64(&r.inflight, 1)
+	if id != "" {
+		r.mu.Lock()
+		r.requests[id]++
+		r.mu.Unlock()
+	}
+}
+
+// requestLogLinger is how long log lines are still attributed to a finished
+// request: llama.cpp logs a request after answering it, and its output
+// reaches us later than the answer.
+const requestLogLinger = 500 * time.Millisecond
+
+// Release marks an in-flight request as finished.
+func (r *Runner) Release(id string) {
+	atomic.AddInt64(&r.inflight, -1)
+	if id != "" {
+		time.AfterFunc(requestLogLinger, func() {
+			r.mu.Lock()
+			if r.requests[id]--; r.requests[id] <= 0 {
+				delete(r.requests, id)
+			}
+			r.mu.Unlock()
+		})
+	}
+}
+
+// RequestIDs returns the sorted ids of the requests in flight or finished
+// within requestLogLinger.
+func (r *Runner) RequestIDs() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]string, 0, len(r.requests))
+	for id := range r.requests {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// InFlight returns the number of requests currently proxied to this runner.
+func (r *Runner) InFlight() int64 {
+	return atomic.LoadInt64(&r.inflight)
+}
+
+// Drain waits until no requests are in flight or the timeout expires.
+func (r *Runner) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for r.InFlight() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+// Stop terminates the backend process.
+func (r *Runner) Stop() {
+	r.Cancel()
+}
+
+// Done is closed once the backend process has exited or the runner was stopped.
+func (r *Runner) Done() <-chan struct{} {
+	return r.done
+}
@@ -0,0 +1,394 @@
+package chatterbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// session serializes the turns of one conversation.
+type session struct {
+	mu      sync.Mutex
+	deleted bool //removed while a message waited for mu, must not be saved again
+	*types.Session
+}
+
+// errPromptTooLong is returned when even the shortest possible prompt of a
+// session doesn't fit into the context.
+var errPromptTooLong = fmt.Errorf("Prompt doesn't fit into the context even after trimming old messages")
+
+// assignSlot returns the global slot of model used by the fewest sessions.
+// Must be called with s.mu held.
+func (s *Server) assignSlot(model string, config *types.Model_Request) int {
+	slots := max(config.Replicas, 1) * max(config.ParallelSlots, 1)
+	used := make([]int, slots)
+	for _, sess := range s.sessions {
+		if sess.Model == model && sess.Slot < slots {
+			used[sess.Slot]++
+		}
+	}
+	best := 0
+	for slot, n := range used {
+		if n < used[best] {
+			best = slot
+		}
+	}
+	return best
+}
+
+// promptFit is a prompt rendered from a chat, trimmed to fit a slot.
+type promptFit struct {
+	Prompt  string
+	Tokens  int
+	Trimmed int
+}
+
+// fitChat renders chat with the konfig's chat template, leaving out the oldest
+// messages until the prompt and reserve tokens for the answer fit into one
+// slot's context. Leading system messages and the messages within the first
+// nKeep tokens are always kept, with nKeep -1 nothing is left out. The last
+// message is never left out, and a window never starts with an assistant
+// message. Backends that can't tokenize get the whole chat and trim it
+// themselves.
+func fitChat(ctx context.Context, runner *Runner, chat []types.ChatMessage, nKeep, reserve int) (*promptFit, error) {
+	config := runner.Config
+	if _, ok := runner.Backend.Endpoint("/tokenize"); !ok {
+		prompt, err := types.RenderChat(config.ChatTemplate, chat)
+		if err != nil {
+			return nil, err
+		}
+		return &promptFit{Prompt: prompt}, nil
+	}
+	count := func(msgs []types.ChatMessage) (*promptFit, error) {
+		prompt, err := types.RenderChat(config.ChatTemplate, msgs)
+		if err != nil {
+			return nil, err
+		}
+		tokens, err := tokenize(ctx, runner, prompt)
+		if err != nil {
+			return nil, err
+		}
+		return &promptFit{Prompt: prompt, Tokens: len(tokens), Trimmed: len(chat) - len(msgs)}, nil
+	}
+
+	full, err := count(chat)
+	if err != nil {
+		return nil, err
+	}
+	//without a context size we can't know what fits
+	if config.ContextSize == 0 {
+		return full, nil
+	}
+	budget := config.ContextSize/max(config.ParallelSlots, 1) - reserve
+	if full.Tokens <= budget {
+		return full, nil
+	}
+
+	kept := 0
+	for kept < len(chat)-1 && chat[kept].Role == "system" {
+		kept++
+	}
+	if nKeep < 0 {
+		return nil, errPromptTooLong
+	}
+	for nKeep > 0 && kept < len(chat)-1 {
+		prefix, err := count(chat[:kept+1])
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Tokens > nKeep {
+			break
+		}
+		kept++
+	}
+
+	// window drops the k oldest messages after the kept ones
+	window := func(k int) []types.ChatMessage {
+		for kept+k < len(chat)-1 && chat[kept+k].Role == "assistant" {
+			k++
+		}
+		return append(chat[:kept:kept], chat[kept+k:]...)
+	}
+	droppable := len(chat) - 1 - kept
+	shortest, err := count(window(droppable))
+	if err != nil {
+		return nil, err
+	}
+	if shortest.Tokens > budget {
+		return nil, errPromptTooLong
+	}
+	// the token count shrinks with every dropped message, so search for the
+	// fewest dropped messages that fit; best always matches window(hi)
+	lo, hi := 1, droppable
+	best := shortest
+	for lo < hi {
+		mid := (lo + hi) / 2
+		fit, err := count(window(mid))
+		if err != nil {
+			return nil, err
+		}
+		if fit.Tokens <= budget {
+			hi, best = mid, fit
+		} else {
+			lo = mid + 1
+		}
+	}
+	return best, nil
+}
+
+func (s *Server) getSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for _, sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.mu.RUnlock()
+
+	list := make([]types.Session, len(sessions))
+	for i, sess := range sessions {
+		sess.mu.Lock()
+		list[i] = *sess.Session
+		sess.mu.Unlock()
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func (s *Server) createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	req := &types.Session_Request{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Params != nil {
+		if err := req.Params.Validate(0); err != nil {
+			writeRequestError(w, err)
+			return
+		}
+	}
+	id, err := types.NewSessionID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	//sessions are pinned to slots, so they need a model and not a route
+	s.mu.Lock()
+	pool, ok := s.LoadedModels[req.Model]
+	if !ok {
+		s.mu.Unlock()
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	sess := &session{Session: &types.Session{
+		ID:       id,
+		Model:    req.Model,
+		System:   req.System,
+		Params:   req.Params,
+		Slot:     s.assignSlot(req.Model, pool.Config),
+		Messages: []types.ChatMessage{},
+		Created:  now,
+		Updated:  now,
+	}}
+	s.sessions[id] = sess
+	s.mu.Unlock()
+
+	if err := sess.Save(s.sessionsPath); err != nil {
+		s.mu.Lock()
+		delete(s.sessions, id)
+		s.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sess.Session)
+}
+
+func (s *Server) getSession(id string) (*session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sess, ok := s.sessions[id]
+	return sess, ok
+}
+
+func (s *Server) getSessionHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the session id from the path
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	sess, ok := s.getSession(id)
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.deleted {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(sess.Session)
+}
+
+func (s *Server) deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the session id from the path
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	s.mu.Lock()
+	sess, ok := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	//a message in flight saves the session before the file is removed,
+	//messages still waiting see it is gone
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.deleted = true
+	if err := types.DeleteSession(s.sessionsPath, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("Session deleted"))
+}
+
+// sessionParams returns the sampling parameters of a turn: the konfig's
+// defaults overridden by the session's parameters.
+func sessionParams(config *types.Model_Request, sess *types.Session) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for _, layer := range []*types.Prediction_Request{config.Defaults, sess.Params} {
+		if layer == nil {
+			continue
+		}
+		for name, value := range layer.SetFields() {
+			fields[name] = value
+		}
+	}
+	return fields
+}
+
+// sessionMessageHandler appends a user message to the session, asks the model
+// for the answer on the session's slot and appends that too.
+func (s *Server) sessionMessageHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the session id from the path
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	req := &types.SessionMessage_Request{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Content == "" {
+		http.Error(w, "content is required", http.StatusBadRequest)
+		return
+	}
+
+	sess, ok := s.getSession(id)
+	if !ok {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if sess.deleted {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	pool, ok := s.pool(sess.Model)
+	if !ok {
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
+	}
+	audit := s.startAudit(r, sess.Model, pool)
+	w = audit.track(w)
+	defer audit.done()
+
+	pool, runner, slot := s.pick(pool, Affinity{Replica: -1, Slot: sess.Slot}, requestID(r.Context()))
+	if runner == nil {
+		http.Error(w, "No replica available", http.StatusServiceUnavailable)
+		return
+	}
+	defer runner.Release(requestID(r.Context()))
+
+	fields := sessionParams(runner.Config, sess.Session)
+	//llama.cpp only knows raw grammars
+	name, _ := fields["grammar_name"].(string)
+	format, _ := fields["response_format"].(*types.ResponseFormat)
+	gbnf, _, err := s.resolveGrammar(name, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if gbnf != "" {
+		fields["grammar"] = gbnf
+	}
+	delete(fields, "grammar_name")
+	delete(fields, "response_format")
+	nKeep, _ := fields["n_keep"].(int)
+	reserve, _ := fields["n_predict"].(int)
+	if limit := s.nPredictCap(runner.Config); limit > 0 && (reserve <= 0 || reserve > limit) {
+		reserve = limit
+		fields["n_predict"] = limit
+	}
+	if reserve <= 0 {
+		//unlimited answers still need room, keep a quarter of the slot
+		reserve = runner.Config.ContextSize / max(runner.Config.ParallelSlots, 1) / 4
+	}
+
+	user := types.ChatMessage{Role: "user", Content: req.Content}
+	chat := append(sess.Chat(), user)
+	fit, err := fitChat(r.Context(), runner, chat, nKeep, reserve)
+	if err == errPromptTooLong {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	stop, _ := fields["stop"].([]string)
+	fields["stop"] = append(append([]string{}, stop...), types.ChatStop(runner.Config.ChatTemplate)...)
+	fields["prompt"] = fit.Prompt
+	fields["id_slot"] = slot
+	fields["cache_prompt"] = true
+	fields["stream"] = false
+
+	data, _ := json.Marshal(fields)
+	audit.setRequest(data)
+	result := &types.Result{}
+	if err := callRunner(r.Context(), runner, "/completion", fields, result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	audit.setResult(result)
+	answer := types.ChatMessage{Role: "assistant", Content: strings.TrimSpace(result.Content)}
+
+	sess.Messages = append(sess.Messages, user, answer)
+	sess.Updated = time.Now()
+	if err := sess.Save(s.sessionsPath); err != nil {
+		logger.Error("Saving session failed: ", err)
+	}
+
+	w.Header().Set(BackendHeader, runner.Config.ModelName)
+	json.NewEncoder(w).Encode(&types.SessionMessage_Response{
+		Message: answer,
+		Tokens:  fit.Tokens,
+		Trimmed: fit.Trimmed,
+		Result:  result,
+	})
+}
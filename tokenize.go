@@ -0,0 +1,176 @@
+package chatterbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/types"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// pickRunner acquires any replica of the model behind name for the request
+// id, following routes. It also returns the model the routes picked, which
+// may be on a worker if there is no runner. The caller must Release it.
+func (s *Server) pickRunner(name, id string) (*Runner, string, bool) {
+	pool, target, ok := s.routePool(name)
+	if !ok {
+		return nil, target, false
+	}
+	_, runner, _ := s.pick(pool, Affinity{Replica: -1, Slot: -1}, id)
+	return runner, target, runner != nil
+}
+
+// utilityProxy proxies requests that don't generate anything, so neither
+// generation defaults nor slot affinity apply.
+func (s *Server) utilityProxy(w http.ResponseWriter, r *http.Request, path string) {
+	// Access the model value from the path
+	vars := mux.Vars(r)
+	modelname := vars["model"]
+
+	id := requestID(r.Context())
+	runner, target, ok := s.pickRunner(modelname, id)
+	if !ok {
+		if s.routeToWorker(w, r, modelname, target) {
+			return
+		}
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
+	}
+	defer runner.Release(id)
+	w.Header().Set(BackendHeader, runner.Config.ModelName)
+	s.genericProxy(w, r, path, runner, nil)
+}
+
+func (s *Server) tokenizeProxy(w http.ResponseWriter, r *http.Request) {
+	s.utilityProxy(w, r, "/tokenize")
+}
+
+func (s *Server) detokenizeProxy(w http.ResponseWriter, r *http.Request) {
+	s.utilityProxy(w, r, "/detokenize")
+}
+
+// callRunner posts in as JSON to the llama.cpp endpoint path of runner and
+// decodes the answer into out. The backend translates the request and the
+// answer like it does for proxied requests. runner must be acquired by the
+// caller.
+func callRunner(ctx context.Context, runner *Runner, path string, in, out interface{}) error {
+	upstreamPath, ok := runner.Backend.Endpoint(path)
+	if !ok {
+		return fmt.Errorf("%s is not supported by the %s backend", path, runner.Config.Backend)
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, runner.Backend.BaseURL(runner.Config)+upstreamPath, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	id := requestID(ctx)
+	if id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if err := runner.Backend.Request(runner.Config, path, req); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "call "+path, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(runnerAttributes(runner)...))
+	injectTrace(ctx, req.Header)
+	err = doRunner(req, runner.Backend, path, out)
+	if res, ok := out.(*types.Result); ok && err == nil {
+		span.SetAttributes(timingAttributes(res, time.Since(start))...)
+	}
+	endSpan(span, err)
+	return err
+}
+
+// doRunner sends req, lets backend normalize the response and decodes the
+// JSON answer into out.
+func doRunner(req *http.Request, backend Backend, path string, out interface{}) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	//Response may replace the body
+	defer func() { resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed: %s: %s", path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if err := backend.Response(path, resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// tokenize asks runner for the tokens of content.
+func tokenize(ctx context.Context, runner *Runner, content string) ([]int, error) {
+	res := &types.Tokenize_Response{}
+	err := callRunner(ctx, runner, "/tokenize", types.Tokenize_Request{Content: content}, res)
+	return res.Tokens, err
+}
+
+// countHandler reports how many tokens a prompt or chat takes and how much
+// of a slot's context is left for the answer.
+func (s *Server) countHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the model value from the path
+	vars := mux.Vars(r)
+	modelname := vars["model"]
+
+	id := requestID(r.Context())
+	runner, target, ok := s.pickRunner(modelname, id)
+	if !ok {
+		if s.routeToWorker(w, r, modelname, target) {
+			return
+		}
+		http.Error(w, "Model not loaded", http.StatusBadRequest)
+		return
+	}
+	defer runner.Release(id)
+
+	req := &types.Count_Request{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (req.Prompt == "") == (len(req.Messages) == 0) {
+		http.Error(w, "Either prompt or messages is required", http.StatusBadRequest)
+		return
+	}
+	prompt := req.Prompt
+	if len(req.Messages) > 0 {
+		prompt, err = types.RenderChat(runner.Config.ChatTemplate, req.Messages)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if _, ok := runner.Backend.Endpoint("/tokenize"); !ok {
+		http.Error(w, fmt.Sprintf("/tokenize is not supported by the %s backend", runner.Config.Backend), http.StatusNotImplemented)
+		return
+	}
+	tokens, err := tokenize(r.Context(), runner, prompt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	res := &types.Count_Response{Tokens: len(tokens)}
+	//llama.cpp splits the context evenly between the slots. A context size
+	//of 0 is taken from the model, which we don't know.
+	if runner.Config.ContextSize > 0 {
+		res.ContextSize = runner.Config.ContextSize / max(runner.Config.ParallelSlots, 1)
+		res.Remaining = res.ContextSize - res.Tokens
+	}
+	w.Header().Set(BackendHeader, runner.Config.ModelName)
+	json.NewEncoder(w).Encode(res)
+}
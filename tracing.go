@@ -0,0 +1,137 @@
+package chatterbox
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer follows the global tracer provider, so spans are dropped until
+// SetupTracing is called.
+var tracer = otel.Tracer("github.com/schnapper79/chatterbox")
+
+// SetupTracing exports spans via OTLP over HTTP to endpoint, a URL like
+// http://localhost:4318 (the path defaults to /v1/traces). It also makes
+// chatterbox join traces started by clients and pass them on to runners and
+// workers. The returned function flushes and stops the exporter.
+func SetupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("chatterbox")))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// endSpan records err, if any, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// timingAttributes are the llama.cpp timings of a result. wait_ms is the rest
+// of elapsed: time spent neither evaluating the prompt nor generating, mostly
+// waiting for a free slot.
+func timingAttributes(res *types.Result, elapsed time.Duration) []attribute.KeyValue {
+	t := res.Timings
+	if t == (types.Timings{}) {
+		return nil
+	}
+	wait := float64(elapsed.Microseconds())/1000 - t.PromptMs - t.PredictedMs
+	return []attribute.KeyValue{
+		attribute.Float64("llama.prompt_ms", t.PromptMs),
+		attribute.Int("llama.prompt_n", t.PromptN),
+		attribute.Float64("llama.predicted_ms", t.PredictedMs),
+		attribute.Int("llama.predicted_n", t.PredictedN),
+		attribute.Float64("llama.wait_ms", max(wait, 0)),
+		attribute.Int("llama.tokens_cached", res.TokensCached),
+	}
+}
+
+// runnerAttributes identify the runner a span is about.
+func runnerAttributes(runner *Runner) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("chatterbox.konfig", runner.Config.ModelName),
+		attribute.Int("chatterbox.replica", runner.Replica),
+		attribute.String("chatterbox.backend", runner.Config.Backend),
+	}
+}
+
+// traceRequests starts the server span of every request, joining the trace
+// of the client if it sent one. It runs before logRequests so the access log
+// can name the trace.
+func (s *Server) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.HTTPRouteKey.String(route),
+			semconv.URLPath(r.URL.Path),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCodeKey.Int(rec.status))
+		if id := w.Header().Get(RequestIDHeader); id != "" {
+			span.SetAttributes(attribute.String("chatterbox.request_id", id))
+		}
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// traceRunnerStart traces a runner from its start until it is ready or
+// failed to get there.
+func traceRunnerStart(req *types.Model_Request, replica int) (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), "runner start", trace.WithAttributes(
+		attribute.String("chatterbox.konfig", req.ModelName),
+		attribute.Int("chatterbox.replica", replica),
+		attribute.String("chatterbox.backend", req.Backend),
+		attribute.Int("chatterbox.port", req.Port),
+	))
+}
+
+// injectTrace passes the trace of ctx on in header.
+func injectTrace(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+func statusError(status int) error {
+	if status < 500 {
+		return nil
+	}
+	return fmt.Errorf("upstream answered %d", status)
+}
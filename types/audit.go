@@ -0,0 +1,61 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+)
+
+// AuditRecord is one line of the audit log: who asked what of which model,
+// and what it answered.
+type AuditRecord struct {
+	Time            time.Time              `json:"time"`
+	APIKey          string                 `json:"api_key,omitempty"` //fingerprint of the key, never the key itself
+	Model           string                 `json:"model"`             //as requested, may be an alias or route
+	Konfig          string                 `json:"konfig"`            //konfig that served the request
+	Revision        int                    `json:"revision,omitempty"`
+	Worker          string                 `json:"worker,omitempty"` //worker the request was forwarded to, which knows the revision
+	Endpoint        string                 `json:"endpoint"`
+	Prompt          string                 `json:"prompt"`
+	Params          map[string]interface{} `json:"params,omitempty"` //sampling parameters differing from their defaults
+	Content         string                 `json:"content"`
+	StopReason      string                 `json:"stop_reason,omitempty"` //eos, word or limit
+	TokensEvaluated int                    `json:"tokens_evaluated"`
+	TokensPredicted int                    `json:"tokens_predicted"`
+	LatencyMs       int64                  `json:"latency_ms"`
+	Status          int                    `json:"status"` //as sent to the client
+	Error           string                 `json:"error,omitempty"`
+	Cached          bool                   `json:"cached,omitempty"`
+}
+
+// RedactionRule replaces every match of Pattern in prompts, string parameters
+// and contents before a record is written. Replace may refer to submatches
+// like regexp.ReplaceAllString, and defaults to "[REDACTED]".
+type RedactionRule struct {
+	Pattern string `json:"pattern"`
+	Replace string `json:"replace,omitempty"`
+}
+
+// Compile returns the rule's regexp.
+func (r RedactionRule) Compile() (*regexp.Regexp, error) {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redaction pattern %q: %v", r.Pattern, err)
+	}
+	return re, nil
+}
+
+// LoadRedactionRules reads a JSON list of rules.
+func LoadRedactionRules(path string) ([]RedactionRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rules := []RedactionRule{}
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
+}
@@ -0,0 +1,12 @@
+package types
+
+// CacheStats are the counters of the response cache since the start.
+type CacheStats struct {
+	Entries     int   `json:"entries"`
+	Hits        int64 `json:"hits"`
+	Misses      int64 `json:"misses"`
+	Bypasses    int64 `json:"bypasses"` //not deterministic, or skipped by request headers
+	Stores      int64 `json:"stores"`
+	Evictions   int64 `json:"evictions"`   //dropped from a full cache
+	Expirations int64 `json:"expirations"` //expired responses removed by the periodic sweep
+}
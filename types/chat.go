@@ -0,0 +1,31 @@
+package types
+
+// ChatCompletion_Request is the body of POST /v1/chat/completions. Sampling
+// parameters left out fall back to the konfig's defaults.
+type ChatCompletion_Request struct {
+	Model       string        `json:"model"`
+	Messages    []ChatMessage `json:"messages"`
+	Tools       []Tool        `json:"tools,omitempty"`
+	ToolChoice  *ToolChoice   `json:"tool_choice,omitempty"` //defaults to auto with tools
+	MaxTokens   *int          `json:"max_tokens,omitempty"`
+	Temperature *float32      `json:"temperature,omitempty"`
+	TopP        *float32      `json:"top_p,omitempty"`
+	Seed        *int          `json:"seed,omitempty"`
+	Stop        StringList    `json:"stop,omitempty"`   //a single stop word or a list
+	Stream      bool          `json:"stream,omitempty"` //not supported
+}
+
+type ChatChoice struct {
+	Index        int         `json:"index"`
+	Message      ChatMessage `json:"message"`
+	FinishReason string      `json:"finish_reason"` //stop, length or tool_calls
+}
+
+type ChatCompletion_Response struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"` //always "chat.completion"
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []ChatChoice `json:"choices"`
+	Usage   OpenAIUsage  `json:"usage"`
+}
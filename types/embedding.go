@@ -0,0 +1,61 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type Embedding_Request struct {
+	Content string `json:"content"`
+}
+
+type Embedding_Response struct {
+	Embedding []float64 `json:"embedding"`
+}
+
+// OpenAIEmbeddings_Request is the body of POST /v1/embeddings.
+type OpenAIEmbeddings_Request struct {
+	Model          string     `json:"model"`
+	Input          StringList `json:"input"`
+	EncodingFormat string     `json:"encoding_format,omitempty"` //only float is supported
+}
+
+// StringList is a single string or an array of strings, as OpenAI accepts
+// for embedding inputs and stop words.
+type StringList []string
+
+func (in *StringList) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*in = StringList{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("expected a string or an array of strings")
+	}
+	*in = list
+	return nil
+}
+
+type OpenAIEmbedding struct {
+	Object    string    `json:"object"` //always "embedding"
+	Index     int       `json:"index"`
+	Embedding []float64 `json:"embedding"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIEmbeddings_Response struct {
+	Object string            `json:"object"` //always "list"
+	Data   []OpenAIEmbedding `json:"data"`
+	Model  string            `json:"model"`
+	Usage  OpenAIUsage       `json:"usage"`
+}
@@ -0,0 +1,382 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolve returns m merged over the chain of konfigs it extends. Fields a
+// konfig sets in its JSON override those of its base, even if they are set to
+// their default; nested structs and maps are merged recursively. Missing bases
+// and cycles are reported as a *ValidationError on /extends.
+func (m *Model_Request) Resolve(store KonfigStore) (*Model_Request, error) {
+	chain := []string{}
+	if m.ModelName != "" {
+		chain = append(chain, m.ModelName)
+	}
+	return m.resolve(store, chain)
+}
+
+func (m *Model_Request) resolve(store KonfigStore, chain []string) (*Model_Request, error) {
+	if m.Extends == "" {
+		return m, nil
+	}
+	for _, name := range chain {
+		if name == m.Extends {
+			verr := &ValidationError{}
+			verr.add("/extends", "cycle: %s -> %s", strings.Join(chain, " -> "), m.Extends)
+			return nil, verr
+		}
+	}
+
+	base := NewModelRequestWithDefaults()
+	if err := base.Load(store, m.Extends); err != nil {
+		verr := &ValidationError{}
+		if errors.Is(err, ErrKonfigNotFound) {
+			verr.add("/extends", "base konfig %s does not exist", m.Extends)
+		} else {
+			verr.add("/extends", "base konfig %s: %v", m.Extends, err)
+		}
+		return nil, verr
+	}
+	base, err := base.resolve(store, append(chain, m.Extends))
+	if err != nil {
+		return nil, err
+	}
+	return Merge(base, m), nil
+}
+
+// UnmarshalJSON remembers data, so Merge knows which fields the konfig sets.
+func (m *Model_Request) UnmarshalJSON(data []byte) error {
+	type plain Model_Request
+	if err := json.Unmarshal(data, (*plain)(m)); err != nil {
+		return err
+	}
+	m.raw = append(json.RawMessage{}, data...)
+	return nil
+}
+
+func (m *Model_Request) source() json.RawMessage       { return m.raw }
+func (m *Model_Request) setSource(raw json.RawMessage) { m.raw = raw }
+
+func (p *Prediction_Request) source() json.RawMessage       { return p.raw }
+func (p *Prediction_Request) setSource(raw json.RawMessage) { p.raw = raw }
+
+// jsonSource is implemented by the types that remember the JSON they were
+// decoded from. Merges and copies keep it, so a merged konfig still knows
+// which fields its parts set.
+type jsonSource interface {
+	source() json.RawMessage
+	setSource(raw json.RawMessage)
+}
+
+var jsonSourceType = reflect.TypeOf((*jsonSource)(nil)).Elem()
+
+// sourceOf returns the JSON the struct v was decoded from, and false if its
+// type doesn't remember it.
+func sourceOf(v reflect.Value) (json.RawMessage, bool) {
+	if !reflect.PointerTo(v.Type()).Implements(jsonSourceType) {
+		return nil, false
+	}
+	if !v.CanAddr() {
+		c := reflect.New(v.Type())
+		c.Elem().Set(v)
+		v = c.Elem()
+	}
+	return v.Addr().Interface().(jsonSource).source(), true
+}
+
+// unionJSON returns the JSON object with the members of a and b, those of b
+// winning, or nil if neither is an object.
+func unionJSON(a, b json.RawMessage) json.RawMessage {
+	keys, more := jsonKeys(a), jsonKeys(b)
+	if keys == nil {
+		if more == nil {
+			return nil
+		}
+		keys = map[string]json.RawMessage{}
+	}
+	for k, v := range more {
+		keys[k] = v
+	}
+	data, _ := json.Marshal(keys)
+	return data
+}
+
+// marshalSet encodes the fields m sets, see Merge, so that a stored konfig
+// still sets the same fields when it's loaded again: a field set to its
+// default is kept and one left at its default isn't turned into an override.
+func (m *Model_Request) marshalSet() ([]byte, error) {
+	return setJSON(reflect.ValueOf(m).Elem(), m.raw)
+}
+
+// setJSON encodes the fields of the struct v that are present in raw or
+// differ from their default. Nested structs and maps of them are encoded the
+// same way.
+func setJSON(v reflect.Value, raw json.RawMessage) ([]byte, error) {
+	keys := jsonKeys(raw)
+	t := v.Type()
+	out := bytes.NewBufferString("{")
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if name == "" {
+			continue
+		}
+		value, err := setValueJSON(v.Field(i), t.Field(i).Tag.Get("default"), lookupKey(keys, name))
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		writeMember(out, name, value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+// setValueJSON encodes v if it's set, see setJSON, and returns nil otherwise.
+func setValueJSON(v reflect.Value, def string, raw json.RawMessage) ([]byte, error) {
+	switch {
+	case v.Kind() == reflect.Ptr && !v.IsNil() && isPlainStruct(v.Elem().Type()):
+		data, err := setJSON(v.Elem(), raw)
+		if err != nil || (raw == nil && string(data) == "{}") {
+			return nil, err
+		}
+		return data, nil
+	case v.Kind() == reflect.Map && v.Type().Elem().Kind() == reflect.Ptr && isPlainStruct(v.Type().Elem().Elem()):
+		if v.IsNil() || (raw == nil && v.Len() == 0) {
+			if raw == nil {
+				return nil, nil
+			}
+			return json.Marshal(v.Interface())
+		}
+		entries := []string{}
+		for _, key := range v.MapKeys() {
+			entries = append(entries, key.String())
+		}
+		sort.Strings(entries)
+		keys := jsonKeys(raw)
+		out := bytes.NewBufferString("{")
+		for _, key := range entries {
+			value, err := setValueJSON(v.MapIndex(reflect.ValueOf(key).Convert(v.Type().Key())), "", keys[key])
+			if err != nil {
+				return nil, err
+			}
+			if value == nil {
+				// an entry is always set, even if it only has defaults
+				value = []byte("{}")
+			}
+			writeMember(out, key, value)
+		}
+		out.WriteByte('}')
+		return out.Bytes(), nil
+	case raw != nil || !isDefault(v, def):
+		return json.Marshal(v.Interface())
+	}
+	return nil, nil
+}
+
+// isPlainStruct reports whether t is a struct encoded field by field.
+func isPlainStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && !reflect.PointerTo(t).Implements(reflect.TypeOf((*json.Marshaler)(nil)).Elem())
+}
+
+func writeMember(out *bytes.Buffer, name string, value []byte) {
+	if out.Len() > 1 {
+		out.WriteByte(',')
+	}
+	key, _ := json.Marshal(name)
+	out.Write(key)
+	out.WriteByte(':')
+	out.Write(value)
+}
+
+// Merge returns a copy of base overlaid with the fields child sets. If child
+// was decoded from JSON these are the fields present in it, plus those that
+// were changed from their default afterwards; otherwise all fields that
+// differ from their default.
+func Merge(base, child *Model_Request) *Model_Request {
+	merged := deepCopy(reflect.ValueOf(base).Elem())
+	mergeValue(merged, reflect.ValueOf(child).Elem(), "", child.raw)
+	out := merged.Interface().(Model_Request)
+	return &out
+}
+
+// mergeValue merges src into dst. raw is the JSON src was decoded from, or nil
+// if it isn't known or src wasn't present in its parent's JSON.
+func mergeValue(dst, src reflect.Value, def string, raw json.RawMessage) {
+	switch src.Kind() {
+	case reflect.Struct:
+		own, remembers := sourceOf(src)
+		if raw == nil {
+			raw = own
+		}
+		keys := jsonKeys(raw)
+		t := src.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			mergeValue(dst.Field(i), src.Field(i), t.Field(i).Tag.Get("default"), lookupKey(keys, name))
+		}
+		if remembers {
+			base, _ := sourceOf(dst)
+			dst.Addr().Interface().(jsonSource).setSource(unionJSON(base, raw))
+		}
+	case reflect.Ptr:
+		if src.IsNil() {
+			if raw != nil {
+				// explicit null
+				dst.Set(reflect.Zero(dst.Type()))
+			}
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(deepCopy(src.Elem()).Addr())
+			return
+		}
+		mergeValue(dst.Elem(), src.Elem(), "", raw)
+	case reflect.Map:
+		if src.IsNil() && raw != nil {
+			dst.Set(reflect.Zero(dst.Type()))
+			return
+		}
+		if src.Len() == 0 {
+			return
+		}
+		if dst.IsNil() {
+			dst.Set(reflect.MakeMap(src.Type()))
+		}
+		keys := jsonKeys(raw)
+		for _, key := range src.MapKeys() {
+			sv := src.MapIndex(key)
+			dv := dst.MapIndex(key)
+			if !dv.IsValid() || sv.Kind() != reflect.Ptr || dv.IsNil() || sv.IsNil() {
+				dst.SetMapIndex(key, deepCopy(sv))
+				continue
+			}
+			// merge pointed-to structs into a fresh copy of the base entry
+			merged := deepCopy(dv)
+			mergeValue(merged, sv, "", keys[key.String()])
+			dst.SetMapIndex(key, merged)
+		}
+	default:
+		if raw != nil || !isDefault(src, def) {
+			dst.Set(deepCopy(src))
+		}
+	}
+}
+
+// jsonKeys returns the members of the JSON object raw, or nil if raw isn't
+// one.
+func jsonKeys(raw json.RawMessage) map[string]json.RawMessage {
+	if raw == nil {
+		return nil
+	}
+	keys := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &keys); err != nil {
+		return nil
+	}
+	return keys
+}
+
+// lookupKey returns the member name of keys, matched case-insensitively like
+// encoding/json does when decoding.
+func lookupKey(keys map[string]json.RawMessage, name string) json.RawMessage {
+	if value, ok := keys[name]; ok {
+		return value
+	}
+	for key, value := range keys {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return nil
+}
+
+// jsonName returns the JSON member name of an exported field, or "" if the
+// field isn't encoded.
+func jsonName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return f.Name
+	}
+	return name
+}
+
+// isDefault reports whether v equals the value of its default tag, or its
+// zero value if there is no usable default.
+func isDefault(v reflect.Value, def string) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return v.String() == def
+	case reflect.Int, reflect.Int64:
+		if d, err := strconv.ParseInt(def, 10, 64); err == nil {
+			return v.Int() == d
+		}
+	case reflect.Float32, reflect.Float64:
+		if d, err := strconv.ParseFloat(def, 32); err == nil {
+			return float32(v.Float()) == float32(d)
+		}
+	case reflect.Bool:
+		if d, err := strconv.ParseBool(def); err == nil {
+			return v.Bool() == d
+		}
+	case reflect.Slice:
+		return v.IsNil()
+	}
+	return v.IsZero()
+}
+
+// deepCopy returns an addressable copy of v that shares no pointers, maps or
+// slices with it. Unexported fields are left zero, except the JSON a
+// jsonSource was decoded from.
+func deepCopy(v reflect.Value) reflect.Value {
+	out := reflect.New(v.Type()).Elem()
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			out.Field(i).Set(deepCopy(v.Field(i)))
+		}
+		if raw, ok := sourceOf(v); ok {
+			out.Addr().Interface().(jsonSource).setSource(raw)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			out.Set(deepCopy(v.Elem()).Addr())
+		}
+	case reflect.Map:
+		if !v.IsNil() {
+			out.Set(reflect.MakeMap(v.Type()))
+			for _, key := range v.MapKeys() {
+				out.SetMapIndex(key, deepCopy(v.MapIndex(key)))
+			}
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			out.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				out.Index(i).Set(deepCopy(v.Index(i)))
+			}
+		}
+	default:
+		out.Set(v)
+	}
+	return out
+}
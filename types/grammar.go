@@ -0,0 +1,116 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var grammarNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+// Grammar is a named GBNF grammar, referenced by completion requests with
+// grammar_name.
+type Grammar struct {
+	Name    string `json:"name"`
+	Grammar string `json:"grammar"`
+}
+
+// Grammar_Request stores either a grammar or a JSON Schema that is converted
+// to one.
+type Grammar_Request struct {
+	Grammar string          `json:"grammar,omitempty"`
+	Schema  json.RawMessage `json:"schema,omitempty"`
+}
+
+const (
+	ResponseFormatJSONObject = "json_object"
+	ResponseFormatJSONSchema = "json_schema"
+)
+
+// ResponseFormat asks for JSON output. The schema is taken from Schema or,
+// as OpenAI sends it, from JSONSchema.Schema. json_object without a schema
+// allows any JSON object.
+type ResponseFormat struct {
+	Type       string              `json:"type"`
+	Schema     json.RawMessage     `json:"schema,omitempty"`
+	JSONSchema *ResponseJSONSchema `json:"json_schema,omitempty"`
+}
+
+type ResponseJSONSchema struct {
+	Name   string          `json:"name,omitempty"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict,omitempty"`
+}
+
+// SchemaJSON returns the requested schema, nil if there is none.
+func (f *ResponseFormat) SchemaJSON() json.RawMessage {
+	if f.JSONSchema != nil && len(f.JSONSchema.Schema) > 0 {
+		return f.JSONSchema.Schema
+	}
+	return f.Schema
+}
+
+func grammarPath(dir, name string) (string, error) {
+	if !grammarNamePattern.MatchString(name) {
+		return "", fmt.Errorf("invalid grammar name %q", name)
+	}
+	return filepath.Join(dir, name+".gbnf"), nil
+}
+
+// SaveGrammar writes the grammar to dir/<name>.gbnf.
+func SaveGrammar(dir string, g *Grammar) error {
+	path, err := grammarPath(dir, g.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, []byte(g.Grammar))
+}
+
+// LoadGrammar reads the grammar called name, os.ErrNotExist if there is none.
+func LoadGrammar(dir, name string) (*Grammar, error) {
+	path, err := grammarPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Grammar{Name: name, Grammar: string(data)}, nil
+}
+
+func DeleteGrammar(dir, name string) error {
+	path, err := grammarPath(dir, name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// ListGrammars returns the sorted names of the grammars in dir. A missing dir
+// holds no grammars.
+func ListGrammars(dir string) ([]string, error) {
+	names := []string{}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return names, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".gbnf")
+		if ok && !e.IsDir() && grammarNamePattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,77 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Revision describes one saved version of a konfig.
+type Revision struct {
+	Rev  int       `json:"rev"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// FieldDiff is a single changed value between two konfig revisions.
+type FieldDiff struct {
+	Pointer string      `json:"pointer"`
+	From    interface{} `json:"from"`
+	To      interface{} `json:"to"`
+}
+
+// Diff returns the fields that differ between from and to, addressed by JSON
+// pointers.
+func Diff(from, to *Model_Request) ([]FieldDiff, error) {
+	a, err := toJSONMap(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toJSONMap(to)
+	if err != nil {
+		return nil, err
+	}
+	diffs := []FieldDiff{}
+	diffMaps("", a, b, &diffs)
+	return diffs, nil
+}
+
+func toJSONMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+func diffMaps(prefix string, a, b map[string]interface{}, diffs *[]FieldDiff) {
+	keys := map[string]bool{}
+	for k := range a {
+		keys[k] = true
+	}
+	for k := range b {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		pointer := prefix + "/" + strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+		subA, okA := a[k].(map[string]interface{})
+		subB, okB := b[k].(map[string]interface{})
+		if okA && okB {
+			diffMaps(pointer, subA, subB, diffs)
+			continue
+		}
+		if !reflect.DeepEqual(a[k], b[k]) {
+			*diffs = append(*diffs, FieldDiff{Pointer: pointer, From: a[k], To: b[k]})
+		}
+	}
+}
@@ -2,7 +2,6 @@ package types
 
 import (
 	"encoding/json"
-	"os"
 	"reflect"
 	"strconv"
 )
@@ -12,7 +11,23 @@ type Descriptor struct {
 	Comment string `json:"comment"`
 }
 
+// Backends a konfig can be served by.
+const (
+	BackendLlamaCpp = "llama.cpp" //llama.cpp server started by chatterbox
+	BackendOpenAI   = "openai"    //external OpenAI-compatible HTTP upstream
+)
+
+// Upstream is the external server of the openai backend.
+type Upstream struct {
+	URL       string `json:"url"`                 //base URL including the version, e.g. https://api.example.com/v1
+	Model     string `json:"model,omitempty"`     //model name sent upstream, defaults to the konfig's model
+	APIKeyEnv string `json:"apiKeyEnv,omitempty"` //environment variable holding the bearer token
+}
+
 type Model_Request struct {
+	Backend  string    `json:"backend,omitempty" default:"llama.cpp"` //llama.cpp or openai
+	Upstream *Upstream `json:"upstream,omitempty"`                    //required by the openai backend
+
 	Model       string `json:"model" llama:"model" default:""`
 	ModelName   string `json:"modelName,omitempty" llama:"alias" default:""`
 	ContextSize int    `json:"contextSize,omitempty" llama:"ctx-size" default:"4096"`
@@ -37,6 +52,21 @@ type Model_Request struct {
 	Host            string      `json:"host,omitempty" llama:"host" default:"localhost"`      //defaults to localhost
 	SystemPromtFile string      `json:"systemPromptFile,omitempty" llama:"system-prompt-file" default:""`
 	Decription      *Descriptor `json:"description,omitempty"`
+
+	Replicas  int      `json:"replicas,omitempty" default:"1"` //number of llama.cpp servers behind this name
+	CPUSets   []string `json:"cpuSets,omitempty"`              //taskset cpu list per replica, e.g. "0-7"
+	NUMANodes []int    `json:"numaNodes,omitempty"`            //numactl node per replica, takes precedence over cpuSets
+
+	Extends string `json:"extends,omitempty" default:""` //name of the base konfig
+
+	Defaults *Prediction_Request            `json:"defaults,omitempty"` //merged under every completion request
+	Presets  map[string]*Prediction_Request `json:"presets,omitempty"`  //named sampling presets, selected with ?preset=
+
+	ChatTemplate string `json:"chatTemplate,omitempty" default:"chatml"` //chatml or llama2, renders chat message lists
+
+	MaxNPredict int `json:"maxNPredict,omitempty" default:"0"` //cap on n_predict of completion requests, 0 => no cap
+
+	raw json.RawMessage //the JSON the konfig was decoded from, tells Merge which fields it sets
 }
 
 func NewModelRequestWithDefaults() *Model_Request {
@@ -77,6 +107,10 @@ func (mr *Model_Request) ToMap() map[string]string {
 		field := t.Field(i)
 		def := field.Tag.Get("default")
 		llama := field.Tag.Get("llama")
+		if llama == "" {
+			// not a llama.cpp flag (description, extends, ...)
+			continue
+		}
 		key := "--" + llama
 		fv := v.Field(i)
 
@@ -101,34 +135,20 @@ func (mr *Model_Request) ToMap() map[string]string {
 			if defVal, err := strconv.ParseBool(def); err == nil && val != defVal && val {
 				m[key] = ""
 			}
-		case reflect.Ptr:
-			// Now you need to check what the pointer points to
-			elemType := field.Type.Elem()
-			if elemType.Name() == "Decription" {
-				newDescriptor := Descriptor{}
-				fv.Set(reflect.ValueOf(&newDescriptor))
-			}
 		}
 	}
 	return m
 }
-func (m *Model_Request) Save(ModelPath string) error {
-	data, err := json.Marshal(m)
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(ModelPath+"/"+m.ModelName+".json", data, 0644)
-}
 
-func (m *Model_Request) Load(ModelPath string, name string) error {
-	data, err := os.ReadFile(ModelPath + "/" + name + ".json")
-	if err != nil {
-		return err
+// PinCommand returns the command prefix pinning a replica to its NUMA node or
+// CPU set, or an empty slice if the konfig doesn't pin replicas.
+func (m *Model_Request) PinCommand(replica int) []string {
+	if len(m.NUMANodes) > 0 {
+		node := strconv.Itoa(m.NUMANodes[replica%len(m.NUMANodes)])
+		return []string{"numactl", "--cpunodebind=" + node, "--membind=" + node}
 	}
-	return json.Unmarshal(data, m)
-}
-
-func (m *Model_Request) Delete(ModelPath string) error {
-	err := os.Remove(ModelPath + "/" + m.ModelName + ".json")
-	return err
+	if len(m.CPUSets) > 0 {
+		return []string{"taskset", "-c", m.CPUSets[replica%len(m.CPUSets)]}
+	}
+	return []string{}
 }
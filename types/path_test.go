@@ -0,0 +1,96 @@
+package types
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_SafeJoinRejectsAttacks(t *testing.T) {
+	base := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret.json"), []byte("{}"), 0644)
+	os.Mkdir(filepath.Join(base, "sub"), 0755)
+	os.Symlink(outside, filepath.Join(base, "escape"))
+	os.Symlink(filepath.Join(outside, "secret.json"), filepath.Join(base, "link.json"))
+	os.Symlink(filepath.Join(outside, "new.json"), filepath.Join(base, "dangling.json"))
+
+	cases := []string{
+		"",
+		".",
+		"..",
+		"../secret.json",
+		"../../etc/passwd",
+		"sub/../../secret.json",
+		"/etc/passwd",
+		filepath.Join(outside, "secret.json"),
+		"escape/secret.json",
+		"escape/new.json",
+		"link.json",
+		"dangling.json",
+		"a\x00b",
+	}
+	for _, name := range cases {
+		if p, err := SafeJoin(base, name); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("SafeJoin(%q) = %q, %v; want ErrUnsafePath", name, p, err)
+		}
+	}
+}
+
+func Test_SafeJoinAcceptsNames(t *testing.T) {
+	base := t.TempDir()
+	os.Mkdir(filepath.Join(base, "sub"), 0755)
+	os.Symlink(filepath.Join(base, "sub"), filepath.Join(base, "inside"))
+
+	cases := map[string]string{
+		"model.gguf":            "model.gguf",
+		"sub/model.gguf":        "sub/model.gguf",
+		"sub/../model.gguf":     "model.gguf",
+		"inside/model.gguf":     "inside/model.gguf",
+		"not/yet/created.json":  "not/yet/created.json",
+		"..dotted-name.gguf":    "..dotted-name.gguf",
+		"sub/./nested/../x.bin": "sub/x.bin",
+	}
+	for name, want := range cases {
+		p, err := SafeJoin(base, name)
+		if err != nil {
+			t.Errorf("SafeJoin(%q) failed: %v", name, err)
+			continue
+		}
+		if p != filepath.Join(base, want) {
+			t.Errorf("SafeJoin(%q) = %q, want %q", name, p, filepath.Join(base, want))
+		}
+	}
+}
+
+func Test_KonfigFileOperationsStayInModelPath(t *testing.T) {
+	root := t.TempDir()
+	base := filepath.Join(root, "models")
+	os.Mkdir(base, 0755)
+	victim := filepath.Join(root, "victim.json")
+	os.WriteFile(victim, []byte(`{"model":"victim"}`), 0644)
+
+	store := &FileStore{dir: base}
+	mr := NewModelRequestWithDefaults()
+	mr.ModelName = "../victim"
+	if err := mr.Save(store); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Save outside ModelPath: got %v", err)
+	}
+	if err := mr.Load(store, "../victim"); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Load outside ModelPath: got %v", err)
+	}
+	if err := mr.Delete(store); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("Delete outside ModelPath: got %v", err)
+	}
+	if _, err := os.Stat(victim); err != nil {
+		t.Errorf("victim file was touched: %v", err)
+	}
+
+	mr.Model = "../victim.json"
+	mr.LoraAdapter = "/etc/passwd"
+	verr, ok := mr.Validate(base).(*ValidationError)
+	if !ok || len(verr.Errors) != 2 {
+		t.Errorf("Validate should reject paths outside ModelPath, got %v", verr)
+	}
+}
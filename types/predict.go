@@ -1,6 +1,7 @@
 package types
 
 import (
+	"encoding/json"
 	"reflect"
 	"strconv"
 	"strings"
@@ -12,43 +13,58 @@ type SystemPrompt struct {
 	AssistantName string `json:"assistant_name"`
 }
 
+// Prediction_Request is the body of the llama.cpp /completion endpoint. Fields
+// whose default isn't their zero value are always sent, so an explicit zero
+// isn't replaced by the server's default.
 type Prediction_Request struct {
 	Prompt      string  `json:"prompt" default:""`
 	InputPrefix string  `json:"input_prefix,omitempty" default:""`
 	InputSuffix string  `json:"input_suffix,omitempty" default:""`
-	Temperature float32 `json:"temperature,omitempty" default:"0.8"`
-	TopK        int     `json:"top_k,omitempty" default:"40"`
-	TopP        float32 `json:"top_p,omitempty" default:"0.95"`
+	Temperature float32 `json:"temperature" default:"0.8"`
+	TopK        int     `json:"top_k" default:"40"`
+	TopP        float32 `json:"top_p" default:"0.95"`
 
-	NPredict int `json:"n_predict,omitempty" default:"-1"` //-1 = infinity
-	NKeep    int `json:"n_keep,omitempty" default:"0"`     // 0 none are kept, -1 all are kept
+	NPredict int `json:"n_predict" default:"-1"`       //-1 = infinity
+	NKeep    int `json:"n_keep,omitempty" default:"0"` // 0 none are kept, -1 all are kept
 
 	Stream bool `json:"stream,omitempty" default:"false"`
 
 	Stop []string `json:"stop,omitempty" default:""` //default=stringlist, commaseperated list of stop words
 
-	Tfs_z            float32 `json:"tfs_z,omitempty" default:"1.0"`     //default=1.0 => disabled
-	TypicalP         float32 `json:"typical_p,omitempty" default:"1.0"` //default=1.0 => disabled
-	RepeatPenalty    float32 `json:"repeat_penalty,omitempty" default:"1.1"`
-	RepeatLastN      int     `json:"repeat_last_n,omitempty" default:"64"`      // 0=> disabled, -1 = ctx-size
-	PenalizeNl       bool    `json:"penalize_nl,omitempty" default:"true"`      //penalize new line
+	Tfs_z            float32 `json:"tfs_z" default:"1.0"`     //default=1.0 => disabled
+	TypicalP         float32 `json:"typical_p" default:"1.0"` //default=1.0 => disabled
+	RepeatPenalty    float32 `json:"repeat_penalty" default:"1.1"`
+	RepeatLastN      int     `json:"repeat_last_n" default:"64"`                // 0=> disabled, -1 = ctx-size
+	PenalizeNl       bool    `json:"penalize_nl" default:"true"`                //penalize new line
 	PresencePenalty  float32 `json:"presence_penalty,omitempty" default:"0.0"`  //default=0.0 => disabled
 	FrequencyPenalty float32 `json:"frequency_penalty,omitempty" default:"0.0"` //default=0.0 => disabled
 
-	Mirostat    int     `json:"mirostat,omitempty" default:"0"`       //default=0 => disabled, 1=enabled, 2=mirostat 2.0
-	MirostatTAU float32 `json:"mirostat_tau,omitempty" default:"5.0"` //default=5.0
-	MirostatETA float32 `json:"mirostat_eta,omitempty" default:"0.1"` //default=0.1
+	Mirostat    int     `json:"mirostat,omitempty" default:"0"` //default=0 => disabled, 1=enabled, 2=mirostat 2.0
+	MirostatTAU float32 `json:"mirostat_tau" default:"5.0"`     //default=5.0
+	MirostatETA float32 `json:"mirostat_eta" default:"0.1"`     //default=0.1
 
 	Grammar     string        `json:"grammar,omitempty" default:""`
-	Seed        int           `json:"seed,omitempty" default:"-1"`          //default=-1 => rng
+	GrammarName string        `json:"grammar_name,omitempty" default:""`    //stored grammar, replaced with grammar by chatterbox
+	Seed        int           `json:"seed" default:"-1"`                    //default=-1 => rng
 	IgnoreEOS   bool          `json:"ignore_eos,omitempty" default:"false"` //default=false
 	NProbs      int           `json:"n_probs,omitempty" default:"0"`
-	SlotID      int           `json:"slot_id" default:"-1"`         //default=-1 => idle slot
+	IDSlot      int           `json:"id_slot" default:"-1"`         //default=-1 => idle slot, also read from the old slot_id
 	CachePrompt bool          `json:"cache_prompt" default:"false"` //default=false
 	SystemPromt *SystemPrompt `json:"system_prompt,omitempty"`
 
+	MinP      float32     `json:"min_p" default:"0.05"`            //default=0.05, 0.0 => disabled
+	MinKeep   int         `json:"min_keep,omitempty" default:"0"`  //minimum tokens the samplers keep
+	NDiscard  int         `json:"n_discard,omitempty" default:"0"` //tokens dropped on context shift, 0 => half
+	LogitBias LogitBias   `json:"logit_bias,omitempty"`            //token or piece => bias, false bans
+	ImageData []ImageData `json:"image_data,omitempty"`            //images referenced as [img-<id>] in the prompt
+	Samplers  []string    `json:"samplers,omitempty"`              //sampler order, e.g. top_k, tfs_z, typical_p, top_p, min_p, temperature
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"` //JSON output, turned into a grammar by chatterbox
+
 	Model string `json:"model,omitempty" default:""`  //not set for request
 	NCtx  int    `json:"n_ctx,omitempty" default:"0"` //not set for request
+
+	raw json.RawMessage //the JSON the request was decoded from, tells SetFields which fields it sets
 }
 
 func NewPredictionRequestWithDefaults() *Prediction_Request {
@@ -92,3 +108,77 @@ func NewPredictionRequestWithDefaults() *Prediction_Request {
 	}
 	return &pr
 }
+
+// UnmarshalJSON fills fields missing in data with their defaults, so a
+// decoded request can be told apart from one that sets zero values.
+func (p *Prediction_Request) UnmarshalJSON(data []byte) error {
+	type plain Prediction_Request
+	pr := (*plain)(NewPredictionRequestWithDefaults())
+	if err := json.Unmarshal(data, pr); err != nil {
+		return err
+	}
+	if slot, ok := legacySlotID(data); ok {
+		pr.IDSlot = slot
+	}
+	*p = Prediction_Request(*pr)
+	p.raw = append(json.RawMessage{}, data...)
+	return nil
+}
+
+// legacySlotID returns the slot_id older llama.cpp servers used instead of
+// id_slot, if data has it and no id_slot.
+func legacySlotID(data []byte) (int, bool) {
+	var ids struct {
+		SlotID *int `json:"slot_id"`
+		IDSlot *int `json:"id_slot"`
+	}
+	if err := json.Unmarshal(data, &ids); err != nil || ids.SlotID == nil || ids.IDSlot != nil {
+		return 0, false
+	}
+	return *ids.SlotID, true
+}
+
+// Overrides returns the fields of p that differ from their defaults, keyed by
+// their JSON name.
+func (p *Prediction_Request) Overrides() map[string]interface{} {
+	m := map[string]interface{}{}
+	t := reflect.TypeOf(*p)
+	v := reflect.ValueOf(*p)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fv := v.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Ptr {
+			if !fv.IsNil() && !fv.Elem().IsZero() {
+				m[name] = fv.Interface()
+			}
+			continue
+		}
+		if !isDefault(fv, field.Tag.Get("default")) {
+			m[name] = fv.Interface()
+		}
+	}
+	return m
+}
+
+// SetFields returns the fields p sets, keyed by their JSON name: those present
+// in the JSON it was decoded from, even if they repeat the default, and those
+// that differ from their default.
+func (p *Prediction_Request) SetFields() map[string]interface{} {
+	m := p.Overrides()
+	keys := jsonKeys(p.raw)
+	t := reflect.TypeOf(*p)
+	v := reflect.ValueOf(*p)
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if name != "" && lookupKey(keys, name) != nil {
+			m[name] = v.Field(i).Interface()
+		}
+	}
+	return m
+}
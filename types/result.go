@@ -1,30 +1,40 @@
 package types
 
+import "encoding/json"
+
 type GenerationSettings struct {
-	FrequencyPenalty float64       `json:"frequency_penalty"`
-	Grammar          string        `json:"grammar"`
-	IgnoreEOS        bool          `json:"ignore_eos"`
-	LogitBias        []interface{} `json:"logit_bias"`
-	Mirostat         int           `json:"mirostat"`
-	MirostatEta      float64       `json:"mirostat_eta"`
-	MirostatTau      float64       `json:"mirostat_tau"`
-	Model            string        `json:"model"`
-	NCtx             int           `json:"n_ctx"`
-	NKeep            int           `json:"n_keep"`
-	NPredict         int           `json:"n_predict"`
-	NProbs           int           `json:"n_probs"`
-	PenalizeNL       bool          `json:"penalize_nl"`
-	PresencePenalty  float64       `json:"presence_penalty"`
-	RepeatLastN      int           `json:"repeat_last_n"`
-	RepeatPenalty    float64       `json:"repeat_penalty"`
-	Seed             uint32        `json:"seed"`
-	Stop             []interface{} `json:"stop"`
-	Stream           bool          `json:"stream"`
-	Temp             float64       `json:"temp"`
-	TfsZ             float64       `json:"tfs_z"`
-	TopK             int           `json:"top_k"`
-	TopP             float64       `json:"top_p"`
-	TypicalP         float64       `json:"typical_p"`
+	NCtx                   int       `json:"n_ctx"`
+	NPredict               int       `json:"n_predict"`
+	Model                  string    `json:"model"`
+	Seed                   uint32    `json:"seed"`
+	Temperature            float64   `json:"temperature"`
+	DynatempRange          float64   `json:"dynatemp_range"`
+	DynatempExponent       float64   `json:"dynatemp_exponent"`
+	TopK                   int       `json:"top_k"`
+	TopP                   float64   `json:"top_p"`
+	MinP                   float64   `json:"min_p"`
+	TfsZ                   float64   `json:"tfs_z"`
+	TypicalP               float64   `json:"typical_p"`
+	RepeatLastN            int       `json:"repeat_last_n"`
+	RepeatPenalty          float64   `json:"repeat_penalty"`
+	PresencePenalty        float64   `json:"presence_penalty"`
+	FrequencyPenalty       float64   `json:"frequency_penalty"`
+	PenaltyPromptTokens    []int     `json:"penalty_prompt_tokens"`
+	UsePenaltyPromptTokens bool      `json:"use_penalty_prompt_tokens"`
+	Mirostat               int       `json:"mirostat"`
+	MirostatTau            float64   `json:"mirostat_tau"`
+	MirostatEta            float64   `json:"mirostat_eta"`
+	PenalizeNL             bool      `json:"penalize_nl"`
+	Stop                   []string  `json:"stop"`
+	NKeep                  int       `json:"n_keep"`
+	NDiscard               int       `json:"n_discard"`
+	IgnoreEOS              bool      `json:"ignore_eos"`
+	Stream                 bool      `json:"stream"`
+	LogitBias              LogitBias `json:"logit_bias"`
+	NProbs                 int       `json:"n_probs"`
+	MinKeep                int       `json:"min_keep"`
+	Grammar                string    `json:"grammar"`
+	Samplers               []string  `json:"samplers"`
 }
 
 type Timings struct {
@@ -39,19 +49,45 @@ type Timings struct {
 }
 
 type Result struct {
-	Content            string             `json:"content"`
-	GenerationSettings GenerationSettings `json:"generation_settings"`
-	Model              string             `json:"model"`
-	Prompt             string             `json:"prompt"`
-	SlotID             int                `json:"slot_id"`
-	Stop               bool               `json:"stop"`
-	StoppedEOS         bool               `json:"stopped_eos"`
-	StoppedLimit       bool               `json:"stopped_limit"`
-	StoppedWord        bool               `json:"stopped_word"`
-	StoppingWord       string             `json:"stopping_word"`
-	Timings            Timings            `json:"timings"`
-	TokensCached       int                `json:"tokens_cached"`
-	TokensEvaluated    int                `json:"tokens_evaluated"`
-	TokensPredicted    int                `json:"tokens_predicted"`
-	Truncated          bool               `json:"truncated"`
+	Content                 string                  `json:"content"`
+	IDSlot                  int                     `json:"id_slot"` //also read from the old slot_id
+	Stop                    bool                    `json:"stop"`
+	Model                   string                  `json:"model"`
+	TokensPredicted         int                     `json:"tokens_predicted"`
+	TokensEvaluated         int                     `json:"tokens_evaluated"`
+	GenerationSettings      GenerationSettings      `json:"generation_settings"`
+	Prompt                  string                  `json:"prompt"`
+	Truncated               bool                    `json:"truncated"`
+	StoppedEOS              bool                    `json:"stopped_eos"`
+	StoppedWord             bool                    `json:"stopped_word"`
+	StoppedLimit            bool                    `json:"stopped_limit"`
+	StoppingWord            string                  `json:"stopping_word"`
+	TokensCached            int                     `json:"tokens_cached"`
+	Timings                 Timings                 `json:"timings"`
+	CompletionProbabilities []CompletionProbability `json:"completion_probabilities,omitempty"` //set if n_probs > 0
+}
+
+func (r *Result) UnmarshalJSON(data []byte) error {
+	type plain Result
+	if err := json.Unmarshal(data, (*plain)(r)); err != nil {
+		return err
+	}
+	if slot, ok := legacySlotID(data); ok {
+		r.IDSlot = slot
+	}
+	return nil
+}
+
+// StopReason tells why generation stopped: "eos", "word", "limit", or "" if
+// the result doesn't say.
+func (r *Result) StopReason() string {
+	switch {
+	case r.StoppedEOS:
+		return "eos"
+	case r.StoppedWord:
+		return "word"
+	case r.StoppedLimit:
+		return "limit"
+	}
+	return ""
 }
@@ -0,0 +1,95 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type RouteTarget struct {
+	Model  string `json:"model"`
+	Weight int    `json:"weight,omitempty"` //share of traffic, 0 = none unless all are 0
+}
+
+// Route maps a name used by clients to one or more models. A route with a
+// single target is a plain alias; several targets split traffic by weight,
+// e.g. to send a small share to a canary model.
+type Route struct {
+	Name    string        `json:"name"`
+	Targets []RouteTarget `json:"targets"`
+}
+
+func (r *Route) Validate() error {
+	verr := &ValidationError{}
+	if r.Name == "" {
+		verr.add("/name", "is required")
+	}
+	if len(r.Targets) == 0 {
+		verr.add("/targets", "at least one target is required")
+	}
+	for i, t := range r.Targets {
+		if t.Model == "" {
+			verr.add(fmt.Sprintf("/targets/%d/model", i), "is required")
+		}
+		if t.Weight < 0 {
+			verr.add(fmt.Sprintf("/targets/%d/weight", i), "must not be negative, got %d", t.Weight)
+		}
+	}
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// Weights returns the effective weight of each target. If all weights are 0,
+// every target gets the same share.
+func (r *Route) Weights() []int {
+	weights := make([]int, len(r.Targets))
+	total := 0
+	for i, t := range r.Targets {
+		weights[i] = t.Weight
+		total += t.Weight
+	}
+	if total == 0 {
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	return weights
+}
+
+// LoadRoutes reads the routes persisted at path. A missing file means no
+// routes.
+func LoadRoutes(path string) (map[string]*Route, error) {
+	routes := map[string]*Route{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return routes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := []*Route{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	for _, r := range list {
+		routes[r.Name] = r
+	}
+	return routes, nil
+}
+
+// SaveRoutes atomically persists routes at path.
+func SaveRoutes(path string, routes map[string]*Route) error {
+	list := make([]*Route, 0, len(routes))
+	for _, r := range routes {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
@@ -0,0 +1,117 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// LogitBiasEntry changes the likelihood of a token, or of all tokens of a
+// piece of text.
+type LogitBiasEntry struct {
+	Token int     //token id, used if Piece is empty
+	Piece string  //text whose tokens are biased
+	Bias  float64 //added to the logit
+	Ban   bool    //never generate the token, Bias is ignored
+}
+
+// LogitBias is sent as llama.cpp's list of [token or piece, bias] pairs
+// where a bias of false bans the token. The object form {"token": bias} is
+// accepted as well.
+type LogitBias []LogitBiasEntry
+
+func (e LogitBiasEntry) MarshalJSON() ([]byte, error) {
+	var token interface{} = e.Token
+	if e.Piece != "" {
+		token = e.Piece
+	}
+	var bias interface{} = e.Bias
+	if e.Ban {
+		bias = false
+	}
+	return json.Marshal([]interface{}{token, bias})
+}
+
+func (e *LogitBiasEntry) UnmarshalJSON(data []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(data, &pair); err != nil || len(pair) != 2 {
+		return fmt.Errorf("logit bias entry must be a [token, bias] pair, got %s", data)
+	}
+	*e = LogitBiasEntry{}
+	if err := json.Unmarshal(pair[0], &e.Token); err != nil {
+		if err := json.Unmarshal(pair[0], &e.Piece); err != nil {
+			return fmt.Errorf("logit bias token must be a token id or a string, got %s", pair[0])
+		}
+	}
+	return e.unmarshalBias(pair[1])
+}
+
+// unmarshalBias reads a bias: a number, false to ban the token, or null, which
+// is how llama.cpp reports the -inf of a banned token.
+func (e *LogitBiasEntry) unmarshalBias(data json.RawMessage) error {
+	switch string(data) {
+	case "false", "null":
+		e.Ban = true
+		return nil
+	}
+	if err := json.Unmarshal(data, &e.Bias); err != nil {
+		return fmt.Errorf("logit bias must be a number or false, got %s", data)
+	}
+	return nil
+}
+
+func (b *LogitBias) UnmarshalJSON(data []byte) error {
+	var list []LogitBiasEntry
+	if err := json.Unmarshal(data, &list); err == nil {
+		*b = list
+		return nil
+	} else if len(data) == 0 || data[0] != '{' {
+		return err
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(object))
+	for k := range object {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list = make([]LogitBiasEntry, 0, len(keys))
+	for _, k := range keys {
+		e := LogitBiasEntry{}
+		if id, err := strconv.Atoi(k); err == nil {
+			e.Token = id
+		} else {
+			e.Piece = k
+		}
+		if err := e.unmarshalBias(object[k]); err != nil {
+			return err
+		}
+		list = append(list, e)
+	}
+	*b = list
+	return nil
+}
+
+// ImageData is an image for multimodal models, referenced in the prompt as
+// [img-<ID>].
+type ImageData struct {
+	Data string `json:"data"` //base64 encoded
+	ID   int    `json:"id"`
+}
+
+// TokenProbability is one candidate for a generated token.
+type TokenProbability struct {
+	TokStr string  `json:"tok_str"`
+	Prob   float64 `json:"prob"`
+}
+
+// CompletionProbability lists the n_probs most likely candidates for one
+// generated token.
+type CompletionProbability struct {
+	Content string             `json:"content"`
+	Probs   []TokenProbability `json:"probs"`
+}
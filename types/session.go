@@ -0,0 +1,127 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Session is a conversation kept by chatterbox. The transcript is never
+// trimmed; only the prompt rendered from it is cut to fit the context.
+type Session struct {
+	ID       string              `json:"id"`
+	Model    string              `json:"model"`
+	System   string              `json:"system,omitempty"` //system message rendered before the transcript
+	Params   *Prediction_Request `json:"params,omitempty"` //sampling parameters for every turn
+	Slot     int                 `json:"slot"`             //global slot id the session is pinned to
+	Messages []ChatMessage       `json:"messages"`
+	Created  time.Time           `json:"created"`
+	Updated  time.Time           `json:"updated"`
+}
+
+type Session_Request struct {
+	Model  string              `json:"model"`
+	System string              `json:"system,omitempty"`
+	Params *Prediction_Request `json:"params,omitempty"`
+}
+
+type SessionMessage_Request struct {
+	Content string `json:"content"`
+}
+
+type SessionMessage_Response struct {
+	Message ChatMessage `json:"message"`
+	Tokens  int         `json:"tokens"`  //prompt tokens sent to the model
+	Trimmed int         `json:"trimmed"` //old messages left out to fit the context
+	Result  *Result     `json:"result"`
+}
+
+func NewSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Chat returns the messages to render, starting with the system message.
+func (s *Session) Chat() []ChatMessage {
+	msgs := make([]ChatMessage, 0, len(s.Messages)+1)
+	if s.System != "" {
+		msgs = append(msgs, ChatMessage{Role: "system", Content: s.System})
+	}
+	return append(msgs, s.Messages...)
+}
+
+func sessionPath(dir, id string) (string, error) {
+	if !sessionIDPattern.MatchString(id) {
+		return "", fmt.Errorf("invalid session id %q", id)
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+// Save writes the session to dir/<id>.json.
+func (s *Session) Save(dir string) error {
+	path, err := sessionPath(dir, s.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func DeleteSession(dir, id string) error {
+	path, err := sessionPath(dir, id)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// LoadSessions reads all sessions saved in dir. A missing dir holds no
+// sessions.
+func LoadSessions(dir string) (map[string]*Session, error) {
+	sessions := map[string]*Session{}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() || !sessionIDPattern.MatchString(id) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		s := &Session{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, fmt.Errorf("session %s: %v", id, err)
+		}
+		s.ID = id
+		sessions[id] = s
+	}
+	return sessions, nil
+}
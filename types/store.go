@@ -0,0 +1,124 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrKonfigNotFound = errors.New("konfig not found")
+
+// KonfigInfo describes the current version of a stored konfig.
+type KonfigInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// KonfigStore persists konfigs as raw JSON together with their revision
+// history. Save adds a new revision unless the data equals the latest one.
+type KonfigStore interface {
+	Save(name string, data []byte) error
+	Load(name string) ([]byte, error)
+	Delete(name string) error
+	List() ([]KonfigInfo, error)
+	Revisions(name string) ([]Revision, error)
+	LoadRevision(name string, rev int) ([]byte, error)
+	Close() error
+}
+
+// WatchableStore is implemented by stores whose changes can be noticed by
+// watching a directory.
+type WatchableStore interface {
+	WatchDir() string
+}
+
+// MigrateKonfigs moves konfigs still stored as <name>.json directly in
+// ModelPath (the layout before KonfigStore) into store, including their
+// revision history. Only JSON files with a "model" key are treated as
+// konfigs. It returns the names of the migrated konfigs.
+func MigrateKonfigs(ModelPath string, store KonfigStore) ([]string, error) {
+	files, err := os.ReadDir(ModelPath)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := []string{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), ".json")
+		path := filepath.Join(ModelPath, file.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return migrated, err
+		}
+		var probe map[string]json.RawMessage
+		if json.Unmarshal(data, &probe) != nil || probe["model"] == nil {
+			continue
+		}
+		if _, err := store.Load(name); err == nil {
+			// already present in the store, don't overwrite it
+			continue
+		}
+
+		// Replay the old history first, so revisions keep their order
+		historyDir := filepath.Join(ModelPath, "."+name+".history")
+		old := &FileStore{dir: ModelPath}
+		revs, _ := old.Revisions(name)
+		for _, rev := range revs {
+			revData, err := old.LoadRevision(name, rev.Rev)
+			if err != nil {
+				return migrated, err
+			}
+			if err := store.Save(name, revData); err != nil {
+				return migrated, err
+			}
+		}
+		if err := store.Save(name, data); err != nil {
+			return migrated, err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return migrated, err
+		}
+		os.RemoveAll(historyDir)
+		migrated = append(migrated, name)
+	}
+	return migrated, nil
+}
+
+func (m *Model_Request) Save(store KonfigStore) error {
+	data, err := m.marshalSet()
+	if err != nil {
+		return err
+	}
+	return store.Save(m.ModelName, data)
+}
+
+func (m *Model_Request) Load(store KonfigStore, name string) error {
+	data, err := store.Load(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, m)
+}
+
+// Delete removes the konfig. Its revision history is kept, so a deleted
+// konfig can be restored with a rollback.
+func (m *Model_Request) Delete(store KonfigStore) error {
+	return store.Delete(m.ModelName)
+}
+
+// LoadRevision loads revision rev of the konfig name into m.
+func (m *Model_Request) LoadRevision(store KonfigStore, name string, rev int) error {
+	data, err := store.LoadRevision(name, rev)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, m)
+}
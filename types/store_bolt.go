@@ -0,0 +1,191 @@
+package types
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltKonfigs   = []byte("konfigs")
+	boltRevisions = []byte("revisions")
+)
+
+const boltLockTimeout = 5 * time.Second
+
+// BoltStore keeps konfigs in an embedded bbolt database. The database is
+// only opened for the duration of each operation, so several chatterbox
+// instances on one host can share the same file.
+type BoltStore struct {
+	path string
+}
+
+type boltRecord struct {
+	Time time.Time       `json:"time"`
+	Data json.RawMessage `json:"data"`
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	b := &BoltStore{path: path}
+	err := b.update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltKonfigs); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltRevisions)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *BoltStore) WatchDir() string {
+	return filepath.Dir(b.path)
+}
+
+func (b *BoltStore) Close() error {
+	return nil
+}
+
+func (b *BoltStore) open(readOnly bool) (*bolt.DB, error) {
+	return bolt.Open(b.path, 0644, &bolt.Options{Timeout: boltLockTimeout, ReadOnly: readOnly})
+}
+
+func (b *BoltStore) update(fn func(*bolt.Tx) error) error {
+	db, err := b.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+func (b *BoltStore) view(fn func(*bolt.Tx) error) error {
+	db, err := b.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+func revKey(rev int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(rev))
+	return key
+}
+
+func (b *BoltStore) Save(name string, data []byte) error {
+	record, err := json.Marshal(boltRecord{Time: time.Now(), Data: data})
+	if err != nil {
+		return err
+	}
+	return b.update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(boltKonfigs).Put([]byte(name), record); err != nil {
+			return err
+		}
+		revs, err := tx.Bucket(boltRevisions).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		// Skip the revision if nothing changed
+		if _, last := revs.Cursor().Last(); last != nil {
+			var prev boltRecord
+			if json.Unmarshal(last, &prev) == nil && bytes.Equal(prev.Data, data) {
+				return nil
+			}
+		}
+		seq, err := revs.NextSequence()
+		if err != nil {
+			return err
+		}
+		return revs.Put(revKey(int(seq)), record)
+	})
+}
+
+func (b *BoltStore) Load(name string) ([]byte, error) {
+	var data []byte
+	err := b.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltKonfigs).Get([]byte(name))
+		if v == nil {
+			return ErrKonfigNotFound
+		}
+		var record boltRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		data = record.Data
+		return nil
+	})
+	return data, err
+}
+
+func (b *BoltStore) Delete(name string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltKonfigs)
+		if bucket.Get([]byte(name)) == nil {
+			return ErrKonfigNotFound
+		}
+		return bucket.Delete([]byte(name))
+	})
+}
+
+func (b *BoltStore) List() ([]KonfigInfo, error) {
+	konfigs := []KonfigInfo{}
+	err := b.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltKonfigs).ForEach(func(k, v []byte) error {
+			var record boltRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			konfigs = append(konfigs, KonfigInfo{Name: string(k), Size: int64(len(record.Data)), ModTime: record.Time})
+			return nil
+		})
+	})
+	return konfigs, err
+}
+
+func (b *BoltStore) Revisions(name string) ([]Revision, error) {
+	revisions := []Revision{}
+	err := b.view(func(tx *bolt.Tx) error {
+		revs := tx.Bucket(boltRevisions).Bucket([]byte(name))
+		if revs == nil {
+			return nil
+		}
+		return revs.ForEach(func(k, v []byte) error {
+			var record boltRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			revisions = append(revisions, Revision{Rev: int(binary.BigEndian.Uint64(k)), Time: record.Time, Size: int64(len(record.Data))})
+			return nil
+		})
+	})
+	return revisions, err
+}
+
+func (b *BoltStore) LoadRevision(name string, rev int) ([]byte, error) {
+	var data []byte
+	err := b.view(func(tx *bolt.Tx) error {
+		revs := tx.Bucket(boltRevisions).Bucket([]byte(name))
+		if revs == nil {
+			return ErrKonfigNotFound
+		}
+		v := revs.Get(revKey(rev))
+		if v == nil {
+			return ErrKonfigNotFound
+		}
+		var record boltRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return err
+		}
+		data = record.Data
+		return nil
+	})
+	return data, err
+}
@@ -0,0 +1,197 @@
+package types
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FileStore keeps each konfig as <name>.json in a directory, with revisions
+// in a hidden ".<name>.history" directory next to it.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex //serializes writes, so concurrent saves get distinct revisions
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (f *FileStore) WatchDir() string {
+	return f.dir
+}
+
+func (f *FileStore) Close() error {
+	return nil
+}
+
+func (f *FileStore) path(name string) (string, error) {
+	return SafeJoin(f.dir, name+".json")
+}
+
+func (f *FileStore) historyDir(name string) (string, error) {
+	return SafeJoin(f.dir, "."+name+".history")
+}
+
+func (f *FileStore) Save(name string, data []byte) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	//the revision goes first, so a crash in between never leaves the
+	//current content out of the history
+	if err := f.addRevision(name, data); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func (f *FileStore) Load(name string) ([]byte, error) {
+	path, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrKonfigNotFound
+	}
+	return data, err
+}
+
+func (f *FileStore) Delete(name string) error {
+	path, err := f.path(name)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrKonfigNotFound
+	}
+	return err
+}
+
+func (f *FileStore) List() ([]KonfigInfo, error) {
+	files, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	konfigs := []KonfigInfo{}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		konfigs = append(konfigs, KonfigInfo{
+			Name:    strings.TrimSuffix(file.Name(), ".json"),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return konfigs, nil
+}
+
+// addRevision stores data as the next revision of the konfig name, unless it
+// is identical to the latest revision.
+func (f *FileStore) addRevision(name string, data []byte) error {
+	dir, err := f.historyDir(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	revs, err := f.Revisions(name)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(revs) > 0 {
+		last := revs[len(revs)-1].Rev
+		if prev, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(last)+".json")); err == nil && bytes.Equal(prev, data) {
+			return nil
+		}
+		next = last + 1
+	}
+	return writeFileAtomic(filepath.Join(dir, strconv.Itoa(next)+".json"), data)
+}
+
+func (f *FileStore) Revisions(name string) ([]Revision, error) {
+	dir, err := f.historyDir(name)
+	if err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Revision{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	revs := []Revision{}
+	for _, file := range files {
+		rev, err := strconv.Atoi(strings.TrimSuffix(file.Name(), ".json"))
+		if err != nil || file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil {
+			continue
+		}
+		revs = append(revs, Revision{Rev: rev, Time: info.ModTime(), Size: info.Size()})
+	}
+	sort.Slice(revs, func(i, j int) bool { return revs[i].Rev < revs[j].Rev })
+	return revs, nil
+}
+
+func (f *FileStore) LoadRevision(name string, rev int) ([]byte, error) {
+	dir, err := f.historyDir(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, strconv.Itoa(rev)+".json"))
+	if os.IsNotExist(err) {
+		return nil, ErrKonfigNotFound
+	}
+	return data, err
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and
+// renames it over path, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,89 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Tokenize_Request struct {
+	Content string `json:"content"`
+}
+
+type Tokenize_Response struct {
+	Tokens []int `json:"tokens"`
+}
+
+type Detokenize_Request struct {
+	Tokens []int `json:"tokens"`
+}
+
+type Detokenize_Response struct {
+	Content string `json:"content"`
+}
+
+type ChatMessage struct {
+	Role       string     `json:"role"` //system, user, assistant or tool
+	Content    string     `json:"content"`
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`   //calls made by an assistant message
+	ToolCallID string     `json:"tool_call_id,omitempty"` //call a tool message answers
+}
+
+// Count_Request asks for the token count of a prompt or of a chat rendered
+// with the konfig's chat template. Exactly one of both must be set.
+type Count_Request struct {
+	Prompt   string        `json:"prompt,omitempty"`
+	Messages []ChatMessage `json:"messages,omitempty"`
+}
+
+type Count_Response struct {
+	Tokens      int `json:"tokens"`
+	ContextSize int `json:"contextSize"` //context of one slot, 0 if the konfig leaves it to the model
+	Remaining   int `json:"remaining"`   //negative if the prompt doesn't fit
+}
+
+// Chat templates for rendering message lists into a prompt.
+const (
+	ChatTemplateChatML = "chatml"
+	ChatTemplateLlama2 = "llama2"
+)
+
+// RenderChat renders messages into a prompt that ends where the assistant's
+// answer starts.
+func RenderChat(template string, messages []ChatMessage) (string, error) {
+	var sb strings.Builder
+	switch template {
+	case "", ChatTemplateChatML:
+		for _, m := range messages {
+			fmt.Fprintf(&sb, "<|im_start|>%s\n%s<|im_end|>\n", m.Role, m.Content)
+		}
+		sb.WriteString("<|im_start|>assistant\n")
+	case ChatTemplateLlama2:
+		system := ""
+		for _, m := range messages {
+			switch m.Role {
+			case "system":
+				system = "<<SYS>>\n" + m.Content + "\n<</SYS>>\n\n"
+			case "user":
+				fmt.Fprintf(&sb, "<s>[INST] %s%s [/INST]", system, m.Content)
+				system = ""
+			default:
+				fmt.Fprintf(&sb, " %s </s>", m.Content)
+			}
+		}
+	default:
+		return "", fmt.Errorf("unknown chat template %q", template)
+	}
+	return sb.String(), nil
+}
+
+// ChatStop returns the stop words that end the assistant's turn in template.
+func ChatStop(template string) []string {
+	switch template {
+	case "", ChatTemplateChatML:
+		return []string{"<|im_end|>"}
+	case ChatTemplateLlama2:
+		return []string{"</s>", "[INST]"}
+	}
+	return nil
+}
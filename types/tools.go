@@ -0,0 +1,195 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Tool is a function the model may call, as in the OpenAI chat API.
+type Tool struct {
+	Type     string      `json:"type"` //always "function"
+	Function FunctionDef `json:"function"`
+}
+
+type FunctionDef struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"` //JSON Schema of the arguments
+}
+
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"` //always "function"
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` //JSON encoded
+}
+
+// Tool choices besides naming a function.
+const (
+	ToolChoiceNone     = "none"
+	ToolChoiceAuto     = "auto"
+	ToolChoiceRequired = "required"
+)
+
+// ToolChoice is "none", "auto", "required" or
+// {"type": "function", "function": {"name": ...}} to force that function.
+type ToolChoice struct {
+	Mode     string //none, auto or required, empty if Function is set
+	Function string
+}
+
+func (c ToolChoice) MarshalJSON() ([]byte, error) {
+	if c.Function == "" {
+		return json.Marshal(c.Mode)
+	}
+	return json.Marshal(map[string]interface{}{
+		"type":     "function",
+		"function": map[string]string{"name": c.Function},
+	})
+}
+
+func (c *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		*c = ToolChoice{Mode: mode}
+		return nil
+	}
+	var named struct {
+		Function struct {
+			Name string `json:"name"`
+		} `json:"function"`
+	}
+	if err := json.Unmarshal(data, &named); err != nil || named.Function.Name == "" {
+		return fmt.Errorf(`tool_choice must be "none", "auto", "required" or name a function`)
+	}
+	*c = ToolChoice{Function: named.Function.Name}
+	return nil
+}
+
+// Forced reports whether the model has to call a tool.
+func (c *ToolChoice) Forced() bool {
+	return c != nil && (c.Mode == ToolChoiceRequired || c.Function != "")
+}
+
+// Tags wrapping tool calls and tool results in prompts. Models trained on the
+// Hermes function calling format use them with chatml.
+const (
+	ToolCallStart     = "<tool_call>"
+	ToolCallEnd       = "</tool_call>"
+	toolResponseStart = "<tool_response>"
+	toolResponseEnd   = "</tool_response>"
+)
+
+// toolPrompt describes tools to the model and how to call them.
+func toolPrompt(tools []Tool) string {
+	var sb strings.Builder
+	sb.WriteString("You may call one or more functions to answer. The functions are described as JSON Schema:\n<tools>\n")
+	for _, t := range tools {
+		data, _ := json.Marshal(t)
+		sb.Write(data)
+		sb.WriteByte('\n')
+	}
+	sb.WriteString("</tools>\nTo call a function, answer with a JSON object holding its name and arguments inside tool_call tags:\n")
+	sb.WriteString(ToolCallStart + "\n{\"name\": <function name>, \"arguments\": <arguments object>}\n" + ToolCallEnd)
+	return sb.String()
+}
+
+// formatToolCall renders a call the way the model is asked to make it.
+func formatToolCall(call ToolCall) string {
+	args := json.RawMessage(call.Function.Arguments)
+	if !json.Valid(args) {
+		args, _ = json.Marshal(call.Function.Arguments)
+	}
+	data, _ := json.Marshal(struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}{call.Function.Name, args})
+	return ToolCallStart + "\n" + string(data) + "\n" + ToolCallEnd
+}
+
+// ToolMessages prepares a chat with tools for RenderChat: the tools are
+// described in the system message, tool calls of assistant messages are
+// rendered into their content and tool results become messages of a role
+// template knows, "tool" for chatml and "user" otherwise.
+func ToolMessages(template string, messages []ChatMessage, tools []Tool) []ChatMessage {
+	out := make([]ChatMessage, 0, len(messages)+1)
+	if len(tools) > 0 {
+		prompt := toolPrompt(tools)
+		if len(messages) > 0 && messages[0].Role == "system" {
+			prompt = messages[0].Content + "\n\n" + prompt
+			messages = messages[1:]
+		}
+		out = append(out, ChatMessage{Role: "system", Content: prompt})
+	}
+	for _, m := range messages {
+		switch {
+		case m.Role == "assistant" && len(m.ToolCalls) > 0:
+			parts := []string{}
+			if m.Content != "" {
+				parts = append(parts, m.Content)
+			}
+			for _, call := range m.ToolCalls {
+				parts = append(parts, formatToolCall(call))
+			}
+			out = append(out, ChatMessage{Role: "assistant", Content: strings.Join(parts, "\n")})
+		case m.Role == "tool":
+			role := "user"
+			if template == "" || template == ChatTemplateChatML {
+				role = "tool"
+			}
+			out = append(out, ChatMessage{Role: role, Content: toolResponseStart + "\n" + m.Content + "\n" + toolResponseEnd})
+		default:
+			out = append(out, ChatMessage{Role: m.Role, Content: m.Content})
+		}
+	}
+	return out
+}
+
+// ParseToolCalls extracts the tool calls from a model's answer. It returns
+// the text outside of the calls and the calls, with ids made by newID.
+// Calls that aren't a JSON object with a name are left in the text.
+func ParseToolCalls(content string, newID func() string) (string, []ToolCall) {
+	var text strings.Builder
+	calls := []ToolCall{}
+	rest := content
+	for {
+		before, after, found := strings.Cut(rest, ToolCallStart)
+		if !found {
+			text.WriteString(rest)
+			break
+		}
+		body, tail, closed := strings.Cut(after, ToolCallEnd)
+		var call struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal([]byte(body), &call); err != nil || call.Name == "" {
+			text.WriteString(before + ToolCallStart)
+			rest = after
+			continue
+		}
+		text.WriteString(before)
+		args := &bytes.Buffer{}
+		if len(call.Arguments) == 0 || json.Compact(args, call.Arguments) != nil {
+			args.Reset()
+			args.WriteString("{}")
+		}
+		calls = append(calls, ToolCall{
+			ID:       newID(),
+			Type:     "function",
+			Function: FunctionCall{Name: call.Name, Arguments: args.String()},
+		})
+		if !closed {
+			//the stop word may have cut the closing tag
+			break
+		}
+		rest = tail
+	}
+	return strings.TrimSpace(text.String()), calls
+}
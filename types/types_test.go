@@ -1,6 +1,15 @@
 package types
 
-import "testing"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
 
 func Test_NewModelRequestWithDefaults(t *testing.T) {
 	mr := NewModelRequestWithDefaults()
@@ -15,3 +24,406 @@ func Test_NewPredictionRequestWithDefaults(t *testing.T) {
 		t.Errorf("TopP should be 0.95, got %v", pr.TopP)
 	}
 }
+
+func Test_ValidateReportsAllErrors(t *testing.T) {
+	mr := NewModelRequestWithDefaults()
+	mr.Model = "missing.gguf"
+	mr.ContextSize = -1
+	mr.Port = 70000
+
+	err := mr.Validate(t.TempDir())
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("expected *ValidationError, got %v", err)
+	}
+	want := map[string]bool{"/model": true, "/contextSize": true, "/port": true}
+	if len(verr.Errors) != len(want) {
+		t.Fatalf("expected %d errors, got %v", len(want), verr.Errors)
+	}
+	for _, fe := range verr.Errors {
+		if !want[fe.Pointer] {
+			t.Errorf("unexpected error for %s: %s", fe.Pointer, fe.Message)
+		}
+	}
+}
+
+func Test_PredictionRequestValidate(t *testing.T) {
+	pr := NewPredictionRequestWithDefaults()
+	pr.Grammar = `# a list of words
+root ::= word ("," ws word)*
+word ::= [a-zA-Z\-]+ | "\"" [^"]{1,8} "\""
+ws   ::= (
+  " " | "\t"
+)?
+`
+	if err := pr.Validate(0); err != nil {
+		t.Fatalf("valid request rejected: %v", err)
+	}
+	//llama.cpp lets the last definition of a rule win
+	pr.Grammar = "root ::= \"a\"\nroot ::= \"b\"\n"
+	if err := pr.Validate(0); err != nil {
+		t.Errorf("redefined rule rejected: %v", err)
+	}
+
+	for grammar, want := range map[string]string{
+		`word ::= "a"`:      "root rule",
+		`root ::= word`:     "undefined rule",
+		`root ::= "a`:       "end of input",
+		`root ::= [a-\q]`:   "unknown escape",
+		`root ::= "a" ("b"`: "expecting ')'",
+		`root ::= * "a"`:    "preceding item",
+		`root ::= "a"{3,1}`: "below minimum",
+	} {
+		pr.Grammar = grammar
+		err := pr.Validate(0)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("grammar %q: expected error containing %q, got %v", grammar, want, err)
+		}
+	}
+
+	pr = NewPredictionRequestWithDefaults()
+	pr.NPredict = 100
+	if err := pr.Validate(64); err == nil {
+		t.Error("n_predict above the cap accepted")
+	}
+}
+
+func Test_StoresKeepRevisions(t *testing.T) {
+	fileStore, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	boltStore, err := NewBoltStore(t.TempDir() + "/konfigs.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range []KonfigStore{fileStore, boltStore} {
+		mr := NewModelRequestWithDefaults()
+		mr.ModelName = "konfig"
+		mr.Save(store)
+		mr.Save(store) // unchanged, no new revision
+		mr.ContextSize = 8192
+		if err := mr.Save(store); err != nil {
+			t.Fatal(err)
+		}
+
+		revs, err := store.Revisions("konfig")
+		if err != nil || len(revs) != 2 {
+			t.Fatalf("%T: expected 2 revisions, got %v, %v", store, revs, err)
+		}
+		first := NewModelRequestWithDefaults()
+		if err := first.LoadRevision(store, "konfig", 1); err != nil {
+			t.Fatal(err)
+		}
+		diffs, _ := Diff(first, mr)
+		if len(diffs) != 1 || diffs[0].Pointer != "/contextSize" {
+			t.Errorf("%T: expected a single /contextSize diff, got %v", store, diffs)
+		}
+
+		if err := mr.Delete(store); err != nil {
+			t.Fatal(err)
+		}
+		if err := mr.Load(store, "konfig"); err != ErrKonfigNotFound {
+			t.Errorf("%T: expected ErrKonfigNotFound after delete, got %v", store, err)
+		}
+	}
+}
+
+func Test_FileStoreConcurrentSaves(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := store.Save("konfig", []byte(fmt.Sprintf(`{"contextSize":%d}`, i))); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	revs, _ := store.Revisions("konfig")
+	if len(revs) != 20 {
+		t.Errorf("expected 20 revisions, got %d", len(revs))
+	}
+	current, _ := store.Load("konfig")
+	latest, _ := store.LoadRevision("konfig", len(revs))
+	if !bytes.Equal(current, latest) {
+		t.Errorf("current konfig %s is not the latest revision %s", current, latest)
+	}
+}
+
+func Test_MigrateKonfigs(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/old.json", []byte(`{"model":"m.gguf"}`), 0644)
+	os.WriteFile(dir+"/other.json", []byte(`{"routes":[]}`), 0644)
+	store, _ := NewFileStore(dir + "/konfigs")
+
+	migrated, err := MigrateKonfigs(dir, store)
+	if err != nil || len(migrated) != 1 || migrated[0] != "old" {
+		t.Fatalf("expected old to be migrated, got %v, %v", migrated, err)
+	}
+	if _, err := os.Stat(dir + "/old.json"); !os.IsNotExist(err) {
+		t.Errorf("old.json should have been moved")
+	}
+	if _, err := os.Stat(dir + "/other.json"); err != nil {
+		t.Errorf("other.json is no konfig and should be left alone")
+	}
+	if _, err := store.Load("old"); err != nil {
+		t.Errorf("old not in store: %v", err)
+	}
+}
+
+func Test_ResolveExtends(t *testing.T) {
+	store, _ := NewFileStore(t.TempDir())
+	base := NewModelRequestWithDefaults()
+	base.ModelName = "base"
+	base.Model = "base.gguf"
+	base.ContextSize = 8192
+	base.Decription = &Descriptor{Prompt: "base prompt", Comment: "base"}
+	base.Save(store)
+
+	child := NewModelRequestWithDefaults()
+	child.ModelName = "child"
+	child.Model = "child.gguf"
+	child.Extends = "base"
+	child.Decription = &Descriptor{Comment: "child"}
+
+	resolved, err := child.Resolve(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Model != "child.gguf" || resolved.ContextSize != 8192 {
+		t.Errorf("unexpected merge result: %+v", resolved)
+	}
+	if resolved.Decription.Prompt != "base prompt" || resolved.Decription.Comment != "child" {
+		t.Errorf("description not deep merged: %+v", resolved.Decription)
+	}
+	if base.Decription.Comment != "base" {
+		t.Errorf("base was modified by merge")
+	}
+
+	base.Extends = "child"
+	child.Save(store)
+	base.Save(store)
+	if _, err := child.Resolve(store); err == nil {
+		t.Errorf("expected cycle error")
+	}
+}
+
+func Test_ResolveExplicitDefaults(t *testing.T) {
+	store, _ := NewFileStore(t.TempDir())
+	base := NewModelRequestWithDefaults()
+	json.Unmarshal([]byte(`{"modelName":"base","model":"base.gguf","embeddings":true,"nGpuLayers":33,"mainGpu":"1",
+		"defaults":{"temperature":0.2,"top_k":10},"presets":{"creative":{"temperature":1.2,"top_k":80}}}`), base)
+	base.Save(store)
+
+	// the child is stored and loaded again, so omitempty mustn't drop its false and 0
+	child := NewModelRequestWithDefaults()
+	json.Unmarshal([]byte(`{"modelName":"child","extends":"base","embeddings":false,"nGpuLayers":0,
+		"defaults":{"temperature":0.8},"presets":{"creative":{"top_k":40}}}`), child)
+	child.Save(store)
+	child = NewModelRequestWithDefaults()
+	if err := child.Load(store, "child"); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, err := child.Resolve(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Embeddings || resolved.NGPULayers != 0 {
+		t.Errorf("explicit defaults of the child not applied: %+v", resolved)
+	}
+	if resolved.Model != "base.gguf" || resolved.MainGPU != "1" {
+		t.Errorf("fields missing in the child not inherited: %+v", resolved)
+	}
+	if resolved.Defaults.Temperature != 0.8 || resolved.Defaults.TopK != 10 {
+		t.Errorf("defaults not merged by key: %+v", resolved.Defaults)
+	}
+	//the merged defaults still set the temperature, although to its default
+	if _, ok := resolved.Defaults.SetFields()["temperature"]; !ok {
+		t.Errorf("merged defaults lost their fields: %v", resolved.Defaults.SetFields())
+	}
+	if p := resolved.Presets["creative"]; p.Temperature != 1.2 || p.TopK != 40 {
+		t.Errorf("preset not merged by key: %+v", p)
+	}
+}
+
+// roundTrip decodes the recorded payload into v, encodes it again and
+// returns the recorded and the re-encoded payload as generic JSON.
+func roundTrip(t *testing.T, file string, v interface{}) (map[string]interface{}, map[string]interface{}) {
+	t.Helper()
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("%s: %v", file, err)
+	}
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded, again := map[string]interface{}{}, map[string]interface{}{}
+	json.Unmarshal(data, &recorded)
+	json.Unmarshal(encoded, &again)
+	return recorded, again
+}
+
+func Test_PredictionRequestRoundTrip(t *testing.T) {
+	req := &Prediction_Request{}
+	recorded, again := roundTrip(t, "testdata/completion_request.json", req)
+	for k, v := range recorded {
+		if !reflect.DeepEqual(again[k], v) {
+			t.Errorf("%s: recorded %v, re-encoded %v", k, v, again[k])
+		}
+	}
+
+	want := LogitBias{{Token: 15043, Bias: 1.5}, {Piece: " Hello", Bias: -0.5}, {Token: 2, Ban: true}}
+	if !reflect.DeepEqual(req.LogitBias, want) {
+		t.Errorf("logit bias: got %+v", req.LogitBias)
+	}
+	if req.IDSlot != 1 || req.PenalizeNl || req.ImageData[0].ID != 12 {
+		t.Errorf("unexpected request %+v", req)
+	}
+
+	object := &Prediction_Request{}
+	if err := json.Unmarshal([]byte(`{"logit_bias":{"15043":1.5," Hello":false},"slot_id":3}`), object); err != nil {
+		t.Fatal(err)
+	}
+	want = LogitBias{{Piece: " Hello", Ban: true}, {Token: 15043, Bias: 1.5}}
+	if !reflect.DeepEqual(object.LogitBias, want) || object.IDSlot != 3 {
+		t.Errorf("object logit bias or legacy slot_id: got %+v, slot %d", object.LogitBias, object.IDSlot)
+	}
+}
+
+func Test_ResultRoundTrip(t *testing.T) {
+	res := &Result{}
+	recorded, again := roundTrip(t, "testdata/completion_result.json", res)
+	if !reflect.DeepEqual(recorded, again) {
+		for k, v := range recorded {
+			if !reflect.DeepEqual(again[k], v) {
+				t.Errorf("%s: recorded %v, re-encoded %v", k, v, again[k])
+			}
+		}
+		for k := range again {
+			if _, ok := recorded[k]; !ok {
+				t.Errorf("%s: not in the recorded payload", k)
+			}
+		}
+	}
+	if len(res.CompletionProbabilities) != 4 || res.CompletionProbabilities[0].Probs[1].TokStr != " Research" {
+		t.Errorf("completion probabilities: %+v", res.CompletionProbabilities)
+	}
+
+	legacy := &Result{}
+	roundTrip(t, "testdata/completion_result_legacy.json", legacy)
+	if legacy.IDSlot != 2 || legacy.Content != " Hi" {
+		t.Errorf("legacy result: %+v", legacy)
+	}
+}
+
+func Test_ParseToolCalls(t *testing.T) {
+	n := 0
+	newID := func() string {
+		n++
+		return fmt.Sprintf("call_%d", n)
+	}
+	text, calls := ParseToolCalls("Let me check.\n<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Bern\"}}\n</tool_call>\n<tool_call>\n{\"name\": \"get_time\"}", newID)
+	if text != "Let me check." {
+		t.Errorf("unexpected text %q", text)
+	}
+	want := []ToolCall{
+		{ID: "call_1", Type: "function", Function: FunctionCall{Name: "get_weather", Arguments: `{"city":"Bern"}`}},
+		{ID: "call_2", Type: "function", Function: FunctionCall{Name: "get_time", Arguments: "{}"}},
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("expected %+v, got %+v", want, calls)
+	}
+
+	text, calls = ParseToolCalls("<tool_call>not json</tool_call>", newID)
+	if len(calls) != 0 || text != "<tool_call>not json</tool_call>" {
+		t.Errorf("invalid call parsed: %q %+v", text, calls)
+	}
+}
+
+func Test_PinCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		nodes   []int
+		cpus    []string
+		replica int
+		want    []string
+	}{
+		{"no pinning", nil, nil, 0, []string{}},
+		{"numa node", []int{0, 1}, nil, 1, []string{"numactl", "--cpunodebind=1", "--membind=1"}},
+		{"numa nodes wrap", []int{0, 1}, nil, 2, []string{"numactl", "--cpunodebind=0", "--membind=0"}},
+		{"cpu set", nil, []string{"0-7", "8-15"}, 1, []string{"taskset", "-c", "8-15"}},
+		{"cpu sets wrap", nil, []string{"0-7", "8-15"}, 3, []string{"taskset", "-c", "8-15"}},
+		{"numa before cpu sets", []int{1}, []string{"0-7"}, 0, []string{"numactl", "--cpunodebind=1", "--membind=1"}},
+	} {
+		mr := NewModelRequestWithDefaults()
+		mr.NUMANodes = tc.nodes
+		mr.CPUSets = tc.cpus
+		if got := mr.PinCommand(tc.replica); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func Test_PresetZerosRoundTrip(t *testing.T) {
+	mr := NewModelRequestWithDefaults()
+	if err := json.Unmarshal([]byte(`{"presets":{"greedy":{"temperature":0,"top_k":0,"top_p":0,"seed":0}}}`), mr); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(mr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := NewModelRequestWithDefaults()
+	if err := json.Unmarshal(data, reloaded); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"temperature": float32(0), "top_k": 0, "top_p": float32(0), "seed": 0}
+	if got := reloaded.Presets["greedy"].Overrides(); !reflect.DeepEqual(got, want) {
+		t.Errorf("preset reloaded as %v, want %v", got, want)
+	}
+
+	//a zero that isn't the default must survive marshaling
+	typ := reflect.TypeOf(Prediction_Request{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		def := field.Tag.Get("default")
+		if strings.Contains(field.Tag.Get("json"), "omitempty") && def != "" && def != "0" && def != "0.0" && def != "false" {
+			t.Errorf("%s has the default %s but is omitted when zero", field.Name, def)
+		}
+	}
+}
+
+func Test_ChatStop(t *testing.T) {
+	for body, want := range map[string][]string{
+		`{"stop":"\n"}`:          {"\n"},
+		`{"stop":["a","b"]}`:     {"a", "b"},
+		`{"stop":[]}`:            {},
+		`{"model":"m"}`:          nil,
+		`{"stop":null,"seed":1}`: nil,
+	} {
+		req := ChatCompletion_Request{}
+		if err := json.Unmarshal([]byte(body), &req); err != nil {
+			t.Errorf("%s: %v", body, err)
+			continue
+		}
+		if !reflect.DeepEqual([]string(req.Stop), want) {
+			t.Errorf("%s: stop %#v, want %#v", body, req.Stop, want)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"stop":3}`), &ChatCompletion_Request{}); err == nil {
+		t.Error("numeric stop accepted")
+	}
+}
@@ -0,0 +1,258 @@
+package types
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/schnapper79/chatterbox/grammar"
+)
+
+var cpuSetPattern = regexp.MustCompile(`^[0-9]+(-[0-9]+)?(,[0-9]+(-[0-9]+)?)*$`)
+
+// FieldError describes a problem with a single field, addressed by a JSON
+// pointer into the konfig (RFC 6901).
+type FieldError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects all problems found in a konfig or request.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.Pointer + ": " + fe.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) add(pointer, format string, args ...interface{}) {
+	e.Errors = append(e.Errors, FieldError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks the konfig for values llama.cpp would reject and for
+// referenced files that don't exist inside ModelPath. All problems are returned at once as a
+// *ValidationError.
+func (m *Model_Request) Validate(ModelPath string) error {
+	verr := &ValidationError{}
+
+	switch m.Backend {
+	case "", BackendLlamaCpp:
+		if m.Model == "" {
+			verr.add("/model", "is required")
+		} else if err := checkFile(ModelPath, m.Model); err != nil {
+			verr.add("/model", "%s: %v", m.Model, err)
+		}
+	case BackendOpenAI:
+		//the weights live upstream, model is only the name sent there
+		if m.Upstream == nil || m.Upstream.URL == "" {
+			verr.add("/upstream/url", "is required by the %s backend", m.Backend)
+		} else if u, err := url.Parse(m.Upstream.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			verr.add("/upstream/url", "must be an absolute http(s) URL, got %q", m.Upstream.URL)
+		}
+		if m.Model == "" && (m.Upstream == nil || m.Upstream.Model == "") {
+			verr.add("/model", "is required")
+		}
+	default:
+		verr.add("/backend", "unknown backend %q", m.Backend)
+	}
+	if m.ContextSize < 0 {
+		verr.add("/contextSize", "must not be negative, got %d", m.ContextSize)
+	}
+	if m.NBatch < 1 {
+		verr.add("/nBatch", "must be at least 1, got %d", m.NBatch)
+	}
+	if m.NGPULayers < 0 {
+		verr.add("/nGpuLayers", "must not be negative, got %d", m.NGPULayers)
+	}
+	if m.FreqRopeBase < 0 {
+		verr.add("/freqRopeBase", "must not be negative, got %v", m.FreqRopeBase)
+	}
+	if m.FreqRopeScale < 0 {
+		verr.add("/freqRopeScale", "must not be negative, got %v", m.FreqRopeScale)
+	}
+	if m.ParallelSlots < 1 {
+		verr.add("/parallelSlots", "must be at least 1, got %d", m.ParallelSlots)
+	}
+	if m.Replicas < 1 {
+		verr.add("/replicas", "must be at least 1, got %d", m.Replicas)
+	}
+	for i, set := range m.CPUSets {
+		if !cpuSetPattern.MatchString(set) {
+			verr.add(fmt.Sprintf("/cpuSets/%d", i), "invalid cpu list %q", set)
+		}
+	}
+	for i, node := range m.NUMANodes {
+		if node < 0 {
+			verr.add(fmt.Sprintf("/numaNodes/%d", i), "must not be negative, got %d", node)
+		}
+	}
+	if m.Port < 1 || m.Port > 65535 {
+		verr.add("/port", "must be between 1 and 65535, got %d", m.Port)
+	}
+	if m.Host == "" {
+		verr.add("/host", "is required")
+	}
+	switch m.ChatTemplate {
+	case "", ChatTemplateChatML, ChatTemplateLlama2:
+	default:
+		verr.add("/chatTemplate", "unknown chat template %q", m.ChatTemplate)
+	}
+	if m.MaxNPredict < 0 {
+		verr.add("/maxNPredict", "must not be negative, got %d", m.MaxNPredict)
+	}
+	if m.Defaults != nil {
+		m.Defaults.validate(verr, "/defaults", m.MaxNPredict)
+	}
+	for name, preset := range m.Presets {
+		if preset != nil {
+			preset.validate(verr, "/presets/"+pointerEscape(name), m.MaxNPredict)
+		}
+	}
+	if m.LoraAdapter != "" {
+		if err := checkFile(ModelPath, m.LoraAdapter); err != nil {
+			verr.add("/loraAdapter", "%s: %v", m.LoraAdapter, err)
+		}
+	}
+	if m.LoraBase != "" {
+		if err := checkFile(ModelPath, m.LoraBase); err != nil {
+			verr.add("/loraBase", "%s: %v", m.LoraBase, err)
+		}
+	}
+	if m.SystemPromtFile != "" {
+		if err := checkFile(ModelPath, m.SystemPromtFile); err != nil {
+			verr.add("/systemPromptFile", "%s: %v", m.SystemPromtFile, err)
+		}
+	}
+
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// checkFile checks that name is a regular file inside ModelPath.
+func checkFile(ModelPath, name string) error {
+	path, err := SafeJoin(ModelPath, name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("file does not exist")
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("is a directory")
+	}
+	return nil
+}
+
+// Validate checks the sampling parameters of a completion request for values
+// llama.cpp would reject or misbehave on. With maxNPredict > 0, n_predict
+// must not exceed it. All problems are returned at once as a
+// *ValidationError.
+func (p *Prediction_Request) Validate(maxNPredict int) error {
+	verr := &ValidationError{}
+	p.validate(verr, "", maxNPredict)
+	if len(verr.Errors) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func (p *Prediction_Request) validate(verr *ValidationError, prefix string, maxNPredict int) {
+	if p.Temperature < 0 {
+		verr.add(prefix+"/temperature", "must not be negative, got %v", p.Temperature)
+	}
+	if p.TopP <= 0 || p.TopP > 1 {
+		verr.add(prefix+"/top_p", "must be in (0, 1], got %v", p.TopP)
+	}
+	if p.MinP < 0 || p.MinP > 1 {
+		verr.add(prefix+"/min_p", "must be in [0, 1], got %v", p.MinP)
+	}
+	if p.TypicalP <= 0 || p.TypicalP > 1 {
+		verr.add(prefix+"/typical_p", "must be in (0, 1], got %v", p.TypicalP)
+	}
+	if p.Tfs_z <= 0 || p.Tfs_z > 1 {
+		verr.add(prefix+"/tfs_z", "must be in (0, 1], got %v", p.Tfs_z)
+	}
+	if p.RepeatPenalty < 0 {
+		verr.add(prefix+"/repeat_penalty", "must not be negative, got %v", p.RepeatPenalty)
+	}
+	if p.RepeatLastN < -1 {
+		verr.add(prefix+"/repeat_last_n", "must be -1 or more, got %d", p.RepeatLastN)
+	}
+	switch p.Mirostat {
+	case 0, 1, 2:
+	default:
+		verr.add(prefix+"/mirostat", "must be 0, 1 or 2, got %d", p.Mirostat)
+	}
+	if p.Mirostat != 0 && p.MirostatTAU <= 0 {
+		verr.add(prefix+"/mirostat_tau", "must be positive, got %v", p.MirostatTAU)
+	}
+	if p.Mirostat != 0 && p.MirostatETA <= 0 {
+		verr.add(prefix+"/mirostat_eta", "must be positive, got %v", p.MirostatETA)
+	}
+	if p.NPredict < -1 {
+		verr.add(prefix+"/n_predict", "must be -1 or more, got %d", p.NPredict)
+	} else if maxNPredict > 0 && p.NPredict > maxNPredict {
+		verr.add(prefix+"/n_predict", "must not exceed %d, got %d", maxNPredict, p.NPredict)
+	}
+	if p.NKeep < -1 {
+		verr.add(prefix+"/n_keep", "must be -1 or more, got %d", p.NKeep)
+	}
+	if p.NProbs < 0 {
+		verr.add(prefix+"/n_probs", "must not be negative, got %d", p.NProbs)
+	}
+	if p.MinKeep < 0 {
+		verr.add(prefix+"/min_keep", "must not be negative, got %d", p.MinKeep)
+	}
+	if p.NDiscard < 0 {
+		verr.add(prefix+"/n_discard", "must not be negative, got %d", p.NDiscard)
+	}
+	if p.Grammar != "" {
+		if err := grammar.Check(p.Grammar); err != nil {
+			verr.add(prefix+"/grammar", "%v", err)
+		}
+	}
+	constraints := 0
+	for _, set := range []bool{p.Grammar != "", p.GrammarName != "", p.ResponseFormat != nil} {
+		if set {
+			constraints++
+		}
+	}
+	if constraints > 1 {
+		verr.add(prefix+"/grammar", "only one of grammar, grammar_name and response_format may be set")
+	}
+	if f := p.ResponseFormat; f != nil {
+		switch f.Type {
+		case ResponseFormatJSONObject, ResponseFormatJSONSchema:
+		default:
+			verr.add(prefix+"/response_format/type", "must be %s or %s, got %q", ResponseFormatJSONObject, ResponseFormatJSONSchema, f.Type)
+		}
+		schema := f.SchemaJSON()
+		if f.Type == ResponseFormatJSONSchema && len(schema) == 0 {
+			verr.add(prefix+"/response_format/schema", "is required for %s", ResponseFormatJSONSchema)
+		} else if len(schema) > 0 {
+			if s, err := grammar.ParseSchema(schema); err != nil {
+				verr.add(prefix+"/response_format/schema", "%v", err)
+			} else if _, err := s.Grammar(); err != nil {
+				verr.add(prefix+"/response_format/schema", "%v", err)
+			}
+		}
+	}
+}
+
+// pointerEscape escapes a key for use in a JSON pointer.
+func pointerEscape(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
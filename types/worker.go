@@ -0,0 +1,36 @@
+package types
+
+import "time"
+
+// Capacity is what a worker reports about its resources and load.
+type Capacity struct {
+	CPUs     int   `json:"cpus"`
+	Replicas int   `json:"replicas"` //running llama.cpp servers
+	Slots    int   `json:"slots"`    //parallel slots over all replicas
+	InFlight int64 `json:"inFlight"` //requests currently proxied
+}
+
+// WorkerInfo is sent by a worker when registering and with every heartbeat.
+type WorkerInfo struct {
+	ID       string    `json:"id"`
+	URL      string    `json:"url"` //base URL the coordinator reaches the worker at
+	Models   []string  `json:"models"`
+	Capacity Capacity  `json:"capacity"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func (w *WorkerInfo) HasModel(name string) bool {
+	for _, m := range w.Models {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone returns a copy of w that shares nothing with it.
+func (w *WorkerInfo) Clone() *WorkerInfo {
+	c := *w
+	c.Models = append([]string{}, w.Models...)
+	return &c
+}
@@ -0,0 +1,430 @@
+package chatterbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/schnapper79/chatterbox/types"
+)
+
+// WorkerHeader reports the worker that served a request routed by the
+// coordinator.
+const WorkerHeader = "X-Chatterbox-Worker"
+
+// WorkerSecretHeader carries the secret shared by the coordinator and its
+// workers on registration, heartbeats and deregistration.
+const WorkerSecretHeader = "X-Chatterbox-Worker-Secret"
+
+const (
+	heartbeatInterval = 10 * time.Second
+	heartbeatTimeout  = 3 * heartbeatInterval
+)
+
+// workerInfo describes this instance for registering with a coordinator.
+func (s *Server) workerInfo(id, advertiseURL string) *types.WorkerInfo {
+	info := &types.WorkerInfo{
+		ID:       id,
+		URL:      advertiseURL,
+		Models:   []string{},
+		Capacity: types.Capacity{CPUs: runtime.NumCPU()},
+	}
+	s.mu.RLock()
+	for name, pool := range s.LoadedModels {
+		info.Models = append(info.Models, name)
+		for _, r := range pool.Runners() {
+			info.Capacity.Replicas++
+			info.Capacity.Slots += r.Config.ParallelSlots
+			info.Capacity.InFlight += r.InFlight()
+		}
+	}
+	s.mu.RUnlock()
+	return info
+}
+
+// RunWorker registers this instance with the coordinator and keeps sending
+// heartbeats until ctx is done, then deregisters. If the coordinator has
+// forgotten the worker (e.g. after a restart) it registers again.
+func (s *Server) RunWorker(ctx context.Context, coordinatorURL, advertiseURL, id string) {
+	base := strings.TrimSuffix(coordinatorURL, "/")
+	registered := false
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		info := s.workerInfo(id, advertiseURL)
+		var err error
+		if registered {
+			err = s.postJSON(ctx, base+"/api/v1/workers/"+url.PathEscape(id)+"/heartbeat", info)
+			if err == errNotFound {
+				registered = false
+				err = s.postJSON(ctx, base+"/api/v1/workers/register", info)
+			}
+		} else {
+			err = s.postJSON(ctx, base+"/api/v1/workers/register", info)
+		}
+		if err != nil {
+			logger.Warn("Heartbeat to coordinator failed: ", err)
+		} else if !registered {
+			registered = true
+			logger.Infof("Registered as worker %s with %s", id, coordinatorURL)
+		}
+
+		select {
+		case <-ctx.Done():
+			if registered {
+				deregister, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				req, _ := http.NewRequestWithContext(deregister, http.MethodDelete, base+"/api/v1/workers/"+url.PathEscape(id), nil)
+				req.Header.Set(WorkerSecretHeader, s.WorkerSecret)
+				if resp, err := http.DefaultClient.Do(req); err == nil {
+					resp.Body.Close()
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var errNotFound = fmt.Errorf("not found")
+
+// postJSON posts v to the coordinator with the worker secret.
+func (s *Server) postJSON(ctx context.Context, target string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WorkerSecretHeader, s.WorkerSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", target, resp.Status)
+	}
+	return nil
+}
+
+// reapWorkers deregisters workers that missed their heartbeats.
+func (s *Server) reapWorkers(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.reapStaleWorkers()
+	}
+}
+
+// reapStaleWorkers deregisters the workers not heard of for heartbeatTimeout.
+func (s *Server) reapStaleWorkers() {
+	s.mu.Lock()
+	removed := []*types.WorkerInfo{}
+	for id, worker := range s.workers {
+		if time.Since(worker.LastSeen) > heartbeatTimeout {
+			delete(s.workers, id)
+			removed = append(removed, worker)
+		}
+	}
+	s.mu.Unlock()
+	for _, worker := range removed {
+		logger.Warnf("Worker %s missed its heartbeats, deregistered", worker.ID)
+		s.Events.Publish(EventWorkerRemoved, worker)
+	}
+}
+
+// workerAuthorized checks the worker secret of r. Without a secret
+// configured, the coordinator accepts no workers at all.
+func (s *Server) workerAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if s.WorkerSecret == "" {
+		http.Error(w, "Worker registration is disabled, no worker secret is configured", http.StatusForbidden)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(WorkerSecretHeader)), []byte(s.WorkerSecret)) != 1 {
+		http.Error(w, "Invalid worker secret", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// workerFor returns the least loaded worker hosting modelname.
+func (s *Server) workerFor(modelname string) (*types.WorkerInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var best *types.WorkerInfo
+	for _, worker := range s.workers {
+		if !worker.HasModel(modelname) {
+			continue
+		}
+		if best == nil || worker.Capacity.InFlight < best.Capacity.InFlight {
+			best = worker
+		}
+	}
+	return best, best != nil
+}
+
+// routeToWorker forwards r to a worker serving target, the model picked for
+// the name r was sent to. It reports false if no worker has target.
+func (s *Server) routeToWorker(w http.ResponseWriter, r *http.Request, name, target string) bool {
+	worker, ok := s.workerFor(target)
+	if !ok {
+		return false
+	}
+	s.forwardToWorker(w, r, worker, name, target)
+	return true
+}
+
+// forwardToWorker forwards r to worker. If a route picked a model other than
+// the name r was sent to, the request is rewritten to name target: the
+// {model} path variable, or else the model field of the JSON body.
+func (s *Server) forwardToWorker(w http.ResponseWriter, r *http.Request, worker *types.WorkerInfo, name, target string) {
+	if target != name {
+		if prefix := "/api/v1/" + name + "/"; mux.Vars(r)["model"] == name && strings.HasPrefix(r.URL.Path, prefix) {
+			r.URL.Path = "/api/v1/" + target + "/" + strings.TrimPrefix(r.URL.Path, prefix)
+		} else if err := setBodyField(r, "model", target); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	s.remoteProxy(w, r, worker)
+}
+
+// remoteProxy forwards a request unchanged to the same path on worker.
+func (s *Server) remoteProxy(w http.ResponseWriter, r *http.Request, worker *types.WorkerInfo) {
+	target, err := url.Parse(strings.TrimSuffix(worker.URL, "/") + r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	target.RawQuery = r.URL.RawQuery
+	w.Header().Set(WorkerHeader, worker.ID)
+	s.forward(w, r, target, nil)
+}
+
+func (s *Server) registerWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.workerAuthorized(w, r) {
+		return
+	}
+	info := &types.WorkerInfo{}
+	err := json.NewDecoder(r.Body).Decode(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if info.ID == "" || info.URL == "" {
+		http.Error(w, "Worker id and url are required", http.StatusBadRequest)
+		return
+	}
+	info.LastSeen = time.Now()
+
+	s.mu.Lock()
+	s.workers[info.ID] = info
+	s.mu.Unlock()
+
+	//the registered info is shared, publish a copy
+	s.Events.Publish(EventWorkerRegistered, info.Clone())
+	w.Write([]byte("Worker registered"))
+}
+
+func (s *Server) heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the worker id from the path
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !s.workerAuthorized(w, r) {
+		return
+	}
+	info := &types.WorkerInfo{}
+	err := json.NewDecoder(r.Body).Decode(info)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	//only the load changes, where the worker is reached stays as registered
+	s.mu.Lock()
+	registered, ok := s.workers[id]
+	if ok {
+		updated := registered.Clone()
+		updated.Models = info.Models
+		updated.Capacity = info.Capacity
+		updated.LastSeen = time.Now()
+		s.workers[id] = updated
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Worker not registered", http.StatusNotFound)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+func (s *Server) deregisterWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the worker id from the path
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	if !s.workerAuthorized(w, r) {
+		return
+	}
+	s.mu.Lock()
+	worker, ok := s.workers[id]
+	delete(s.workers, id)
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, "Worker not registered", http.StatusNotFound)
+		return
+	}
+
+	s.Events.Publish(EventWorkerRemoved, worker)
+	w.Write([]byte("Worker deregistered"))
+}
+
+func (s *Server) getWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	//copies, the originals may change once the lock is released
+	s.mu.RLock()
+	workers := make([]*types.WorkerInfo, 0, len(s.workers))
+	for _, worker := range s.workers {
+		workers = append(workers, worker.Clone())
+	}
+	s.mu.RUnlock()
+	json.NewEncoder(w).Encode(workers)
+}
+
+// updateWorker replaces the registered info of worker id by a changed copy.
+// Registered infos are never changed in place, so they can be read after
+// the lock is released.
+func (s *Server) updateWorker(id string, change func(*types.WorkerInfo)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if worker, ok := s.workers[id]; ok {
+		updated := worker.Clone()
+		change(updated)
+		s.workers[id] = updated
+	}
+}
+
+// workerRequest sends a request to the API of worker.
+func workerRequest(ctx context.Context, worker *types.WorkerInfo, method, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(worker.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// loadOnWorkerHandler resolves one of the coordinator's konfigs and loads it
+// on the chosen worker. The worker needs the referenced weights in its own
+// model directory.
+func (s *Server) loadOnWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the worker id and konfig from the path
+	vars := mux.Vars(r)
+	id := vars["id"]
+	konfigname := vars["konfig"]
+
+	s.mu.RLock()
+	worker, ok := s.workers[id]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, "Worker not registered", http.StatusNotFound)
+		return
+	}
+
+	config := types.NewModelRequestWithDefaults()
+	err := config.Load(s.Konfigs, konfigname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	config.ModelName = konfigname
+	resolved, err := config.Resolve(s.Konfigs)
+	if err != nil {
+		writeError(w, err, http.StatusBadRequest)
+		return
+	}
+	//the worker may not have the base konfigs, send it fully resolved
+	resolved.Extends = ""
+
+	data, err := json.Marshal(resolved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resp, err := workerRequest(r.Context(), worker, http.MethodPost, "/api/v1/"+url.PathEscape(konfigname)+"/load", data)
+	if err != nil {
+		http.Error(w, "Failed to reach worker: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		// Route to the worker right away instead of waiting for its heartbeat
+		s.updateWorker(id, func(worker *types.WorkerInfo) {
+			if !worker.HasModel(konfigname) {
+				worker.Models = append(worker.Models, konfigname)
+			}
+		})
+	}
+	w.Header().Set(WorkerHeader, worker.ID)
+	copyResponse(w, resp)
+}
+
+// unloadOnWorkerHandler unloads a model on the chosen worker.
+func (s *Server) unloadOnWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	// Access the worker id and model from the path
+	vars := mux.Vars(r)
+	id := vars["id"]
+	modelname := vars["model"]
+
+	s.mu.RLock()
+	worker, ok := s.workers[id]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, "Worker not registered", http.StatusNotFound)
+		return
+	}
+
+	resp, err := workerRequest(r.Context(), worker, http.MethodGet, "/api/v1/"+url.PathEscape(modelname)+"/unload", nil)
+	if err != nil {
+		http.Error(w, "Failed to reach worker: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		s.updateWorker(id, func(worker *types.WorkerInfo) {
+			for i, m := range worker.Models {
+				if m == modelname {
+					worker.Models = append(worker.Models[:i], worker.Models[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+	w.Header().Set(WorkerHeader, worker.ID)
+	copyResponse(w, resp)
+}